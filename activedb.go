@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// names of the databases created for playgrounds are md5 hashes
+var dbNameRegex = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// write the last use of active databases to config.activeDBFile, so
+// that they are still tracked after a restart
+func (s *server) saveActiveDB() error {
+
+	if s.config.activeDBFile == "" {
+		return nil
+	}
+
+	active := map[string]int64{}
+	s.activeDB.Range(func(k, v interface{}) bool {
+		active[k.(string)] = v.(int64)
+		return true
+	})
+	content, err := json.Marshal(active)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so the file is never
+	// partially written
+	tmp, err := ioutil.TempFile(filepath.Dir(s.config.activeDBFile), ".activeDB")
+	if err != nil {
+		return fmt.Errorf("fail to save active databases: %v", err)
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.config.activeDBFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("fail to save active databases: %v", err)
+	}
+	return nil
+}
+
+// load the last use of active databases saved by saveActiveDB. A missing
+// file is not an error, as nothing was saved yet
+func loadActiveDB(name string) (map[string]int64, error) {
+	content, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return map[string]int64{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("fail to load active databases: %v", err)
+	}
+	var active map[string]int64
+	if err := json.Unmarshal(content, &active); err != nil {
+		return nil, fmt.Errorf("fail to load active databases from %s: %v", name, err)
+	}
+	return active, nil
+}
+
+// reconcile the databases of playgrounds found in mongod with the ones
+// saved by a previous run of the server. Databases still in use are tracked
+// again, and the others are dropped: they are either expired, or unknown
+// because the server stopped before saving them, and may be incomplete
+func (s *server) reconcileDB() error {
+
+	if s.config.activeDBFile == "" {
+		return nil
+	}
+	saved, err := loadActiveDB(s.config.activeDBFile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	kept, dropped := 0, 0
+	for _, b := range s.backends {
+		session := b.session.Copy()
+		defer session.Close()
+
+		names, err := session.DatabaseNames()
+		if err != nil {
+			return fmt.Errorf("fail to list databases of mongodb %s: %v", b.version, err)
+		}
+		for _, name := range names {
+			if !dbNameRegex.MatchString(name) {
+				continue
+			}
+			lastUse, ok := saved[name]
+			if ok && now.Sub(time.Unix(lastUse, 0)) <= s.config.expireInterval {
+				s.activeDB.Store(name, lastUse)
+				size, err := databaseSize(session.DB(name))
+				if err != nil {
+					s.logger.Printf("fail to get size of database %s: %v", name, err)
+				}
+				s.dbSizes.Store(name, size)
+				kept++
+				continue
+			}
+			if err := session.DB(name).DropDatabase(); err != nil {
+				return fmt.Errorf("fail to drop database %s: %v", name, err)
+			}
+			s.metrics.droppedDatabase()
+			dropped++
+		}
+	}
+	s.logger.Printf("found %d active databases, dropped %d stale databases", kept, dropped)
+	return nil
+}
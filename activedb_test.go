@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSaveActiveDB(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "activeDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "activeDB.json")
+
+	active, err := loadActiveDB(file)
+	if err != nil {
+		t.Errorf("missing file should not be an error, but got %v", err)
+	}
+	if len(active) != 0 {
+		t.Errorf("expected no active databases, but got %v", active)
+	}
+
+	s := &server{
+		logger: log.New(ioutil.Discard, "", 0),
+		config: &config{activeDBFile: file},
+	}
+	s.activeDB.Store("a6f3fa2e5b1e56fb2b4dee0f4ec5e7a7", int64(1500000000))
+	s.activeDB.Store("f3cbd6e5bcdf9e2ef5c3fdb3e9e2f10c", int64(1600000000))
+
+	if err := s.saveActiveDB(); err != nil {
+		t.Fatalf("fail to save active databases: %v", err)
+	}
+	active, err = loadActiveDB(file)
+	if err != nil {
+		t.Fatalf("fail to load active databases: %v", err)
+	}
+	want := map[string]int64{
+		"a6f3fa2e5b1e56fb2b4dee0f4ec5e7a7": 1500000000,
+		"f3cbd6e5bcdf9e2ef5c3fdb3e9e2f10c": 1600000000,
+	}
+	if len(active) != len(want) {
+		t.Errorf("expected %v, but got %v", want, active)
+	}
+	for name, lastUse := range want {
+		if active[name] != lastUse {
+			t.Errorf("expected last use of %s to be %d, but got %d", name, lastUse, active[name])
+		}
+	}
+
+	// no temporary file left behind
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected only %s in %s, but found %d files", file, dir, len(files))
+	}
+
+	ioutil.WriteFile(file, []byte("{"), 0644)
+	if _, err := loadActiveDB(file); err == nil {
+		t.Errorf("expected an error for an invalid file")
+	}
+}
+
+func TestReconcileDB(t *testing.T) {
+
+	testServer.clearDatabases(t)
+	defer testServer.clearDatabases(t)
+
+	dir, err := ioutil.TempDir("", "activeDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "activeDB.json")
+
+	const (
+		active  = "0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a0a"
+		expired = "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b"
+		unknown = "0c0c0c0c0c0c0c0c0c0c0c0c0c0c0c0c"
+		other   = "reconcile"
+	)
+	for _, name := range []string{active, expired, unknown, other} {
+		if err := testServer.session.DB(name).C("collection").Insert(map[string]int{"k": 1}); err != nil {
+			t.Fatalf("fail to create database %s: %v", name, err)
+		}
+	}
+	defer testServer.session.DB(other).DropDatabase()
+
+	s := &server{
+		logger:   log.New(ioutil.Discard, "", 0),
+		backends: testServer.backends,
+		metrics:  newMetrics(),
+		config:   &config{activeDBFile: file, expireInterval: time.Hour},
+	}
+	s.activeDB.Store(active, time.Now().Unix())
+	s.activeDB.Store(expired, time.Now().Add(-2*time.Hour).Unix())
+	if err := s.saveActiveDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a restart
+	s.activeDB.Delete(active)
+	s.activeDB.Delete(expired)
+
+	if err := s.reconcileDB(); err != nil {
+		t.Fatalf("fail to reconcile databases: %v", err)
+	}
+
+	names, err := testServer.session.DatabaseNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, name := range names {
+		found[name] = true
+	}
+	if !found[active] {
+		t.Errorf("active database %s should not be dropped", active)
+	}
+	if !found[other] {
+		t.Errorf("database %s is not a playground database and should not be dropped", other)
+	}
+	for _, name := range []string{expired, unknown} {
+		if found[name] {
+			t.Errorf("stale database %s should be dropped", name)
+		}
+	}
+
+	var tracked []string
+	s.activeDB.Range(func(k, v interface{}) bool {
+		tracked = append(tracked, k.(string))
+		return true
+	})
+	sort.Strings(tracked)
+	if len(tracked) != 1 || tracked[0] != active {
+		t.Errorf("expected only %s to be tracked, but got %v", active, tracked)
+	}
+	if want, got := uint64(2), s.metrics.droppedDB; want != got {
+		t.Errorf("expected %d dropped databases, but got %d", want, got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/feliixx/mgodatagen/datagen/generators"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// return the fields of content computed by an aggregator, ie of type
+// countAggregator, valueAggregator or boundAggregator
+func aggregatorFields(content map[string]generators.Config) (map[string]generators.Config, error) {
+
+	fields := map[string]generators.Config{}
+	for k, v := range content {
+		switch v.Type {
+		case generators.TypeCountAggregator, generators.TypeValueAggregator, generators.TypeBoundAggregator:
+			fields[k] = v
+		}
+	}
+	// make sure that the configuration of the aggregators is valid before
+	// creating the database. The database is replaced when aggregators are
+	// run, so any name will do here
+	_, err := newAggregators("db", fields)
+	return fields, err
+}
+
+// create the aggregators computing fields, run against the database dbName
+func newAggregators(dbName string, fields map[string]generators.Config) ([]generators.Aggregator, error) {
+
+	content := make(map[string]generators.Config, len(fields))
+	for k, v := range fields {
+		v.Database = dbName
+		content[k] = v
+	}
+	ci := generators.NewCollInfo(1, nil, 0, nil, nil)
+	return ci.NewAggregatorSlice(content)
+}
+
+// compute the fields of a collection that are generated by an aggregator. This
+// has to be done once all collections are inserted, as aggregators query other
+// collections of the database.
+//
+// The database of the aggregators is always db, whatever the database specified
+// in the configuration. Commands are bounded by the timeout of l
+func runAggregators(db *mgo.Database, name string, fields map[string]generators.Config, l runLimits) error {
+
+	aggregators, err := newAggregators(db.Name, fields)
+	if err != nil {
+		return &invalidConfigError{err: err}
+	}
+
+	for _, aggregator := range aggregators {
+
+		var result struct {
+			Values []interface{} `bson:"values"`
+		}
+		err := db.Run(bson.D{
+			{Name: "distinct", Value: name},
+			{Name: "key", Value: aggregator.LocalVar()},
+			{Name: "maxTimeMS", Value: l.maxTimeMS()},
+		}, &result)
+		if err != nil {
+			return fmt.Errorf("fail to get distinct values for local field %v: %w", aggregator.LocalVar(), l.check(err))
+		}
+
+		for _, value := range result.Values {
+			// the queries of aggregators are part of the configuration
+			update, err := aggregator.Update(db.Session, value)
+			if err != nil {
+				return &invalidConfigError{err: err}
+			}
+			// the local field may not be unique, so update all matching documents
+			var written writeResult
+			err = db.Run(bson.D{
+				{Name: "update", Value: name},
+				{Name: "updates", Value: []bson.M{{"q": update[0], "u": update[1], "multi": true}}},
+				{Name: "maxTimeMS", Value: l.maxTimeMS()},
+			}, &written)
+			if err == nil && len(written.WriteErrors) > 0 {
+				err = &invalidConfigError{err: errors.New(written.WriteErrors[0].Errmsg)}
+			}
+			if err != nil {
+				return fmt.Errorf("fail to update collection %s: %w", name, l.check(err))
+			}
+		}
+	}
+	// aggregated fields can make the collection grow. As the database is
+	// not tracked yet, a collection too large is dropped right away
+	if err := l.checkCollection(db.C(name)); err != nil {
+		db.DropDatabase()
+		if e, ok := err.(*queryLimitError); ok {
+			return &invalidConfigError{err: fmt.Errorf("fail to aggregate fields of collection %s: %s", name, e.reason)}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// max size of the body of an api request
+const maxAPIBodySize = 1 << 20
+
+// kinds of error returned by the api
+const (
+	// the request itself is invalid, like a malformed body
+	requestError = "request"
+	// the configuration can't be parsed, or the database can't be created
+	configError = "config"
+	// a statement of the query can't be parsed
+	parseError = "parse"
+	// a statement of the query failed when run against mongodb
+	queryError = "query"
+	// a statement of the query exceeded the time limit, or returned
+	// too many documents
+	limitError = "limit"
+	// a statement of the query uses a blocked operator, like $out
+	forbiddenError = "forbidden"
+	// the client sent too many requests, or the server is too busy
+	// to create a new database
+	tooManyRequestsError = "tooManyRequests"
+	// no playground is saved with the requested ID
+	notFoundError = "notFound"
+	// the server failed, like when mongodb can't be reached
+	internalError = "internal"
+)
+
+// a playground, as sent to and returned by the api
+type apiPage struct {
+	// bson or mgodatagen
+	Mode   string `json:"mode"`
+	Config string `json:"config"`
+	Query  string `json:"query"`
+	// version of mongodb to run the query against. If empty,
+	// the default version is used
+	MongoVersion string `json:"mongoVersion,omitempty"`
+}
+
+func (a *apiPage) page() (*page, error) {
+	if a.Mode != "bson" && a.Mode != "mgodatagen" {
+		return nil, fmt.Errorf("invalid mode %q, expected bson or mgodatagen", a.Mode)
+	}
+	return &page{
+		Mode:         modeByte(a.Mode),
+		Config:       []byte(a.Config),
+		Query:        []byte(a.Query),
+		MongoVersion: []byte(a.MongoVersion),
+	}, nil
+}
+
+// a saved playground and its metadata, as returned by the api
+type apiSavedPage struct {
+	apiPage
+	// unset for playgrounds saved before metadata were recorded
+	Created    *time.Time `json:"created,omitempty"`
+	LastViewed *time.Time `json:"lastViewed,omitempty"`
+	Views      uint64     `json:"views"`
+	Runs       uint64     `json:"runs"`
+	// version of mongodb the playground was run against when it was saved
+	SavedVersion string `json:"savedVersion,omitempty"`
+}
+
+// body of every api response. Either Result or Error is set
+type apiResponse struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  *apiError   `json:"error,omitempty"`
+	Stats  *apiStats   `json:"stats,omitempty"`
+}
+
+type apiError struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// only set when a statement of the query failed
+	Position *apiPosition `json:"position,omitempty"`
+}
+
+type apiPosition struct {
+	// position of the failing statement in the script, starting at 1
+	Statement int `json:"statement"`
+	// position of the failing stage in the pipeline of the statement,
+	// starting at 1, if the stage is known
+	Stage int `json:"stage,omitempty"`
+}
+
+type apiStats struct {
+	// version of mongodb the query was run against
+	MongoVersion        string `json:"mongoVersion"`
+	ExecutionTimeMillis int64  `json:"executionTimeMillis"`
+}
+
+// result of a successful save
+type apiSaveResult struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+}
+
+// run a query and return the result as json
+func (s *server) apiRunHandler(w http.ResponseWriter, r *http.Request) {
+
+	p, ok := s.apiReadPage(w, r)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	outputs, err := s.runPage(p)
+	stats := &apiStats{
+		MongoVersion:        string(s.backend(p.MongoVersion).version),
+		ExecutionTimeMillis: time.Since(start).Nanoseconds() / int64(time.Millisecond),
+	}
+	if e, ok := err.(*throttledError); ok {
+		s.writeThrottled(w, r, e)
+		return
+	}
+	s.countRun(p)
+	if err != nil {
+		e := &apiError{
+			Kind:    runErrorKind(err),
+			Message: err.Error(),
+		}
+		if se, ok := err.(*statementError); ok {
+			e.Position = &apiPosition{Statement: se.statement}
+			if be, ok := se.err.(*blockedOperatorError); ok {
+				e.Position.Stage = be.stage
+			}
+		}
+		status := http.StatusBadRequest
+		switch e.Kind {
+		case queryError, limitError:
+			status = http.StatusUnprocessableEntity
+		case forbiddenError:
+			status = http.StatusForbidden
+		case internalError:
+			status = http.StatusInternalServerError
+		}
+		s.apiWrite(w, status, &apiResponse{Error: e, Stats: stats})
+		return
+	}
+	res, err := scriptJSON(outputs, len(splitScript(p.Query)))
+	if err != nil {
+		s.logger.Printf("fail to encode result of playground %s: %v", p.String(), err)
+		s.apiWriteError(w, http.StatusInternalServerError, internalError, "fail to encode result")
+		return
+	}
+	s.apiWrite(w, http.StatusOK, &apiResponse{
+		Result: res,
+		Stats:  stats,
+	})
+}
+
+// save the playground and return its ID and url
+func (s *server) apiSaveHandler(w http.ResponseWriter, r *http.Request) {
+
+	p, ok := s.apiReadPage(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := s.save(p)
+	if err != nil {
+		s.logger.Printf("fail to save playground %s with id %s: %v", p.String(), id, err)
+		s.apiWriteError(w, http.StatusInternalServerError, internalError, "fail to save playground")
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	s.apiWrite(w, http.StatusOK, &apiResponse{
+		Result: &apiSaveResult{
+			ID:  string(id),
+			URL: fmt.Sprintf("%s://%s/p/%s", scheme, r.Host, id),
+		},
+	})
+}
+
+// return a saved playground identified by its ID
+func (s *server) apiViewHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.apiWriteError(w, http.StatusMethodNotAllowed, requestError, "method should be GET, but was "+r.Method)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/p/")
+	p, err := s.loadPage([]byte(id))
+	if err != nil {
+		s.apiWriteError(w, http.StatusNotFound, notFoundError, "this playground doesn't exist")
+		return
+	}
+	s.apiWrite(w, http.StatusOK, &apiResponse{
+		Result: &apiSavedPage{
+			apiPage: apiPage{
+				Mode:         modeName(p.Mode),
+				Config:       string(p.Config),
+				Query:        string(p.Query),
+				MongoVersion: string(p.MongoVersion),
+			},
+			Created:      unixTime(p.CreatedAt),
+			LastViewed:   unixTime(p.LastViewedAt),
+			Views:        p.Views,
+			Runs:         p.Runs,
+			SavedVersion: string(p.SavedVersion),
+		},
+	})
+}
+
+// convert a unix timestamp to a time, or nil if it is 0
+func unixTime(ts int64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+	t := time.Unix(ts, 0).UTC()
+	return &t
+}
+
+// read the playground sent in the json body of a POST request. If the
+// request is invalid, the error is written to w and ok is false
+func (s *server) apiReadPage(w http.ResponseWriter, r *http.Request) (p *page, ok bool) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.apiWriteError(w, http.StatusMethodNotAllowed, requestError, "method should be POST, but was "+r.Method)
+		return nil, false
+	}
+
+	var a apiPage
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize)).Decode(&a)
+	if err == nil {
+		p, err = a.page()
+	}
+	if err != nil {
+		s.apiWriteError(w, http.StatusBadRequest, requestError, fmt.Sprintf("invalid request body: %v", err))
+		return nil, false
+	}
+	return p, true
+}
+
+func (s *server) apiWriteError(w http.ResponseWriter, status int, kind, message string) {
+	s.apiWrite(w, status, &apiResponse{
+		Error: &apiError{
+			Kind:    kind,
+			Message: message,
+		},
+	})
+}
+
+func (s *server) apiWrite(w http.ResponseWriter, status int, resp *apiResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		s.logger.Printf("fail to write api response: %v", err)
+	}
+}
+
+// kind of the error returned by a run
+func runErrorKind(err error) string {
+	switch e := err.(type) {
+	case *statementError:
+		return statementErrorKind(e)
+	case *throttledError:
+		return tooManyRequestsError
+	case *invalidConfigError:
+		return configError
+	}
+	return internalError
+}
+
+// tell whether a statement failed because it couldn't be parsed, because
+// it exceeded a limit or used a blocked operator, or because mongodb
+// returned an error
+func statementErrorKind(e *statementError) string {
+	switch e.err.(type) {
+	case *queryLimitError:
+		return limitError
+	case *blockedOperatorError:
+		return forbiddenError
+	case *queryParseError:
+		return parseError
+	}
+	return queryError
+}
+
+// output of a script as a json array. For a single statement, this is the
+// array of documents it returned. For several statements, this is an array
+// holding the array of documents of each statement
+func scriptJSON(outputs []*queryOutput, n int) (json.RawMessage, error) {
+
+	if n == 1 {
+		return outputs[0].json()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, out := range outputs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		res, err := out.json()
+		if err != nil {
+			return nil, &statementError{statement: i + 1, err: err}
+		}
+		buf.Write(bytes.TrimSuffix(res, []byte{'\n'}))
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestAPIRun(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	apiRunTests := []struct {
+		name         string
+		method       string
+		body         string
+		responseCode int
+		result       string
+		err          *apiError
+	}{
+		{
+			name:         "valid query",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.collection.find()"}`,
+			responseCode: http.StatusOK,
+			result:       `[{"_id":1}]`,
+		},
+		{
+			name:         "no document found",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.collection.find({\"_id\":2})"}`,
+			responseCode: http.StatusOK,
+			result:       `[]`,
+		},
+		{
+			name:         "count",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.collection.find().count()"}`,
+			responseCode: http.StatusOK,
+			result:       `[{"count":1}]`,
+		},
+		{
+			name:         "script",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.collection.find();db.collection.find({\"_id\":2})"}`,
+			responseCode: http.StatusOK,
+			result:       `[[{"_id":1}],[]]`,
+		},
+		{
+			name:         "invalid configuration",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"{}","query":"db.collection.find()"}`,
+			responseCode: http.StatusBadRequest,
+			err:          &apiError{Kind: configError, Message: "error in configuration:\n  " + invalidConfig},
+		},
+		{
+			name:         "invalid query",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.collection.find();find()"}`,
+			responseCode: http.StatusBadRequest,
+			err:          &apiError{Kind: parseError, Message: invalidQuery, Position: &apiPosition{Statement: 2}},
+		},
+		{
+			name:         "unknown cursor method",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.collection.find().batchSize(1)"}`,
+			responseCode: http.StatusBadRequest,
+			err:          &apiError{Kind: parseError, Message: "query failed: invalid method: batchSize", Position: &apiPosition{Statement: 1}},
+		},
+		{
+			name:         "missing collection",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.other.find()"}`,
+			responseCode: http.StatusUnprocessableEntity,
+			err:          &apiError{Kind: queryError, Message: `collection "other" doesn't exist`, Position: &apiPosition{Statement: 1}},
+		},
+		{
+			name:         "blocked operator",
+			method:       http.MethodPost,
+			body:         `{"mode":"bson","config":"[{\"_id\":1}]","query":"db.collection.aggregate([{\"$match\":{}},{\"$out\":\"other\"}])"}`,
+			responseCode: http.StatusForbidden,
+			err:          &apiError{Kind: forbiddenError, Message: "operator $out is not allowed, but was found in stage 2 of the pipeline", Position: &apiPosition{Statement: 1, Stage: 2}},
+		},
+		{
+			name:         "unknown mode",
+			method:       http.MethodPost,
+			body:         `{"mode":"json","config":"[{\"_id\":1}]","query":"db.collection.find()"}`,
+			responseCode: http.StatusBadRequest,
+			err:          &apiError{Kind: requestError, Message: `invalid request body: invalid mode "json", expected bson or mgodatagen`},
+		},
+		{
+			name:         "malformed body",
+			method:       http.MethodPost,
+			body:         `mode=bson`,
+			responseCode: http.StatusBadRequest,
+			err:          &apiError{Kind: requestError, Message: "invalid request body: invalid character 'm' looking for beginning of value"},
+		},
+		{
+			name:         "wrong method",
+			method:       http.MethodGet,
+			responseCode: http.StatusMethodNotAllowed,
+			err:          &apiError{Kind: requestError, Message: "method should be POST, but was GET"},
+		},
+	}
+
+	for _, tt := range apiRunTests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := apiResponseOf(t, testServer.apiRunHandler, tt.method, "/api/v1/run", tt.body, tt.responseCode)
+
+			if tt.err == nil {
+				if resp.Error != nil {
+					t.Fatalf("expected no error, but got %v", resp.Error.Message)
+				}
+				result, err := json.Marshal(resp.Result)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want, got := tt.result, string(result); want != got {
+					t.Errorf("expected result %s, but got %s", want, got)
+				}
+				return
+			}
+			checkAPIError(t, tt.err, resp.Error)
+		})
+	}
+
+	testStorageContent(t, 1, 0)
+}
+
+func TestRunErrorKind(t *testing.T) {
+
+	t.Parallel()
+
+	runErrorKindTests := []struct {
+		name string
+		err  error
+		kind string
+	}{
+		{
+			name: "invalid configuration",
+			err:  &invalidConfigError{err: errors.New("error in configuration")},
+			kind: configError,
+		},
+		{
+			name: "configuration rejected by mongodb",
+			err:  rejectedConfig(fmt.Errorf("fail to create indexes on collection c: %w", &mgo.QueryError{Code: 85, Message: "index already exists"})),
+			kind: configError,
+		},
+		{
+			name: "duplicate key in configuration",
+			err:  rejectedConfig(&mgo.BulkError{}),
+			kind: configError,
+		},
+		{
+			name: "mongodb unreachable",
+			err:  rejectedConfig(io.EOF),
+			kind: internalError,
+		},
+		{
+			name: "unknown error",
+			err:  errors.New("no reachable servers"),
+			kind: internalError,
+		},
+		{
+			name: "unknown cursor method",
+			err:  &statementError{statement: 1, err: invalidMethod("batchSize")},
+			kind: parseError,
+		},
+		{
+			name: "failing statement",
+			err:  &statementError{statement: 1, err: errors.New("query failed")},
+			kind: queryError,
+		},
+		{
+			name: "statement over limit",
+			err:  &statementError{statement: 1, err: &queryLimitError{}},
+			kind: limitError,
+		},
+		{
+			name: "blocked operator",
+			err:  &statementError{statement: 1, err: &blockedOperatorError{}},
+			kind: forbiddenError,
+		},
+		{
+			name: "throttled",
+			err:  &throttledError{},
+			kind: tooManyRequestsError,
+		},
+	}
+
+	for _, tt := range runErrorKindTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runErrorKind(tt.err); got != tt.kind {
+				t.Errorf("expected kind %s, but got %s", tt.kind, got)
+			}
+		})
+	}
+}
+
+func TestScriptJSON(t *testing.T) {
+
+	t.Parallel()
+
+	scriptJSONTests := []struct {
+		name       string
+		outputs    []*queryOutput
+		statements int
+		result     string
+	}{
+		{
+			name:       "documents",
+			outputs:    []*queryOutput{{docs: []interface{}{bson.M{"_id": 1}, bson.M{"_id": 2}}}},
+			statements: 1,
+			result:     `[{"_id":1},{"_id":2}]`,
+		},
+		{
+			name:       "extended json",
+			outputs:    []*queryOutput{{docs: []interface{}{bson.D{{Name: "_id", Value: bson.ObjectIdHex("5a934e000102030405000000")}, {Name: "d", Value: time.Unix(0, 0)}}}}},
+			statements: 1,
+			result:     `[{"_id":{"$oid":"5a934e000102030405000000"},"d":{"$date":"1970-01-01T00:00:00Z"}}]`,
+		},
+		{
+			name:       "no document found",
+			outputs:    []*queryOutput{{}},
+			statements: 1,
+			result:     `[]`,
+		},
+		{
+			name:       "count",
+			outputs:    []*queryOutput{{counted: true, count: 3}},
+			statements: 1,
+			result:     `[{"count":3}]`,
+		},
+		{
+			name:       "script",
+			outputs:    []*queryOutput{{docs: []interface{}{bson.M{"_id": 1}}}, {}, {counted: true}},
+			statements: 3,
+			result:     `[[{"_id":1}],[],[{"count":0}]]`,
+		},
+	}
+
+	for _, tt := range scriptJSONTests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := scriptJSON(tt.outputs, tt.statements)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, res); err != nil {
+				t.Fatalf("invalid json %s: %v", res, err)
+			}
+			if want, got := tt.result, buf.String(); want != got {
+				t.Errorf("expected result %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestAPISaveAndView(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	body := `{"mode":"mgodatagen","config":` + jsonString(templateConfig) + `,"query":"` + templateQuery + `"}`
+	resp := apiResponseOf(t, testServer.apiSaveHandler, http.MethodPost, "/api/v1/save", body, http.StatusOK)
+	result, _ := resp.Result.(map[string]interface{})
+	if want, got := "http://playground.test/"+templateURL, result["url"]; want != got {
+		t.Errorf("expected url %s, but got %v", want, got)
+	}
+
+	resp = apiResponseOf(t, testServer.apiViewHandler, http.MethodGet, "/api/v1/p/"+result["id"].(string), "", http.StatusOK)
+	page, _ := resp.Result.(map[string]interface{})
+	if page["mode"] != "mgodatagen" || page["config"] != templateConfig || page["query"] != templateQuery {
+		t.Errorf("expected the saved playground, but got %v", page)
+	}
+	if page["views"] != 1.0 || page["runs"] != 0.0 || page["created"] == nil || page["savedVersion"] == nil {
+		t.Errorf("expected metadata of the saved playground, but got %v", page)
+	}
+
+	resp = apiResponseOf(t, testServer.apiViewHandler, http.MethodGet, "/api/v1/p/random", "", http.StatusNotFound)
+	checkAPIError(t, &apiError{Kind: notFoundError, Message: "this playground doesn't exist"}, resp.Error)
+
+	testStorageContent(t, 0, 1)
+}
+
+func apiResponseOf(t *testing.T, handler func(http.ResponseWriter, *http.Request), method, url, body string, responseCode int) *apiResponse {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "playground.test"
+	resp := httptest.NewRecorder()
+	handler(resp, req)
+
+	if responseCode != resp.Code {
+		t.Errorf("expected response code %d, but got %d", responseCode, resp.Code)
+	}
+	if want, got := "application/json; charset=utf-8", resp.Header().Get("Content-Type"); want != got {
+		t.Errorf("expected content type %s, but got %s", want, got)
+	}
+	var r apiResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &r); err != nil {
+		t.Fatalf("fail to decode response %s: %v", resp.Body, err)
+	}
+	return &r
+}
+
+func checkAPIError(t *testing.T, want, got *apiError) {
+	if got == nil {
+		t.Fatalf("expected error %s, but got none", want.Message)
+	}
+	if want.Kind != got.Kind || want.Message != got.Message {
+		t.Errorf("expected error %s: %s, but got %s: %s", want.Kind, want.Message, got.Kind, got.Message)
+	}
+	if (want.Position == nil) != (got.Position == nil) || want.Position != nil && *want.Position != *got.Position {
+		t.Errorf("expected position %v, but got %v", want.Position, got.Position)
+	}
+}
+
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/globalsign/mgo"
+)
+
+// a mongod instance queries can be run against
+type backend struct {
+	// full version of mongodb, like 4.0.10
+	version []byte
+	session *mgo.Session
+}
+
+// connect to each mongodb uri. Each uri has to point to a
+// distinct version of mongodb
+func dialBackends(mongoURIs []string) ([]backend, error) {
+
+	backends := make([]backend, 0, len(mongoURIs))
+	for _, uri := range mongoURIs {
+		session, err := mgo.Dial(uri)
+		if err != nil {
+			closeBackends(backends)
+			return nil, fmt.Errorf("fail to connect to mongodb: %v", err)
+		}
+		info, _ := session.BuildInfo()
+		b := backend{
+			version: []byte(info.Version),
+			session: session,
+		}
+		for _, other := range backends {
+			if bytes.Equal(other.version, b.version) {
+				session.Close()
+				closeBackends(backends)
+				return nil, fmt.Errorf("two backends run the same version of mongodb: %s", b.version)
+			}
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+func closeBackends(backends []backend) {
+	for _, b := range backends {
+		b.session.Close()
+	}
+}
+
+// return the backend running the requested version of mongodb. If no backend
+// matches exactly, for example because the backend was upgraded since the page
+// was saved, use a backend with the same major version, like 4.0 for 4.0.3.
+// Otherwise, use the default backend
+func (s *server) backend(version []byte) *backend {
+
+	if len(version) == 0 {
+		return &s.backends[0]
+	}
+	for i := range s.backends {
+		if bytes.Equal(s.backends[i].version, version) {
+			return &s.backends[i]
+		}
+	}
+	major := majorVersion(version)
+	for i := range s.backends {
+		if bytes.Equal(majorVersion(s.backends[i].version), major) {
+			return &s.backends[i]
+		}
+	}
+	return &s.backends[0]
+}
+
+// return the version of the backend running the requested version of mongodb,
+// or nil if it is the default backend. Databases are identified by this version,
+// so that a playground run against the default backend without a version, with
+// the full version of the backend, or with an unknown version, always uses the
+// same database
+func (s *server) normalizeVersion(version []byte) []byte {
+	b := s.backend(version)
+	if b == &s.backends[0] {
+		return nil
+	}
+	return b.version
+}
+
+// return the version a page is saved with: the full version of the backend
+// running the requested version, so that the page keeps running against this
+// version if the default backend changes. Pages without a version, like the
+// ones saved before versions were recorded, keep none, so that their ID
+// doesn't change
+func (s *server) savedVersion(version []byte) []byte {
+	if len(version) == 0 {
+		return nil
+	}
+	return s.backend(version).version
+}
+
+// return the major version of mongodb, ie the first two numbers
+// of the version
+func majorVersion(version []byte) []byte {
+	parts := bytes.SplitN(version, []byte("."), 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return bytes.Join(parts[:2], []byte("."))
+}
+
+// return the versions of mongodb available, the default one first
+func (s *server) mongodbVersions() []string {
+	versions := make([]string, 0, len(s.backends))
+	for _, b := range s.backends {
+		versions = append(versions, string(b.version))
+	}
+	return versions
+}
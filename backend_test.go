@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeVersion(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		backends: []backend{{version: []byte("4.0.10")}, {version: []byte("3.6.12")}},
+	}
+
+	normalizeTests := []struct {
+		name    string
+		version string
+		result  string
+	}{
+		{
+			name:    "no version",
+			version: "",
+			result:  "",
+		},
+		{
+			name:    "default version",
+			version: "4.0.10",
+			result:  "",
+		},
+		{
+			name:    "other version",
+			version: "3.6.12",
+			result:  "3.6.12",
+		},
+		{
+			name:    "same major version",
+			version: "3.6.3",
+			result:  "3.6.12",
+		},
+		{
+			name:    "unknown version",
+			version: "1.0.0",
+			result:  "",
+		},
+	}
+
+	for _, tt := range normalizeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if want, got := tt.result, string(s.normalizeVersion([]byte(tt.version))); want != got {
+				t.Errorf("expected version %q, but got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestSavedVersion(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		backends: []backend{{version: []byte("4.0.10")}, {version: []byte("3.6.12")}},
+	}
+
+	savedVersionTests := []struct {
+		name    string
+		version string
+		result  string
+	}{
+		{
+			name:    "no version",
+			version: "",
+			result:  "",
+		},
+		{
+			name:    "default version",
+			version: "4.0.10",
+			result:  "4.0.10",
+		},
+		{
+			name:    "same major version as default",
+			version: "4.0.3",
+			result:  "4.0.10",
+		},
+		{
+			name:    "other version",
+			version: "3.6.12",
+			result:  "3.6.12",
+		},
+		{
+			name:    "unknown version",
+			version: "1.0.0",
+			result:  "4.0.10",
+		},
+	}
+
+	for _, tt := range savedVersionTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if want, got := tt.result, string(s.savedVersion([]byte(tt.version))); want != got {
+				t.Errorf("expected version %q, but got %q", want, got)
+			}
+		})
+	}
+}
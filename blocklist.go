@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// operators and methods rejected by default. $out and $merge could write
+// into the database of another playground, and the others run server-side
+// javascript
+var blockedOperators = map[string]bool{
+	"$out":         true,
+	"$merge":       true,
+	"$where":       true,
+	"$function":    true,
+	"$accumulator": true,
+	"mapReduce":    true,
+}
+
+// error returned when a statement uses a blocked operator
+type blockedOperatorError struct {
+	operator string
+	// position of the stage containing the operator in the pipeline,
+	// starting at 1, or 0 if the statement is not an aggregation
+	stage int
+}
+
+func (e *blockedOperatorError) Error() string {
+	if !strings.HasPrefix(e.operator, "$") {
+		return fmt.Sprintf("method %s() is not allowed", e.operator)
+	}
+	if e.stage > 0 {
+		return fmt.Sprintf("operator %s is not allowed, but was found in stage %d of the pipeline", e.operator, e.stage)
+	}
+	return fmt.Sprintf("operator %s is not allowed", e.operator)
+}
+
+// build the set of blocked operators allowed anyway from their names,
+// like $out or mapReduce
+func allowOperators(names []string) (map[string]bool, error) {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !blockedOperators[name] {
+			return nil, fmt.Errorf("operator %s is not blocked, expected one of %s", name, strings.Join(blockedOperatorNames(), ", "))
+		}
+		allowed[name] = true
+	}
+	return allowed, nil
+}
+
+func blockedOperatorNames() []string {
+	names := make([]string, 0, len(blockedOperators))
+	for name := range blockedOperators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (l runLimits) blocked(operator string) bool {
+	return blockedOperators[operator] && !l.allowedOperators[operator]
+}
+
+// make sure that the method doesn't use a blocked operator
+func (l runLimits) checkMethod(method string) error {
+	if l.blocked(method) {
+		return &blockedOperatorError{operator: method}
+	}
+	return nil
+}
+
+// make sure that the stages of a pipeline don't use a blocked operator,
+// including in nested pipelines like the ones of $lookup or $facet
+func (l runLimits) checkPipeline(stages []bson.M) error {
+	for i, stage := range stages {
+		if op := l.findBlocked(stage); op != "" {
+			return &blockedOperatorError{operator: op, stage: i + 1}
+		}
+	}
+	return nil
+}
+
+// make sure that the values, like a filter or an update document, don't
+// use a blocked operator
+func (l runLimits) checkValues(values ...interface{}) error {
+	for _, v := range values {
+		if op := l.findBlocked(v); op != "" {
+			return &blockedOperatorError{operator: op}
+		}
+	}
+	return nil
+}
+
+// return the first blocked operator used as a key in v, or an
+// empty string if there is none
+func (l runLimits) findBlocked(v interface{}) string {
+	switch v := v.(type) {
+	case bson.M:
+		return l.findBlocked(map[string]interface{}(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if l.blocked(k) {
+				return k
+			}
+			if op := l.findBlocked(v[k]); op != "" {
+				return op
+			}
+		}
+	case bson.D:
+		for _, elem := range v {
+			if l.blocked(elem.Name) {
+				return elem.Name
+			}
+			if op := l.findBlocked(elem.Value); op != "" {
+				return op
+			}
+		}
+	case []bson.M:
+		for _, doc := range v {
+			if op := l.findBlocked(doc); op != "" {
+				return op
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if op := l.findBlocked(item); op != "" {
+				return op
+			}
+		}
+	}
+	return ""
+}
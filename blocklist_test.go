@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBlockedOperators(t *testing.T) {
+
+	p := &page{
+		Mode:   bsonMode,
+		Config: []byte(`[{"_id":1,"k":1},{"_id":2,"k":2}]`),
+	}
+	db := testServer.session.DB("blocklist")
+	defer db.DropDatabase()
+	if err := createPageDatabase(db, p, false, defaultLimits); err != nil {
+		t.Fatalf("fail to create database: %v", err)
+	}
+
+	allowWhere := defaultLimits
+	allowWhere.allowedOperators = map[string]bool{"$where": true}
+
+	blockedOperatorsTests := []struct {
+		name   string
+		limits runLimits
+		query  string
+		result string
+		err    string
+	}{
+		{
+			name:   "$out stage",
+			limits: defaultLimits,
+			query:  `db.collection.aggregate([{"$match":{"k":1}},{"$out":"other"}])`,
+			err:    "operator $out is not allowed, but was found in stage 2 of the pipeline",
+		},
+		{
+			name:   "$merge in $facet",
+			limits: defaultLimits,
+			query:  `db.collection.aggregate([{"$facet":{"a":[{"$merge":{"into":"other"}}]}}])`,
+			err:    "operator $merge is not allowed, but was found in stage 1 of the pipeline",
+		},
+		{
+			name:   "$function in $lookup pipeline",
+			limits: defaultLimits,
+			query:  `db.collection.aggregate([{"$match":{}},{"$lookup":{"from":"collection","pipeline":[{"$project":{"v":{"$function":{"body":"function() { return 1 }","args":[],"lang":"js"}}}}],"as":"l"}}])`,
+			err:    "operator $function is not allowed, but was found in stage 2 of the pipeline",
+		},
+		{
+			name:   "$accumulator in $group",
+			limits: defaultLimits,
+			query:  `db.collection.aggregate([{"$group":{"_id":null,"v":{"$accumulator":{"init":"function() { return 0 }"}}}}])`,
+			err:    "operator $accumulator is not allowed, but was found in stage 1 of the pipeline",
+		},
+		{
+			name:   "$where in find",
+			limits: defaultLimits,
+			query:  `db.collection.find({"$where":"this.k == 1"})`,
+			err:    "operator $where is not allowed",
+		},
+		{
+			name:   "$where in count",
+			limits: defaultLimits,
+			query:  `db.collection.find({"$or":[{"$where":"this.k == 1"}]}).count()`,
+			err:    "operator $where is not allowed",
+		},
+		{
+			name:   "$where in update filter",
+			limits: defaultLimits,
+			query:  `db.collection.updateOne({"$where":"this.k == 1"},{"$set":{"k":3}})`,
+			err:    "operator $where is not allowed",
+		},
+		{
+			name:   "mapReduce",
+			limits: defaultLimits,
+			query:  `db.collection.mapReduce("function() {}","function() {}",{"out":"other"})`,
+			err:    "method mapReduce() is not allowed",
+		},
+		{
+			name:   "allowed operator",
+			limits: allowWhere,
+			query:  `db.collection.find({"$where":"this.k == 1"})`,
+			result: `[{"_id":1,"k":1}]`,
+		},
+	}
+
+	for _, tt := range blockedOperatorsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := runScript(db, [][]byte{[]byte(tt.query)}, tt.limits)
+			if tt.err != "" {
+				if err == nil || tt.err != err.Error() {
+					t.Errorf("expected error\n'%s'\nbut got\n'%v'", tt.err, err)
+				}
+				if se, ok := err.(*statementError); !ok || statementErrorKind(se) != forbiddenError {
+					t.Errorf("expected a forbidden error, but got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			if want, got := tt.result, string(res); want != got {
+				t.Errorf("expected %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestAllowOperators(t *testing.T) {
+
+	t.Parallel()
+
+	allowed, err := allowOperators([]string{"$out", "mapReduce"})
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !allowed["$out"] || !allowed["mapReduce"] || len(allowed) != 2 {
+		t.Errorf("expected $out and mapReduce to be allowed, but got %v", allowed)
+	}
+
+	_, err = allowOperators([]string{"$lookup"})
+	if want := "operator $lookup is not blocked, expected one of $accumulator, $function, $merge, $out, $where, mapReduce"; err == nil || want != err.Error() {
+		t.Errorf("expected error %s, but got %v", want, err)
+	}
+}
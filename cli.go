@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// subcommands of the command line client
+var commands = map[string]func(c *cliOptions, stdout io.Writer) error{
+	"run":   cliRun,
+	"save":  cliSave,
+	"prune": cliPrune,
+}
+
+// timeout of requests sent to a playground server
+const cliTimeout = 30 * time.Second
+
+type cliOptions struct {
+	mode         string
+	config       string
+	query        string
+	mongoVersion string
+	// url of a saved playground to use instead of config and query
+	link string
+	// url of a playground server, like https://mongoplayground.net
+	server string
+	// uri of the mongod instance to run queries against locally
+	mongoURI string
+	// storage of a server to prune saved playgrounds from
+	storage   string
+	badgerDir string
+	pagesDir  string
+	// saved playgrounds not viewed within retention are pruned
+	retention time.Duration
+	// only report the playgrounds that would be pruned
+	dryRun bool
+}
+
+// run the subcommand args[0] with the flags args[1:], and return the exit
+// code of the program
+func runCommand(args []string, stdout, stderr io.Writer) int {
+
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %s, expected run, save or prune\n", args[0])
+		return 2
+	}
+
+	c := &cliOptions{}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.mode, "mode", "bson", "mode of the configuration: bson or mgodatagen")
+	fs.StringVar(&c.config, "config", "", "file holding the configuration")
+	fs.StringVar(&c.query, "query", "", "file holding the query")
+	fs.StringVar(&c.mongoVersion, "mongoVersion", "", "version of mongodb to run the query against on the server (default version of the server)")
+	fs.StringVar(&c.link, "link", "", "link to a saved playground, like https://mongoplayground.net/p/snbIQ3uGHGq, to use instead of -config, -query and -mode")
+	fs.StringVar(&c.server, "server", "", "url of a playground server. If set, the playground is sent to this server instead of being run locally")
+	fs.StringVar(&c.mongoURI, "mongodb", "mongodb://", "uri of the mongod instance to run the query against locally")
+	fs.StringVar(&c.storage, "storage", "badger", "storage of the server to prune: badger or filesystem. The server must be stopped")
+	fs.StringVar(&c.badgerDir, "badgerDir", "storage", "directory of the badger storage to prune")
+	fs.StringVar(&c.pagesDir, "pagesDir", "pages", "directory of the filesystem storage to prune")
+	fs.DurationVar(&c.retention, "retention", 0, "prune saved playgrounds not viewed within this duration, like 2160h for 90 days")
+	fs.BoolVar(&c.dryRun, "dryRun", false, "only report the saved playgrounds that would be pruned")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: mongoplayground %s [flags]\n\n", args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if err := command(c, stdout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// run the playground, either locally or on a playground server, and write
+// the result to stdout
+func cliRun(c *cliOptions, stdout io.Writer) error {
+
+	p, err := c.page()
+	if err != nil {
+		return err
+	}
+
+	var res []byte
+	if c.server != "" {
+		var result json.RawMessage
+		err = c.callAPI("/api/v1/run", p, &result)
+		res = result
+	} else {
+		res, err = runLocally(c.mongoURI, p)
+	}
+	if len(res) > 0 {
+		fmt.Fprintln(stdout, strings.TrimSuffix(string(res), "\n"))
+	}
+	return err
+}
+
+// save the playground on a playground server, and write its url to stdout
+func cliSave(c *cliOptions, stdout io.Writer) error {
+
+	if c.server == "" {
+		return errors.New("save requires a playground server, set with -server")
+	}
+	p, err := c.page()
+	if err != nil {
+		return err
+	}
+	var result apiSaveResult
+	if err := c.callAPI("/api/v1/save", p, &result); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, result.URL)
+	return nil
+}
+
+// delete the playgrounds not viewed within the retention from the storage
+// of a server, and write a report to stdout
+func cliPrune(c *cliOptions, stdout io.Writer) error {
+
+	if c.retention <= 0 {
+		return errors.New("prune requires a retention, set with -retention")
+	}
+	if c.storage == "memory" {
+		return errors.New("can't prune a memory storage, expected badger or filesystem")
+	}
+	storage, err := newStore(&config{storage: c.storage, badgerDir: c.badgerDir, pagesDir: c.pagesDir})
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	report, err := prunePages(storage, c.retention, time.Now(), c.dryRun, &sync.Mutex{}, nil)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		fmt.Fprintf(stdout, "would prune %v not viewed within %v\n", report, c.retention)
+	} else {
+		fmt.Fprintf(stdout, "pruned %v not viewed within %v\n", report, c.retention)
+	}
+	return nil
+}
+
+// return the playground to run or save, read from the configuration and
+// query files, or from a saved playground
+func (c *cliOptions) page() (*page, error) {
+
+	if c.link != "" {
+		return fetchPage(c.link)
+	}
+
+	if c.mode != "bson" && c.mode != "mgodatagen" {
+		return nil, fmt.Errorf("invalid mode %s, expected bson or mgodatagen", c.mode)
+	}
+	if c.config == "" || c.query == "" {
+		return nil, errors.New("both -config and -query are required, unless -link is set")
+	}
+	config, err := ioutil.ReadFile(c.config)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read configuration: %v", err)
+	}
+	query, err := ioutil.ReadFile(c.query)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read query: %v", err)
+	}
+	return &page{
+		Mode:         modeByte(c.mode),
+		Config:       config,
+		Query:        query,
+		MongoVersion: []byte(c.mongoVersion),
+	}, nil
+}
+
+// send the p page to an endpoint of the json api of the playground server,
+// and decode the result of the response in result. If the server returned
+// an error, its message is returned
+func (c *cliOptions) callAPI(endpoint string, p *page, result interface{}) error {
+
+	body, err := json.Marshal(&apiPage{
+		Mode:         modeName(p.Mode),
+		Config:       string(p.Config),
+		Query:        string(p.Query),
+		MongoVersion: string(p.MongoVersion),
+	})
+	if err != nil {
+		return err
+	}
+	server := strings.TrimSuffix(c.server, "/")
+	resp, err := (&http.Client{Timeout: cliTimeout}).Post(server+endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("fail to send playground to %s: %v", server, err)
+	}
+	defer resp.Body.Close()
+
+	r := struct {
+		Result interface{} `json:"result"`
+		Error  *apiError   `json:"error"`
+	}{Result: result}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return fmt.Errorf("%s%s returned %s: invalid response: %v", server, endpoint, resp.Status, err)
+	}
+	if r.Error != nil {
+		return errors.New(r.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s%s returned %s", server, endpoint, resp.Status)
+	}
+	return nil
+}
+
+// load the playground saved at link, like https://mongoplayground.net/p/snbIQ3uGHGq,
+// through the json api of the server
+func fetchPage(link string) (*page, error) {
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("invalid link %s: %v", link, err)
+	}
+	i := strings.LastIndex(u.Path, "/p/")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid link %s: expected a link like https://mongoplayground.net/p/snbIQ3uGHGq", link)
+	}
+	u.Path = u.Path[:i] + "/api/v1" + u.Path[i:]
+
+	resp, err := (&http.Client{Timeout: cliTimeout}).Get(u.String())
+	if err != nil {
+		return nil, fmt.Errorf("fail to load playground %s: %v", link, err)
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Result *apiPage  `json:"result"`
+		Error  *apiError `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load playground %s: %v", link, err)
+	}
+	if r.Error != nil {
+		return nil, fmt.Errorf("fail to load playground %s: %s", link, r.Error.Message)
+	}
+	if r.Result == nil {
+		return nil, fmt.Errorf("fail to load playground %s: empty response", link)
+	}
+	return r.Result.page()
+}
+
+// run the p page against the mongod instance listening on mongoURI, in
+// a database dropped once the query returns
+func runLocally(mongoURI string, p *page) ([]byte, error) {
+
+	session, err := mgo.Dial(mongoURI)
+	if err != nil {
+		return nil, fmt.Errorf("fail to connect to mongodb: %v", err)
+	}
+	defer session.Close()
+
+	// don't reuse the database of the page, as a playground server may
+	// run against the same mongod
+	name := fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s%d", p.dbHash(), time.Now().UnixNano()))))
+	db := session.DB(name)
+	defer db.DropDatabase()
+
+	statements := splitScript(p.Query)
+
+	err = createPageDatabase(db, p, !isWriteScript(statements), defaultLimits)
+	if err != nil {
+		return nil, err
+	}
+	return runScript(db, statements, defaultLimits)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandLine(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	ts := httptest.NewServer(testServer)
+	defer ts.Close()
+
+	// a proxy in front of a server that is down
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatalf("fail to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json":     `[{"_id":1},{"_id":2}]`,
+		"template.json":   templateConfig,
+		"find.js":         `db.collection.find({"_id":2})`,
+		"template.js":     templateQuery,
+		"script.js":       `db.collection.find({"_id":2});db.collection.insertOne({"_id":1})`,
+		"invalidQuery.js": `db.collection.find(`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("fail to write %s: %v", name, err)
+		}
+	}
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	commandTests := []struct {
+		name     string
+		args     []string
+		exitCode int
+		stdout   string
+		stderr   string
+	}{
+		{
+			name:     "unknown command",
+			args:     []string{"start"},
+			exitCode: 2,
+			stderr:   "unknown command start, expected run, save or prune",
+		},
+		{
+			name:     "invalid mode",
+			args:     []string{"run", "-mode", "json", "-config", file("config.json"), "-query", file("find.js")},
+			exitCode: 1,
+			stderr:   "invalid mode json, expected bson or mgodatagen",
+		},
+		{
+			name:     "missing query",
+			args:     []string{"run", "-config", file("config.json")},
+			exitCode: 1,
+			stderr:   "both -config and -query are required, unless -link is set",
+		},
+		{
+			name:     "missing configuration file",
+			args:     []string{"run", "-config", file("missing.json"), "-query", file("find.js")},
+			exitCode: 1,
+			stderr:   "fail to read configuration: open " + file("missing.json"),
+		},
+		{
+			name:     "run locally",
+			args:     []string{"run", "-config", file("config.json"), "-query", file("find.js")},
+			exitCode: 0,
+			stdout:   `[{"_id":2}]`,
+		},
+		{
+			name:     "run script locally",
+			args:     []string{"run", "-config", file("config.json"), "-query", file("script.js")},
+			exitCode: 1,
+			stdout:   "statement 1:\n" + `[{"_id":2}]` + "\n\nstatement 2:",
+			stderr:   "query failed: E11000 duplicate key error",
+		},
+		{
+			name:     "invalid query locally",
+			args:     []string{"run", "-config", file("config.json"), "-query", file("invalidQuery.js")},
+			exitCode: 1,
+			stderr:   invalidQuery,
+		},
+		{
+			name:     "run on server",
+			args:     []string{"run", "-server", ts.URL, "-config", file("config.json"), "-query", file("find.js")},
+			exitCode: 0,
+			stdout:   `[{"_id":2}]`,
+		},
+		{
+			name:     "run script on server",
+			args:     []string{"run", "-server", ts.URL, "-config", file("config.json"), "-query", file("script.js")},
+			exitCode: 1,
+			stderr:   "query failed: E11000 duplicate key error",
+		},
+		{
+			name:     "invalid query on server",
+			args:     []string{"run", "-server", ts.URL, "-config", file("config.json"), "-query", file("invalidQuery.js")},
+			exitCode: 1,
+			stderr:   invalidQuery,
+		},
+		{
+			name:     "server error",
+			args:     []string{"run", "-server", failing.URL, "-config", file("config.json"), "-query", file("find.js")},
+			exitCode: 1,
+			stderr:   failing.URL + "/api/v1/run returned 502 Bad Gateway: invalid response",
+		},
+		{
+			name:     "save on server",
+			args:     []string{"save", "-server", ts.URL + "/", "-mode", "mgodatagen", "-config", file("template.json"), "-query", file("template.js")},
+			exitCode: 0,
+			stdout:   ts.URL + "/" + templateURL,
+		},
+		{
+			name:     "save without server",
+			args:     []string{"save", "-config", file("config.json"), "-query", file("find.js")},
+			exitCode: 1,
+			stderr:   "save requires a playground server, set with -server",
+		},
+		{
+			name:     "run saved playground",
+			args:     []string{"run", "-link", ts.URL + "/" + templateURL},
+			exitCode: 0,
+			stdout:   templateResult,
+		},
+		{
+			name:     "run missing playground",
+			args:     []string{"run", "-link", ts.URL + "/p/random"},
+			exitCode: 1,
+			stderr:   "fail to load playground " + ts.URL + "/p/random: this playground doesn't exist",
+		},
+	}
+
+	for _, tt := range commandTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := runCommand(tt.args, &stdout, &stderr)
+
+			if tt.exitCode != exitCode {
+				t.Errorf("expected exit code %d, but got %d (stderr: %s)", tt.exitCode, exitCode, stderr.String())
+			}
+			if want, got := tt.stdout, strings.TrimSuffix(stdout.String(), "\n"); want != got {
+				t.Errorf("expected output\n'%s'\nbut got\n'%s'", want, got)
+			}
+			if !strings.HasPrefix(stderr.String(), tt.stderr) {
+				t.Errorf("expected error starting with\n'%s'\nbut got\n'%s'", tt.stderr, stderr.String())
+			}
+		})
+	}
+
+	// databases created locally are dropped
+	testStorageContent(t, 2, 1)
+}
+
+func TestCommandLinePrune(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "prune")
+	if err != nil {
+		t.Fatalf("fail to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	storage, err := newFilesystemStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Put([]byte("old"), (&page{CreatedAt: time.Now().Add(-48 * time.Hour).Unix()}).encode())
+	storage.Put([]byte("recent"), (&page{CreatedAt: time.Now().Unix()}).encode())
+	storage.Close()
+
+	pruneTests := []struct {
+		name     string
+		args     []string
+		exitCode int
+		stdout   string
+		stderr   string
+		pages    int
+	}{
+		{
+			name:     "missing retention",
+			args:     []string{"prune", "-storage", "filesystem", "-pagesDir", dir},
+			exitCode: 1,
+			stderr:   "prune requires a retention, set with -retention",
+			pages:    2,
+		},
+		{
+			name:     "dry run",
+			args:     []string{"prune", "-storage", "filesystem", "-pagesDir", dir, "-retention", "24h", "-dryRun"},
+			exitCode: 0,
+			stdout:   "would prune 1 pages out of 2",
+			pages:    2,
+		},
+		{
+			name:     "prune",
+			args:     []string{"prune", "-storage", "filesystem", "-pagesDir", dir, "-retention", "24h"},
+			exitCode: 0,
+			stdout:   "pruned 1 pages out of 2",
+			pages:    1,
+		},
+	}
+
+	for _, tt := range pruneTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := runCommand(tt.args, &stdout, &stderr)
+
+			if tt.exitCode != exitCode {
+				t.Errorf("expected exit code %d, but got %d (stderr: %s)", tt.exitCode, exitCode, stderr.String())
+			}
+			if !strings.HasPrefix(stdout.String(), tt.stdout) {
+				t.Errorf("expected stdout to start with %q, but got %q", tt.stdout, stdout.String())
+			}
+			if !strings.HasPrefix(stderr.String(), tt.stderr) {
+				t.Errorf("expected stderr to start with %q, but got %q", tt.stderr, stderr.String())
+			}
+			if want, got := tt.pages, countPages(storage); want != got {
+				t.Errorf("expected %d pages left, but got %d", want, got)
+			}
+		})
+	}
+}
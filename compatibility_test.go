@@ -2,10 +2,9 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
-
-	"github.com/dgraph-io/badger"
 )
 
 const backupPath = "backup/backup.bak"
@@ -22,7 +21,22 @@ func TestGenerateresultFile(t *testing.T) {
 	if err != nil {
 		t.Errorf("fail to open backup file: %v", err)
 	}
-	testServer.storage.Load(backup)
+	defer backup.Close()
+
+	// the backup is a badger backup of the storage of the playground
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatalf("fail to create storage directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := newBadgerStore(dir)
+	if err != nil {
+		t.Fatalf("fail to open storage: %v", err)
+	}
+	defer storage.Close()
+	if err := storage.db.Load(backup); err != nil {
+		t.Fatalf("fail to load backup: %v", err)
+	}
 
 	out, err := os.Create("backup/new_result.txt")
 	if err != nil {
@@ -30,32 +44,23 @@ func TestGenerateresultFile(t *testing.T) {
 	}
 	defer out.Close()
 
-	err = testServer.storage.View(func(txn *badger.Txn) error {
-
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
+	err = storage.Iterate(func(key, value []byte) error {
 
-			key := item.Key()
-			value, err := item.Value()
-			if err != nil {
-				return err
-			}
-
-			p := &page{}
-			p.decode(value)
+		p := &page{}
+		err := p.decode(value)
+		if err != nil {
+			fmt.Printf("fail to decode playground %s: %v\n", key, err)
+			return nil
+		}
 
-			result, err := testServer.run(p)
-			if err != nil {
-				fmt.Printf("error for playground %s:\n\t%v", key, err)
-			}
-			out.Write(key)
-			out.WriteString(":")
-			out.Write(result)
-			out.WriteString("\n")
+		result, err := testServer.run(p)
+		if err != nil {
+			fmt.Printf("error for playground %s:\n\t%v", key, err)
 		}
+		out.Write(key)
+		out.WriteString(":")
+		out.Write(result)
+		out.WriteString("\n")
 		return nil
 	})
 	if err != nil {
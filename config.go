@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// prefix of the environment variables used to configure the server,
+// like MONGOPLAYGROUND_PORT
+const envPrefix = "MONGOPLAYGROUND_"
+
+// configuration of the server
+type config struct {
+	// port the server listens on
+	port int
+	// address of the listener serving the admin endpoints, like
+	// /metrics. Empty to disable them
+	adminAddr string
+	// uris of the mongod instances to run queries against, one per
+	// version of mongodb. The first one is the default
+	mongoURIs []string
+	// where to save playgrounds: badger, filesystem or memory
+	storage string
+	// directory of the badger storage
+	badgerDir string
+	// directory of the filesystem storage
+	pagesDir string
+	// directory of the static resources (javascript, css, docs)
+	staticDir string
+	// interval between two database cleanup
+	cleanupInterval time.Duration
+	// if a database is not used within the last expireInterval,
+	// it is removed in the next cleanup
+	expireInterval time.Duration
+	// saved pages not viewed within pageRetention are deleted every
+	// pruneInterval. 0 to keep pages forever
+	pageRetention time.Duration
+	pruneInterval time.Duration
+	// interval between two writes of the views and runs of saved
+	// pages to the storage
+	flushInterval time.Duration
+	// how long running requests are waited for when the server
+	// is shut down
+	shutdownTimeout time.Duration
+	// file where the last use of active databases is saved, so that
+	// they are tracked across restarts. Empty to disable it
+	activeDBFile string
+	limits       runLimits
+	traffic      trafficLimits
+	pool         poolLimits
+}
+
+func defaultConfig() *config {
+	return &config{
+		port:            80,
+		storage:         "badger",
+		badgerDir:       "storage",
+		pagesDir:        "pages",
+		staticDir:       "static/",
+		cleanupInterval: 120 * time.Minute,
+		expireInterval:  60 * time.Minute,
+		pruneInterval:   24 * time.Hour,
+		flushInterval:   time.Minute,
+		shutdownTimeout: 30 * time.Second,
+		activeDBFile:    "activeDB.json",
+		limits:          defaultLimits,
+		traffic:         defaultTrafficLimits,
+		pool:            defaultPoolLimits,
+	}
+}
+
+// load the configuration of the server. Options are read from the command line
+// args, then from environment variables, like MONGOPLAYGROUND_MAX_DOCS for -maxDocs,
+// and finally from the json file set with -configFile, like
+//
+//	{"port": 8080, "mongodb": ["mongodb://localhost:27017"], "queryTimeout": "10s"}
+//
+// The first source setting an option wins
+func loadConfig(args []string, getenv func(string) string, output io.Writer) (*config, error) {
+
+	c := defaultConfig()
+
+	var allowedOperators, trustedProxies stringList
+	var configFile string
+
+	fs := flag.NewFlagSet("mongoplayground", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&configFile, "configFile", "", "json file holding options of the server, keyed by flag name")
+	fs.IntVar(&c.port, "port", c.port, "port the server listens on")
+	fs.StringVar(&c.adminAddr, "adminAddr", c.adminAddr, "address serving /metrics and /admin/databases, like 127.0.0.1:8081. These endpoints are not authenticated, and are disabled if empty")
+	fs.Var((*stringList)(&c.mongoURIs), "mongodb", "uri of a mongod instance to run queries against, can be repeated to support several versions of mongodb. The first one is the default (default mongodb://)")
+	fs.StringVar(&c.storage, "storage", c.storage, "where to save playgrounds: badger, filesystem or memory")
+	fs.StringVar(&c.badgerDir, "badgerDir", c.badgerDir, "directory of the badger storage")
+	fs.StringVar(&c.pagesDir, "pagesDir", c.pagesDir, "directory of the filesystem storage")
+	fs.StringVar(&c.staticDir, "staticDir", c.staticDir, "directory of the static resources")
+	fs.DurationVar(&c.cleanupInterval, "cleanupInterval", c.cleanupInterval, "interval between two cleanups of unused databases")
+	fs.DurationVar(&c.expireInterval, "expireInterval", c.expireInterval, "databases not used within this interval are dropped in the next cleanup")
+	fs.DurationVar(&c.pageRetention, "pageRetention", c.pageRetention, "saved playgrounds not viewed within this duration, like 2160h for 90 days, are deleted. 0 to keep them forever")
+	fs.DurationVar(&c.pruneInterval, "pruneInterval", c.pruneInterval, "interval between two deletions of playgrounds not viewed within -pageRetention")
+	fs.DurationVar(&c.flushInterval, "flushInterval", c.flushInterval, "interval between two writes of the views and runs of saved playgrounds to the storage. They are also written on shutdown")
+	fs.DurationVar(&c.shutdownTimeout, "shutdownTimeout", c.shutdownTimeout, "how long running requests are waited for on SIGTERM before shutting down anyway")
+	fs.StringVar(&c.activeDBFile, "activeDBFile", c.activeDBFile, "file where active databases are saved to be tracked across restarts. Databases of playgrounds not tracked are dropped on startup. Empty to disable it")
+	fs.IntVar(&c.pool.maxDatabases, "maxDatabases", c.pool.maxDatabases, "max number of databases created for playgrounds, least recently used ones are dropped first. 0 for no limit")
+	fs.Int64Var(&c.pool.maxBytes, "maxDatabasesBytes", c.pool.maxBytes, "max total data size in bytes of the databases created for playgrounds, least recently used ones are dropped first. 0 for no limit")
+	fs.IntVar(&c.limits.maxCollections, "maxCollections", c.limits.maxCollections, "max number of collections in a database")
+	fs.IntVar(&c.limits.maxDocs, "maxDocs", c.limits.maxDocs, "max number of documents in a collection")
+	fs.IntVar(&c.limits.maxCollectionBytes, "maxCollectionBytes", c.limits.maxCollectionBytes, "max size in bytes of a collection")
+	fs.DurationVar(&c.limits.timeout, "queryTimeout", c.limits.timeout, "max execution time of a statement of a query")
+	fs.IntVar(&c.limits.maxResultDocs, "maxResultDocs", c.limits.maxResultDocs, "max number of documents returned by a statement of a query")
+	fs.IntVar(&c.limits.maxResultBytes, "maxResultBytes", c.limits.maxResultBytes, "max size in bytes of the documents returned by a statement of a query")
+	fs.Var(&allowedOperators, "allowOperator", "operator or method blocked by default to allow anyway, like $out or mapReduce, can be repeated")
+	fs.Float64Var(&c.traffic.requestsPerSecond, "rateLimit", c.traffic.requestsPerSecond, "requests to /run and /save allowed per second for each client IP, 0 to disable rate limiting")
+	fs.IntVar(&c.traffic.burst, "rateBurst", c.traffic.burst, "requests a client can send at once before being rate limited")
+	fs.IntVar(&c.traffic.maxDBCreations, "maxDBCreations", c.traffic.maxDBCreations, "max number of databases created at the same time, 0 for no limit")
+	fs.DurationVar(&c.traffic.dbCreationWait, "dbCreationWait", c.traffic.dbCreationWait, "how long a run waits for a database creation slot before failing")
+	fs.Var(&trustedProxies, "trustedProxy", "IP or CIDR, like 10.0.0.0/8, of a reverse proxy allowed to set the client IP in the X-Forwarded-For header, can be repeated. The header is ignored by default")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// the config file itself may be set from the environment
+	if !set["configFile"] {
+		if v := getenv(envName("configFile")); v != "" {
+			configFile = v
+		}
+	}
+	var fileValues map[string][]string
+	if configFile != "" {
+		var err error
+		fileValues, err = readConfigFile(configFile, fs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] || f.Name == "configFile" {
+			return
+		}
+		values, ok := fileValues[f.Name]
+		if v := getenv(envName(f.Name)); v != "" {
+			values, ok = []string{v}, true
+			// repeated options are separated by spaces, which can't
+			// appear in a mongodb uri or an operator
+			if _, isList := f.Value.(*stringList); isList {
+				values = strings.Fields(v)
+			}
+		}
+		if !ok {
+			return
+		}
+		for _, v := range values {
+			if e := f.Value.Set(strings.TrimSpace(v)); e != nil {
+				err = fmt.Errorf("invalid value %q for option %s: %v", v, f.Name, e)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.limits.allowedOperators, err = allowOperators(allowedOperators)
+	if err != nil {
+		return nil, err
+	}
+	c.traffic.trustedProxies, err = parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// check that intervals and timeouts are positive, and that limits are
+// not negative
+func (c *config) validate() error {
+
+	durations := []struct {
+		option string
+		value  time.Duration
+	}{
+		{"cleanupInterval", c.cleanupInterval},
+		{"expireInterval", c.expireInterval},
+		{"pruneInterval", c.pruneInterval},
+		{"flushInterval", c.flushInterval},
+		{"shutdownTimeout", c.shutdownTimeout},
+		{"queryTimeout", c.limits.timeout},
+		{"dbCreationWait", c.traffic.dbCreationWait},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("invalid value %s for option %s: should be positive", d.value, d.option)
+		}
+	}
+	if c.pageRetention < 0 {
+		return fmt.Errorf("invalid value %s for option pageRetention: should not be negative", c.pageRetention)
+	}
+
+	limits := []struct {
+		option string
+		value  float64
+	}{
+		{"maxDatabases", float64(c.pool.maxDatabases)},
+		{"maxDatabasesBytes", float64(c.pool.maxBytes)},
+		{"maxCollections", float64(c.limits.maxCollections)},
+		{"maxDocs", float64(c.limits.maxDocs)},
+		{"maxCollectionBytes", float64(c.limits.maxCollectionBytes)},
+		{"maxResultDocs", float64(c.limits.maxResultDocs)},
+		{"maxResultBytes", float64(c.limits.maxResultBytes)},
+		{"rateLimit", c.traffic.requestsPerSecond},
+		{"rateBurst", float64(c.traffic.burst)},
+		{"maxDBCreations", float64(c.traffic.maxDBCreations)},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			return fmt.Errorf("invalid value %v for option %s: should not be negative", l.value, l.option)
+		}
+	}
+	return nil
+}
+
+// read the options of a json config file. Values may be strings, numbers,
+// booleans, or arrays for repeated options
+func readConfigFile(name string, fs *flag.FlagSet) (map[string][]string, error) {
+
+	content, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read config file: %v", err)
+	}
+	var options map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(content))
+	d.UseNumber()
+	if err := d.Decode(&options); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", name, err)
+	}
+
+	values := make(map[string][]string, len(options))
+	for option, v := range options {
+		if fs.Lookup(option) == nil || option == "configFile" {
+			return nil, fmt.Errorf("invalid config file %s: unknown option %s", name, option)
+		}
+		items, isArray := v.([]interface{})
+		if !isArray {
+			items = []interface{}{v}
+		}
+		for _, item := range items {
+			switch item.(type) {
+			case string, json.Number, bool:
+				values[option] = append(values[option], fmt.Sprint(item))
+			default:
+				return nil, fmt.Errorf("invalid config file %s: invalid value for option %s: %v", name, option, item)
+			}
+		}
+	}
+	return values, nil
+}
+
+// name of the environment variable setting an option, like
+// MONGOPLAYGROUND_MAX_DB_CREATIONS for maxDBCreations
+func envName(option string) string {
+	r := []rune(option)
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) && (unicode.IsLower(r[i-1]) || i+1 < len(r) && unicode.IsLower(r[i+1])) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
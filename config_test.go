@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("fail to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json":  `{"port": 8080, "mongodb": ["mongodb://localhost:27017", "mongodb://localhost:27018"], "queryTimeout": "10s", "maxDocs": 500, "storage": "memory"}`,
+		"unknown.json": `{"listen": ":8080"}`,
+		"invalid.json": `{"port": "http"}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("fail to write %s: %v", name, err)
+		}
+	}
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	loadConfigTests := []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		check func(c *config) bool
+		err   string
+	}{
+		{
+			name: "default configuration",
+			check: func(c *config) bool {
+				return c.port == 80 && c.storage == "badger" && c.limits.maxDocs == 100 && len(c.mongoURIs) == 0 && c.adminAddr == ""
+			},
+		},
+		{
+			name: "flags",
+			args: []string{"-port", "8080", "-mongodb", "mongodb://a", "-mongodb", "mongodb://b", "-maxCollections", "20", "-expireInterval", "1h"},
+			check: func(c *config) bool {
+				return c.port == 8080 && strings.Join(c.mongoURIs, ",") == "mongodb://a,mongodb://b" && c.limits.maxCollections == 20 && c.expireInterval == time.Hour
+			},
+		},
+		{
+			name: "environment variables",
+			env:  map[string]string{"MONGOPLAYGROUND_PORT": "9090", "MONGOPLAYGROUND_MONGODB": "mongodb://a mongodb://b,c/?replicaSet=rs", "MONGOPLAYGROUND_MAX_DB_CREATIONS": "8"},
+			check: func(c *config) bool {
+				return c.port == 9090 && strings.Join(c.mongoURIs, " ") == "mongodb://a mongodb://b,c/?replicaSet=rs" && c.traffic.maxDBCreations == 8
+			},
+		},
+		{
+			name: "comma in environment variable",
+			env:  map[string]string{"MONGOPLAYGROUND_ALLOW_OPERATOR": "$out,$where"},
+			err:  "operator $out,$where is not blocked",
+		},
+		{
+			name: "config file",
+			args: []string{"-configFile", file("config.json")},
+			check: func(c *config) bool {
+				return c.port == 8080 && len(c.mongoURIs) == 2 && c.limits.timeout == 10*time.Second && c.limits.maxDocs == 500 && c.storage == "memory"
+			},
+		},
+		{
+			name:  "config file from environment",
+			env:   map[string]string{"MONGOPLAYGROUND_CONFIG_FILE": file("config.json")},
+			check: func(c *config) bool { return c.port == 8080 && c.limits.maxDocs == 500 },
+		},
+		{
+			name: "flags override environment, which overrides config file",
+			args: []string{"-configFile", file("config.json"), "-port", "7070"},
+			env:  map[string]string{"MONGOPLAYGROUND_PORT": "9090", "MONGOPLAYGROUND_MAX_DOCS": "200", "MONGOPLAYGROUND_MONGODB": "mongodb://c"},
+			check: func(c *config) bool {
+				return c.port == 7070 && c.limits.maxDocs == 200 && strings.Join(c.mongoURIs, ",") == "mongodb://c" && c.storage == "memory"
+			},
+		},
+		{
+			name:  "allowed operators",
+			args:  []string{"-allowOperator", "$out", "-allowOperator", "$where"},
+			check: func(c *config) bool { return c.limits.allowedOperators["$out"] && c.limits.allowedOperators["$where"] },
+		},
+		{
+			name:  "trusted proxies",
+			args:  []string{"-trustedProxy", "10.0.0.0/8", "-trustedProxy", "192.168.1.1"},
+			check: func(c *config) bool { return len(c.traffic.trustedProxies) == 2 },
+		},
+		{
+			name: "invalid trusted proxy",
+			args: []string{"-trustedProxy", "proxy.local"},
+			err:  "invalid trusted proxy proxy.local, expected an IP or a CIDR like 10.0.0.0/8",
+		},
+		{
+			name: "unknown flag",
+			args: []string{"-listen", ":80"},
+			err:  "flag provided but not defined: -listen",
+		},
+		{
+			name: "invalid environment variable",
+			env:  map[string]string{"MONGOPLAYGROUND_QUERY_TIMEOUT": "10"},
+			err:  `invalid value "10" for option queryTimeout`,
+		},
+		{
+			name: "missing config file",
+			args: []string{"-configFile", file("missing.json")},
+			err:  "fail to read config file: open " + file("missing.json"),
+		},
+		{
+			name: "unknown option in config file",
+			args: []string{"-configFile", file("unknown.json")},
+			err:  "invalid config file " + file("unknown.json") + ": unknown option listen",
+		},
+		{
+			name: "invalid value in config file",
+			args: []string{"-configFile", file("invalid.json")},
+			err:  `invalid value "http" for option port`,
+		},
+		{
+			name: "operator not blocked",
+			args: []string{"-allowOperator", "$match"},
+			err:  "operator $match is not blocked",
+		},
+		{
+			name: "null cleanup interval",
+			args: []string{"-cleanupInterval", "0s"},
+			err:  "invalid value 0s for option cleanupInterval: should be positive",
+		},
+		{
+			name: "null prune interval",
+			env:  map[string]string{"MONGOPLAYGROUND_PRUNE_INTERVAL": "0"},
+			err:  "invalid value 0s for option pruneInterval: should be positive",
+		},
+		{
+			name: "negative query timeout",
+			args: []string{"-queryTimeout", "-1s"},
+			err:  "invalid value -1s for option queryTimeout: should be positive",
+		},
+		{
+			name: "negative page retention",
+			args: []string{"-pageRetention", "-24h"},
+			err:  "invalid value -24h0m0s for option pageRetention: should not be negative",
+		},
+		{
+			name:  "pages kept forever",
+			args:  []string{"-pageRetention", "0"},
+			check: func(c *config) bool { return c.pageRetention == 0 },
+		},
+		{
+			name: "negative max docs",
+			args: []string{"-maxDocs", "-1"},
+			err:  "invalid value -1 for option maxDocs: should not be negative",
+		},
+		{
+			name: "negative rate limit",
+			args: []string{"-rateLimit", "-0.5"},
+			err:  "invalid value -0.5 for option rateLimit: should not be negative",
+		},
+		{
+			name:  "no limit on databases",
+			args:  []string{"-maxDatabases", "0", "-maxDBCreations", "0"},
+			check: func(c *config) bool { return c.pool.maxDatabases == 0 && c.traffic.maxDBCreations == 0 },
+		},
+	}
+
+	for _, tt := range loadConfigTests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(name string) string { return tt.env[name] }
+			c, err := loadConfig(tt.args, getenv, ioutil.Discard)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Errorf("expected error starting with\n'%s'\nbut got\n'%v'", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			if !tt.check(c) {
+				t.Errorf("unexpected configuration %+v", c)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+
+	t.Parallel()
+
+	envNameTests := map[string]string{
+		"port":           "MONGOPLAYGROUND_PORT",
+		"configFile":     "MONGOPLAYGROUND_CONFIG_FILE",
+		"maxDBCreations": "MONGOPLAYGROUND_MAX_DB_CREATIONS",
+		"mongodb":        "MONGOPLAYGROUND_MONGODB",
+	}
+	for option, want := range envNameTests {
+		if got := envName(option); want != got {
+			t.Errorf("expected %s for option %s, but got %s", want, option, got)
+		}
+	}
+}
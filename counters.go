@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// views and runs of saved pages, kept in memory and written to the storage
+// in batches, so that viewing or running a page doesn't wait for a write
+type pageCounters struct {
+	sync.Mutex
+	// keyed by page ID
+	pending map[string]*pageCount
+}
+
+// views and runs of a page since the last flush
+type pageCount struct {
+	views        uint64
+	runs         uint64
+	lastViewedAt int64
+}
+
+// add the metadata of the page recorded since the last flush
+func (n *pageCount) apply(p *page) {
+	p.Views += n.views
+	p.Runs += n.runs
+	if n.lastViewedAt > p.LastViewedAt {
+		p.LastViewedAt = n.lastViewedAt
+	}
+}
+
+// apply update to the count of the page identified by id, and return
+// the updated count
+func (c *pageCounters) record(id []byte, update func(n *pageCount)) pageCount {
+	c.Lock()
+	defer c.Unlock()
+	if c.pending == nil {
+		c.pending = map[string]*pageCount{}
+	}
+	n, ok := c.pending[string(id)]
+	if !ok {
+		n = &pageCount{}
+		c.pending[string(id)] = n
+	}
+	update(n)
+	return *n
+}
+
+// last view of the page identified by id since the last flush, or 0
+func (c *pageCounters) lastViewed(id []byte) int64 {
+	c.Lock()
+	defer c.Unlock()
+	if n, ok := c.pending[string(id)]; ok {
+		return n.lastViewedAt
+	}
+	return 0
+}
+
+// return the counts recorded since the last call, and reset them
+func (c *pageCounters) take() map[string]*pageCount {
+	c.Lock()
+	defer c.Unlock()
+	pending := c.pending
+	c.pending = nil
+	return pending
+}
+
+// record a view of the page identified by id, and return the views and
+// runs not written to the storage yet
+func (s *server) countView(id []byte) pageCount {
+	return s.counters.record(id, func(n *pageCount) {
+		n.views++
+		n.lastViewedAt = time.Now().Unix()
+	})
+}
+
+// record a run of the p page. Runs of pages that are not saved are
+// dropped when counters are flushed
+func (s *server) countRun(p *page) {
+	saved := *p
+	saved.MongoVersion = s.savedVersion(p.MongoVersion)
+	s.counters.record(saved.ID(), func(n *pageCount) { n.runs++ })
+	// pages saved without a version are displayed and run with the
+	// version of the default backend
+	if len(saved.MongoVersion) > 0 && s.normalizeVersion(saved.MongoVersion) == nil {
+		saved.MongoVersion = nil
+		s.counters.record(saved.ID(), func(n *pageCount) { n.runs++ })
+	}
+}
+
+// write the views and runs recorded since the last flush to the storage.
+// Each page is written once, whatever its number of views and runs
+func (s *server) flushCounters() {
+	for id, n := range s.counters.take() {
+		s.updatePage([]byte(id), n.apply)
+	}
+}
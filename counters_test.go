@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+)
+
+func TestFlushCounters(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		logger:   log.New(ioutil.Discard, "", 0),
+		storage:  newMemoryStore(),
+		backends: []backend{{version: []byte("4.0.10")}},
+	}
+	saved := &page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery)}
+	id, err := s.save(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := &page{Mode: bsonMode, Config: []byte(`[{"_id":2}]`), Query: []byte(templateQuery)}
+	deletedID, err := s.save(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.loadPage(id)
+			s.countRun(&page{Mode: saved.Mode, Config: saved.Config, Query: saved.Query})
+		}()
+	}
+	wg.Wait()
+
+	s.loadPage(deletedID)
+	s.storage.Delete(deletedID)
+
+	s.flushCounters()
+	// counters are reset once written
+	s.flushCounters()
+
+	val, err := s.storage.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &page{}
+	if err := p.decode(val); err != nil {
+		t.Fatal(err)
+	}
+	if p.Views != 50 || p.Runs != 50 || p.LastViewedAt == 0 {
+		t.Errorf("expected 50 views and 50 runs, but got %d views and %d runs, last view at %d", p.Views, p.Runs, p.LastViewedAt)
+	}
+	if _, err := s.storage.Get(deletedID); err != errPageNotFound {
+		t.Errorf("flushing counters should not save a deleted page, but got %v", err)
+	}
+	if len(s.counters.pending) != 0 {
+		t.Errorf("expected no pending counters, but got %d", len(s.counters.pending))
+	}
+}
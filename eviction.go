@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// limits on the databases created for playgrounds. When a limit is
+// exceeded, the least recently used databases are dropped, without
+// waiting for them to expire
+type poolLimits struct {
+	// max number of databases, or 0 for no limit
+	maxDatabases int
+	// max total data size of the databases in bytes, or 0 for no limit
+	maxBytes int64
+}
+
+var defaultPoolLimits = poolLimits{
+	maxDatabases: 1000,
+	maxBytes:     1 << 30,
+}
+
+func (l poolLimits) exceeded(databases int, bytes int64) bool {
+	return l.maxDatabases > 0 && databases > l.maxDatabases ||
+		l.maxBytes > 0 && bytes > l.maxBytes
+}
+
+// a database created for a playground
+type pooledDB struct {
+	Name    string    `json:"name"`
+	LastUse time.Time `json:"lastUse"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// state of the databases created for playgrounds
+type poolState struct {
+	Databases    int   `json:"databases"`
+	MaxDatabases int   `json:"maxDatabases"`
+	Bytes        int64 `json:"bytes"`
+	MaxBytes     int64 `json:"maxBytes"`
+	// databases in eviction order, least recently used first
+	Pool []pooledDB `json:"pool"`
+}
+
+// list the tracked databases, least recently used first
+func (s *server) pooledDBs() []pooledDB {
+	pool := make([]pooledDB, 0)
+	s.activeDB.Range(func(k, v interface{}) bool {
+		d := pooledDB{
+			Name:    k.(string),
+			LastUse: time.Unix(v.(int64), 0).UTC(),
+		}
+		if size, ok := s.dbSizes.Load(k); ok {
+			d.Bytes = size.(int64)
+		}
+		pool = append(pool, d)
+		return true
+	})
+	sort.Slice(pool, func(i, j int) bool {
+		if !pool[i].LastUse.Equal(pool[j].LastUse) {
+			return pool[i].LastUse.Before(pool[j].LastUse)
+		}
+		return pool[i].Name < pool[j].Name
+	})
+	return pool
+}
+
+// record the size of a database just created
+func (s *server) addToPool(db *mgo.Database) {
+	size, err := databaseSize(db)
+	if err != nil {
+		s.logger.Printf("fail to get size of database %s: %v", db.Name, err)
+	}
+	s.dbSizes.Store(db.Name, size)
+}
+
+// data size of a database in bytes
+func databaseSize(db *mgo.Database) (int64, error) {
+	var stats struct {
+		DataSize float64 `bson:"dataSize"`
+	}
+	err := db.Run(bson.D{{Name: "dbStats", Value: 1}}, &stats)
+	return int64(stats.DataSize), err
+}
+
+// drop the least recently used databases until the pool is within its
+// limits. keep is the database just created, and is never evicted, like
+// databases being queried
+func (s *server) evictDB(keep string) {
+
+	limits := s.config.pool
+	if limits.maxDatabases <= 0 && limits.maxBytes <= 0 {
+		return
+	}
+	// the lock is only taken when databases have to be dropped
+	if _, count, bytes := s.poolUsage(); !limits.exceeded(count, bytes) {
+		return
+	}
+
+	s.dropping.Lock()
+	defer s.dropping.Unlock()
+
+	pool, count, bytes := s.poolUsage()
+	if !limits.exceeded(count, bytes) {
+		return
+	}
+
+	sessions := s.copySessions()
+	defer closeSessions(sessions)
+
+	for _, d := range pool {
+		if !limits.exceeded(count, bytes) {
+			break
+		}
+		if d.Name == keep {
+			continue
+		}
+		dropped, err := s.dropDB(sessions, d.Name)
+		if err != nil {
+			s.logger.Printf("fail to evict database %s: %v", d.Name, err)
+			continue
+		}
+		if !dropped {
+			continue
+		}
+		s.metrics.evictedDatabase()
+		count--
+		bytes -= d.Bytes
+	}
+}
+
+// tracked databases, least recently used first, with their number and
+// total size
+func (s *server) poolUsage() (pool []pooledDB, count int, bytes int64) {
+	pool = s.pooledDBs()
+	for _, d := range pool {
+		bytes += d.Bytes
+	}
+	return pool, len(pool), bytes
+}
+
+// copy the sessions of every backend. The backend of a database is not
+// tracked, so databases are dropped from every backend, as dropping a
+// missing database is a no-op
+func (s *server) copySessions() []*mgo.Session {
+	sessions := make([]*mgo.Session, 0, len(s.backends))
+	for _, b := range s.backends {
+		sessions = append(sessions, b.session.Copy())
+	}
+	return sessions
+}
+
+func closeSessions(sessions []*mgo.Session) {
+	for _, session := range sessions {
+		session.Close()
+	}
+}
+
+// drop a database from every backend and stop tracking it. A database
+// being queried, or not tracked anymore, is not dropped
+func (s *server) dropDB(sessions []*mgo.Session, name string) (dropped bool, err error) {
+
+	if !s.using.reserve(name) {
+		return false, nil
+	}
+	// runs of this database wait until it is dropped
+	defer s.using.unreserve(name)
+
+	if _, ok := s.activeDB.Load(name); !ok {
+		return false, nil
+	}
+	for _, session := range sessions {
+		if err := session.DB(name).DropDatabase(); err != nil {
+			return false, err
+		}
+	}
+	s.activeDB.Delete(name)
+	s.dbSizes.Delete(name)
+	return true, nil
+}
+
+// expose the state of the databases created for playgrounds
+func (s *server) adminDatabasesHandler(w http.ResponseWriter, r *http.Request) {
+
+	state := poolState{
+		MaxDatabases: s.config.pool.maxDatabases,
+		MaxBytes:     s.config.pool.maxBytes,
+		Pool:         s.pooledDBs(),
+	}
+	state.Databases = len(state.Pool)
+	for _, d := range state.Pool {
+		state.Bytes += d.Bytes
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		s.logger.Printf("fail to write state of databases: %v", err)
+	}
+}
+
+// a lock per database name. The zero value is ready to use
+type dbLocks struct {
+	sync.Mutex
+	locks map[string]*dbLock
+}
+
+type dbLock struct {
+	sync.Mutex
+	// number of goroutines holding or waiting for the lock. The lock
+	// is forgotten once nobody uses it
+	users int
+}
+
+func (l *dbLocks) lock(name string) {
+	l.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*dbLock{}
+	}
+	d, ok := l.locks[name]
+	if !ok {
+		d = &dbLock{}
+		l.locks[name] = d
+	}
+	d.users++
+	l.Unlock()
+
+	d.Lock()
+}
+
+func (l *dbLocks) unlock(name string) {
+	l.Lock()
+	d := l.locks[name]
+	d.users--
+	if d.users == 0 {
+		delete(l.locks, name)
+	}
+	l.Unlock()
+
+	d.Unlock()
+}
+
+// number of runs using each database. A database reserved to be dropped
+// has -1 users, and runs of it wait until it is dropped. The zero value
+// is ready to use
+type dbUsers struct {
+	sync.Mutex
+	released *sync.Cond
+	users    map[string]int
+}
+
+func (u *dbUsers) init() {
+	if u.users == nil {
+		u.users = map[string]int{}
+		u.released = sync.NewCond(&u.Mutex)
+	}
+}
+
+// mark the database as used, waiting for it to be dropped first if it
+// is reserved
+func (u *dbUsers) acquire(name string) {
+	u.Lock()
+	defer u.Unlock()
+	u.init()
+	for u.users[name] < 0 {
+		u.released.Wait()
+	}
+	u.users[name]++
+}
+
+func (u *dbUsers) release(name string) {
+	u.Lock()
+	defer u.Unlock()
+	u.users[name]--
+	if u.users[name] == 0 {
+		delete(u.users, name)
+	}
+}
+
+// reserve the database to drop it. This fails if the database is used
+// or already reserved
+func (u *dbUsers) reserve(name string) bool {
+	u.Lock()
+	defer u.Unlock()
+	u.init()
+	if u.users[name] != 0 {
+		return false
+	}
+	u.users[name] = -1
+	return true
+}
+
+func (u *dbUsers) unreserve(name string) {
+	u.Lock()
+	defer u.Unlock()
+	delete(u.users, name)
+	u.released.Broadcast()
+}
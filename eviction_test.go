@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// databases a, b, c and d, from the least to the most recently used
+func testPoolServer(limits poolLimits) *server {
+	s := &server{
+		logger:  log.New(ioutil.Discard, "", 0),
+		metrics: newMetrics(),
+		config:  &config{pool: limits},
+	}
+	for i, name := range []string{"a", "b", "c", "d"} {
+		s.activeDB.Store(name, int64(1500000000+i))
+		s.dbSizes.Store(name, int64(100*(i+1)))
+	}
+	return s
+}
+
+func TestEvictDB(t *testing.T) {
+
+	t.Parallel()
+
+	evictDBTests := []struct {
+		name      string
+		limits    poolLimits
+		keep      string
+		used      string
+		remaining []string
+	}{
+		{
+			name:      "no limit",
+			limits:    poolLimits{},
+			keep:      "d",
+			remaining: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:      "within limits",
+			limits:    poolLimits{maxDatabases: 4, maxBytes: 1000},
+			keep:      "d",
+			remaining: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:      "too many databases",
+			limits:    poolLimits{maxDatabases: 2},
+			keep:      "d",
+			remaining: []string{"c", "d"},
+		},
+		{
+			name:      "too large",
+			limits:    poolLimits{maxBytes: 800},
+			keep:      "d",
+			remaining: []string{"c", "d"},
+		},
+		{
+			name:      "too large with size lower than max number",
+			limits:    poolLimits{maxDatabases: 3, maxBytes: 500},
+			keep:      "d",
+			remaining: []string{"d"},
+		},
+		{
+			name:      "used database is not evicted",
+			limits:    poolLimits{maxDatabases: 2},
+			keep:      "a",
+			remaining: []string{"a", "d"},
+		},
+		{
+			name:      "database being queried is not evicted",
+			limits:    poolLimits{maxDatabases: 2},
+			keep:      "d",
+			used:      "a",
+			remaining: []string{"a", "d"},
+		},
+	}
+
+	for _, tt := range evictDBTests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testPoolServer(tt.limits)
+			if tt.used != "" {
+				s.using.acquire(tt.used)
+				defer s.using.release(tt.used)
+			}
+			s.evictDB(tt.keep)
+
+			remaining := make([]string, 0)
+			for _, d := range s.pooledDBs() {
+				remaining = append(remaining, d.Name)
+			}
+			if !reflect.DeepEqual(tt.remaining, remaining) {
+				t.Errorf("expected remaining databases %v, but got %v", tt.remaining, remaining)
+			}
+			if want, got := uint64(4-len(tt.remaining)), s.metrics.evictedDB; want != got {
+				t.Errorf("expected %d evicted databases, but got %d", want, got)
+			}
+			sizes := 0
+			s.dbSizes.Range(func(k, v interface{}) bool {
+				sizes++
+				return true
+			})
+			if want, got := len(tt.remaining), sizes; want != got {
+				t.Errorf("expected size of %d databases to be tracked, but got %d", want, got)
+			}
+		})
+	}
+}
+
+// with a pool of one database, each run of a new configuration evicts the
+// databases of the others. A run should never see its database dropped
+func TestConcurrentRunsAndEviction(t *testing.T) {
+
+	s := &server{
+		logger:   log.New(ioutil.Discard, "", 0),
+		session:  testServer.session,
+		backends: testServer.backends,
+		metrics:  newMetrics(),
+		config:   &config{limits: defaultLimits, pool: poolLimits{maxDatabases: 1}},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(config string) {
+			defer wg.Done()
+			p := &page{
+				Mode:   bsonMode,
+				Config: []byte(config),
+				Query:  []byte("db.collection.find()"),
+			}
+			result, err := s.run(p)
+			if err != nil {
+				t.Errorf("expected no error, but got %v", err)
+				return
+			}
+			if want, got := config, string(bytes.TrimSuffix(result, []byte("\n"))); want != got {
+				t.Errorf("expected result %s, but got %s", want, got)
+			}
+		}(fmt.Sprintf(`[{"_id":"eviction %d"}]`, i%3))
+	}
+	wg.Wait()
+
+	pool := s.pooledDBs()
+	if len(pool) != 1 {
+		t.Errorf("expected 1 database in the pool, but got %v", pool)
+	}
+	if s.metrics.evictedDB == 0 {
+		t.Errorf("expected databases to be evicted")
+	}
+
+	sessions := s.copySessions()
+	defer closeSessions(sessions)
+	for _, d := range pool {
+		s.dropDB(sessions, d.Name)
+	}
+}
+
+// databases are only locked when some of them have to be dropped
+func TestEvictDBWithinLimits(t *testing.T) {
+
+	t.Parallel()
+
+	s := testPoolServer(poolLimits{maxDatabases: 4})
+	s.dropping.Lock()
+	defer s.dropping.Unlock()
+
+	evicted := make(chan struct{})
+	go func() {
+		s.evictDB("d")
+		close(evicted)
+	}()
+	select {
+	case <-evicted:
+	case <-time.After(time.Second):
+		t.Errorf("eviction within limits should not wait for other drops")
+	}
+}
+
+func TestDBUsers(t *testing.T) {
+
+	t.Parallel()
+
+	var u dbUsers
+
+	u.acquire("a")
+	if u.reserve("a") {
+		t.Errorf("a database being used should not be reserved")
+	}
+	u.release("a")
+	if !u.reserve("a") {
+		t.Errorf("a database not used anymore should be reserved")
+	}
+	if u.reserve("a") {
+		t.Errorf("a database should not be reserved twice")
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		u.acquire("a")
+		close(acquired)
+	}()
+	// other databases are not blocked
+	u.acquire("b")
+	u.release("b")
+
+	select {
+	case <-acquired:
+		t.Fatalf("a reserved database should not be used")
+	case <-time.After(50 * time.Millisecond):
+	}
+	u.unreserve("a")
+	<-acquired
+	u.release("a")
+
+	if len(u.users) != 0 {
+		t.Errorf("unused databases should be forgotten, but got %v", u.users)
+	}
+}
+
+func TestDBLocks(t *testing.T) {
+
+	t.Parallel()
+
+	var locks dbLocks
+	var wg sync.WaitGroup
+	running := map[string]int{}
+	var mu sync.Mutex
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			locks.lock(name)
+			defer locks.unlock(name)
+
+			mu.Lock()
+			running[name]++
+			if running[name] > 1 {
+				t.Errorf("database %s is locked twice", name)
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			running[name]--
+			mu.Unlock()
+		}(fmt.Sprintf("db%d", i%5))
+	}
+	wg.Wait()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("unused locks should be forgotten, but got %v", locks.locks)
+	}
+}
+
+func TestAdminDatabasesHandler(t *testing.T) {
+
+	t.Parallel()
+
+	s := testPoolServer(poolLimits{maxDatabases: 10, maxBytes: 2000})
+
+	req, _ := http.NewRequest(http.MethodGet, "/admin/databases", nil)
+	resp := httptest.NewRecorder()
+	s.adminDatabasesHandler(resp, req)
+
+	if http.StatusOK != resp.Code {
+		t.Errorf("expected code %d but got %d", http.StatusOK, resp.Code)
+	}
+	var state poolState
+	if err := json.Unmarshal(resp.Body.Bytes(), &state); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	want := poolState{
+		Databases:    4,
+		MaxDatabases: 10,
+		Bytes:        1000,
+		MaxBytes:     2000,
+		Pool: []pooledDB{
+			{Name: "a", LastUse: time.Unix(1500000000, 0).UTC(), Bytes: 100},
+			{Name: "b", LastUse: time.Unix(1500000001, 0).UTC(), Bytes: 200},
+			{Name: "c", LastUse: time.Unix(1500000002, 0).UTC(), Bytes: 300},
+			{Name: "d", LastUse: time.Unix(1500000003, 0).UTC(), Bytes: 400},
+		},
+	}
+	if !reflect.DeepEqual(want, state) {
+		t.Errorf("expected state\n%+v\nbut got\n%+v", want, state)
+	}
+}
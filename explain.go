@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// verbosity modes accepted by explain()
+var explainVerbosity = map[string]bool{
+	"queryPlanner":      true,
+	"executionStats":    true,
+	"allPlansExecution": true,
+}
+
+// remove the explain() call from the query, if any, and return the
+// requested verbosity. Both forms of the mongo shell are supported:
+//
+//	db.collection.find({k: 1}).explain("executionStats")
+//	db.collection.explain("executionStats").aggregate([...])
+func explainOf(q *query) (verbosity string, explain bool, err error) {
+
+	var args []byte
+	switch {
+	case q.method() == "explain":
+		if len(q.calls) < 2 {
+			return "", false, errInvalidQuery
+		}
+		args = q.calls[0].args
+		q.calls = q.calls[1:]
+	case len(q.calls) > 1 && q.calls[len(q.calls)-1].method == "explain" && q.method() == "find":
+		args = q.calls[len(q.calls)-1].args
+		q.calls = q.calls[:len(q.calls)-1]
+	default:
+		return "", false, nil
+	}
+
+	if q.method() != "find" && q.method() != "aggregate" {
+		return "", false, fmt.Errorf("query failed: explain() is only supported with find() and aggregate(), but was %s()", q.method())
+	}
+
+	verbosity = "queryPlanner"
+	if len(args) == 0 {
+		return verbosity, true, nil
+	}
+	var v interface{}
+	if err := bson.UnmarshalJSON(args, &v); err != nil {
+		return "", false, parseErrorf("invalid explain: %v", err)
+	}
+	switch v := v.(type) {
+	case bool:
+		// like in the mongo shell, explain(true) returns the stats of all plans
+		if v {
+			verbosity = "allPlansExecution"
+		}
+	case string:
+		if !explainVerbosity[v] {
+			return "", false, parseErrorf("invalid verbosity for explain: %s", v)
+		}
+		verbosity = v
+	default:
+		return "", false, parseErrorf("invalid verbosity for explain: %v", v)
+	}
+	return verbosity, true, nil
+}
+
+// build the find command equivalent to a find() query and the cursor modifiers
+// chained after it. Modifiers are expected to be already validated by
+// applyModifiers
+func findCommand(name string, stages []bson.M, modifiers []call) (bson.D, error) {
+
+	filter := stages[0]
+	if filter == nil {
+		filter = bson.M{}
+	}
+	cmd := bson.D{
+		{Name: "find", Value: name},
+		{Name: "filter", Value: filter},
+	}
+	if len(stages[1]) > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "projection", Value: stages[1]})
+	}
+
+	for _, m := range modifiers {
+		var value interface{}
+		switch m.method {
+		case "sort", "hint":
+			doc, err := orderedDoc(m.args)
+			if err != nil {
+				return nil, parseErrorf("invalid %s: %v", m.method, err)
+			}
+			value = doc
+		case "limit", "skip":
+			var n int
+			if err := bson.UnmarshalJSON(m.args, &n); err != nil {
+				return nil, parseErrorf("invalid %s: %v", m.method, err)
+			}
+			value = n
+		case "collation":
+			var collation bson.M
+			if err := bson.UnmarshalJSON(m.args, &collation); err != nil {
+				return nil, parseErrorf("invalid collation: %v", err)
+			}
+			value = collation
+		case "count":
+			return nil, errors.New("query failed: explain() can't be used with count()")
+		default:
+			continue
+		}
+		cmd = setElem(cmd, m.method, value)
+	}
+	return cmd, nil
+}
+
+// set the value of the element name in d, replacing the existing one if any
+func setElem(d bson.D, name string, value interface{}) bson.D {
+	for i := range d {
+		if d[i].Name == name {
+			d[i].Value = value
+			return d
+		}
+	}
+	return append(d, bson.DocElem{Name: name, Value: value})
+}
+
+// convert a document like {b: 1, a: -1} into a bson.D, keeping the order
+// of the keys
+func orderedDoc(spec []byte) (bson.D, error) {
+
+	var values bson.M
+	err := bson.UnmarshalJSON(spec, &values)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := orderedKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		doc = append(doc, bson.DocElem{Name: k, Value: values[k]})
+	}
+	return doc, nil
+}
+
+// run the explain command for cmd and return a summary of the
+// query plan
+func runExplain(db *mgo.Database, cmd bson.D, verbosity string, l runLimits) (*queryOutput, error) {
+
+	// with executionStats verbosity, the query is actually run
+	cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: l.maxTimeMS()})
+
+	var result bson.M
+	err := db.Run(bson.D{
+		{Name: "explain", Value: cmd},
+		{Name: "verbosity", Value: verbosity},
+	}, &result)
+	if err != nil {
+		return queryResult(nil, l.check(err))
+	}
+	return &queryOutput{docs: []interface{}{explainSummary(result)}}, nil
+}
+
+// extract the winning plan, the indexes used and the execution stats from the
+// output of the explain command. For aggregation, the plan may be either at
+// the top level or in the $cursor stage of the pipeline
+func explainSummary(result bson.M) bson.D {
+
+	planner, _ := result["queryPlanner"].(bson.M)
+	stats, _ := result["executionStats"].(bson.M)
+	if stages, ok := result["stages"].([]interface{}); ok && planner == nil && len(stages) > 0 {
+		if first, ok := stages[0].(bson.M); ok {
+			cursor, _ := first["$cursor"].(bson.M)
+			planner, _ = cursor["queryPlanner"].(bson.M)
+			stats, _ = cursor["executionStats"].(bson.M)
+		}
+	}
+
+	plan, _ := planner["winningPlan"].(bson.M)
+	if plan == nil {
+		// unknown format, let the user read the raw output
+		return bson.D{{Name: "explain", Value: result}}
+	}
+	if queryPlan, ok := plan["queryPlan"].(bson.M); ok {
+		plan = queryPlan
+	}
+
+	indexes := []string{}
+	summary := bson.D{
+		{Name: "namespace", Value: planner["namespace"]},
+		{Name: "winningPlan", Value: planStages(plan, &indexes)},
+		{Name: "indexesUsed", Value: indexes},
+	}
+	if stats != nil {
+		summary = append(summary,
+			bson.DocElem{Name: "nReturned", Value: stats["nReturned"]},
+			bson.DocElem{Name: "executionTimeMillis", Value: stats["executionTimeMillis"]},
+			bson.DocElem{Name: "totalKeysExamined", Value: stats["totalKeysExamined"]},
+			bson.DocElem{Name: "totalDocsExamined", Value: stats["totalDocsExamined"]},
+		)
+	}
+	return append(summary, bson.DocElem{Name: "plan", Value: plan})
+}
+
+// return the stages of the plan from the root to the leaves, like
+// "FETCH > IXSCAN k_1", and collect the names of the indexes used
+func planStages(plan bson.M, indexes *[]string) string {
+
+	var buf bytes.Buffer
+	stage, _ := plan["stage"].(string)
+	buf.WriteString(stage)
+	if name, ok := plan["indexName"].(string); ok {
+		buf.WriteString(" " + name)
+		*indexes = append(*indexes, name)
+	}
+
+	if input, ok := plan["inputStage"].(bson.M); ok {
+		buf.WriteString(" > " + planStages(input, indexes))
+	}
+	if inputs, ok := plan["inputStages"].([]interface{}); ok {
+		parts := make([]string, 0, len(inputs))
+		for _, in := range inputs {
+			if input, ok := in.(bson.M); ok {
+				parts = append(parts, planStages(input, indexes))
+			}
+		}
+		buf.WriteString(" > (" + strings.Join(parts, ", ") + ")")
+	}
+	return buf.String()
+}
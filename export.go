@@ -0,0 +1,1390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/feliixx/mgodatagen/datagen/generators"
+	"github.com/globalsign/mgo/bson"
+)
+
+// languages a playground can be exported to
+var languages = map[string]language{
+	"go":     goLanguage{},
+	"python": pythonLanguage{},
+	"node":   nodeLanguage{},
+	"java":   javaLanguage{},
+}
+
+const (
+	// database used by the exported code
+	exportDB = "playground"
+	// uri of the mongod instance used by the exported code
+	exportURI = "mongodb://localhost:27017"
+	// max length of a document or an array written on a single line
+	maxInlineLength = 60
+)
+
+// export a saved playground as a program using the driver of the requested
+// language, like /p/snbIQ3uGHGq/export?lang=go
+func (s *server) exportHandler(w http.ResponseWriter, r *http.Request, id string) {
+
+	p, err := s.loadPage([]byte(id))
+	if err != nil {
+		s.logger.Printf("requested page %s doesn't exists", id)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("this playground doesn't exist"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	code, err := exportPage(p, r.FormValue("lang"), s.config.limits)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write(code)
+}
+
+// a language a playground can be exported to
+type language interface {
+	syntax() *syntax
+	// literal of a value that is not a document, an array, a string,
+	// a boolean or null
+	scalar(e *exporter, v interface{}) (string, error)
+	// code inserting the docs in the collection, or creating the collection
+	// if there is no document
+	seed(e *exporter, collection string, docs []interface{}) (string, error)
+	// code running the statement and printing its result
+	statement(e *exporter, st *exportedStatement) (string, error)
+	// write the program running the blocks of code to w
+	program(e *exporter, w *bytes.Buffer, blocks []string)
+}
+
+// how documents and arrays are written in a language
+type syntax struct {
+	// start of a comment line
+	comment string
+	// indentation of a nested level
+	indent string
+	null   string
+	// literals of true and false
+	boolean [2]string
+	// documents are written with their keys in order
+	document list
+	array    list
+	// import required to write an array, if any
+	arrayImport string
+	// format a field of a document
+	field func(key, value string) string
+	quote func(s string) string
+}
+
+type list struct {
+	open, close string
+	// separator written after each item but the last one
+	sep string
+	// whether the last item is followed by the separator when
+	// items are written on several lines
+	trailing bool
+}
+
+// a statement of the query, with its arguments already parsed
+type exportedStatement struct {
+	source     []byte
+	collection string
+	method     string
+	// filter and projection of find(), pipeline of aggregate(), or
+	// arguments of write methods
+	args []interface{}
+	// cursor modifiers of find()
+	sort        bson.D
+	skip, limit int
+	count       bool
+}
+
+// write the program
+type exporter struct {
+	*syntax
+	lang language
+	// imports or helpers required by the code written so far
+	needs map[string]bool
+	// variables already declared
+	declared map[string]bool
+}
+
+// generate the code running the p page in the requested language. The seed
+// data is loaded from the configuration, and each statement of the query is
+// run in order
+func exportPage(p *page, lang string, limits runLimits) ([]byte, error) {
+
+	l, ok := languages[lang]
+	if !ok {
+		return nil, fmt.Errorf("unknown language %s, expected go, python, node or java", lang)
+	}
+	e := &exporter{
+		syntax:   l.syntax(),
+		lang:     l,
+		needs:    map[string]bool{},
+		declared: map[string]bool{},
+	}
+
+	collections, _, aggregators, err := loadPageContent(p, limits)
+	if err != nil {
+		return nil, err
+	}
+	names := make(sort.StringSlice, 0, len(collections))
+	for name := range collections {
+		names = append(names, name)
+	}
+	names.Sort()
+	setMissingIDs(collections, names)
+
+	sources := seedSources(p)
+	var blocks []string
+	for _, name := range names {
+		docs := make([]interface{}, 0, len(collections[name]))
+		items := arrayItems(sources[name])
+		for i, doc := range collections[name] {
+			// generated documents share the content of the collection
+			src := sources[name]
+			if p.Mode == bsonMode {
+				src = nil
+				if len(items) == len(collections[name]) {
+					src = items[i]
+				}
+			}
+			docs = append(docs, orderedMap(src, doc))
+		}
+		code, err := l.seed(e, name, docs)
+		if err != nil {
+			return nil, fmt.Errorf("fail to export collection %s: %v", name, err)
+		}
+		if fields, ok := aggregators[name]; ok {
+			code = e.commented(aggregatorNote(fields)) + "\n" + code
+		}
+		blocks = append(blocks, code)
+	}
+
+	for _, source := range splitScript(p.Query) {
+		st, err := parseStatement(source)
+		if err != nil {
+			return nil, err
+		}
+		code, err := l.statement(e, st)
+		if err != nil {
+			return nil, fmt.Errorf("fail to export %s: %v", source, err)
+		}
+		blocks = append(blocks, e.commented(string(source))+"\n"+code)
+	}
+
+	var buf bytes.Buffer
+	l.program(e, &buf, blocks)
+	return buf.Bytes(), nil
+}
+
+// source of the documents of each collection of the configuration, used to
+// write them with their keys in the order they're declared. For bson, this
+// is the array of documents, and for mgodatagen, the content of the
+// collection. Collections that can't be found are missing
+func seedSources(p *page) map[string][]byte {
+
+	sources := map[string][]byte{}
+	config := bytes.TrimSpace(p.Config)
+
+	if p.Mode == mgodatagenMode {
+		for _, c := range arrayItems(config) {
+			keys, values, err := documentFields(c)
+			if err != nil {
+				continue
+			}
+			var name string
+			var content []byte
+			for i, k := range keys {
+				switch k {
+				case "collection":
+					bson.UnmarshalJSON(values[i], &name)
+				case "content":
+					content = values[i]
+				}
+			}
+			sources[name] = content
+		}
+		return sources
+	}
+
+	if bytes.HasPrefix(config, []byte("[")) {
+		sources["collection"] = config
+		return sources
+	}
+	keys, values, _ := documentFields(bytes.TrimPrefix(config, []byte("db=")))
+	for i, k := range keys {
+		sources[k] = values[i]
+	}
+	return sources
+}
+
+// the fields computed by aggregators are only known once the database is
+// created, so they're not part of the seed data
+func aggregatorNote(fields map[string]generators.Config) string {
+	names := make(sort.StringSlice, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	names.Sort()
+	return fmt.Sprintf("fields %s are computed by aggregators, and are not part of the seed data", strings.Join(names, ", "))
+}
+
+// parse a statement of the query, and keep only what can be exported
+func parseStatement(source []byte) (*exportedStatement, error) {
+
+	q, err := parseQuery(source)
+	if err != nil {
+		return nil, err
+	}
+	st := &exportedStatement{
+		source:     source,
+		collection: q.collection,
+		method:     q.method(),
+	}
+	args := q.calls[0].args
+
+	switch {
+	case st.method == "find":
+		stages, err := stages(args)
+		if err != nil {
+			return nil, parseErrorf("%v", err)
+		}
+		items := arrayItems(argsSource(args))
+		st.args = []interface{}{bson.D{}, nil}
+		if len(stages) > 0 && stages[0] != nil {
+			st.args[0] = orderedMap(itemSource(items, 0), stages[0])
+		}
+		// an empty projection returns all fields
+		if len(stages) > 1 && len(stages[1]) > 0 {
+			st.args[1] = orderedMap(itemSource(items, 1), stages[1])
+		}
+		return st, st.applyModifiers(q.calls[1:])
+
+	case st.method == "aggregate":
+		stages, opts, err := pipeline(args)
+		if err != nil {
+			return nil, parseErrorf("%v", err)
+		}
+		if len(opts) > 0 {
+			return nil, fmt.Errorf("fail to export %s: options of aggregate() can't be exported", source)
+		}
+		items := arrayItems(argsSource(args))
+		p := make([]interface{}, 0, len(stages))
+		for i, stage := range stages {
+			p = append(p, orderedMap(itemSource(items, i), stage))
+		}
+		st.args = []interface{}{p}
+
+	case writeMethods[st.method]:
+		a, err := arguments(args)
+		if err != nil {
+			return nil, parseErrorf("%v", err)
+		}
+		st.args = ordered(append(append([]byte{'['}, args...), ']'), a).([]interface{})
+		expected := map[string]int{
+			"insertOne":  1,
+			"insertMany": 1,
+			"updateOne":  2,
+			"updateMany": 2,
+			"deleteOne":  1,
+			"deleteMany": 1,
+		}[st.method]
+		if len(st.args) > expected {
+			return nil, fmt.Errorf("fail to export %s: options of %s() can't be exported", source, st.method)
+		}
+		if len(st.args) < expected {
+			return nil, fmt.Errorf("fail to export %s: %s() expects %d arguments, but got %d", source, st.method, expected, len(st.args))
+		}
+		if _, ok := st.args[0].([]interface{}); st.method == "insertMany" && !ok {
+			return nil, fmt.Errorf("fail to export %s: insertMany requires an array of documents", source)
+		}
+
+	default:
+		return nil, fmt.Errorf("fail to export %s: %s() can't be exported", source, st.method)
+	}
+
+	for _, m := range q.calls[1:] {
+		if m.method != "pretty" && m.method != "toArray" {
+			return nil, fmt.Errorf("fail to export %s: %s() can't be exported", source, m.method)
+		}
+	}
+	return st, nil
+}
+
+// source of the arguments of find() or aggregate() as an array, like
+// stages() and pipeline() parse them
+func argsSource(args []byte) []byte {
+	if len(args) > 0 && args[0] == '[' {
+		if end := closing(args, 0, '[', ']'); end != -1 {
+			return args[:end+1]
+		}
+		return args
+	}
+	return append(append([]byte{'['}, args...), ']')
+}
+
+// source of the i-th item, or nil if the items don't match the
+// decoded values
+func itemSource(items [][]byte, i int) []byte {
+	if i < len(items) {
+		return items[i]
+	}
+	return nil
+}
+
+// apply the cursor modifiers chained after find(), like applyModifiers does
+func (st *exportedStatement) applyModifiers(modifiers []call) error {
+
+	countAll := true
+	for _, m := range modifiers {
+		switch m.method {
+		case "sort":
+			sort, err := orderedDoc(m.args)
+			if err != nil {
+				return parseErrorf("invalid sort: %v", err)
+			}
+			st.sort = sort
+		case "limit", "skip":
+			n := &st.limit
+			if m.method == "skip" {
+				n = &st.skip
+			}
+			if err := bson.UnmarshalJSON(m.args, n); err != nil {
+				return parseErrorf("invalid %s: %v", m.method, err)
+			}
+		case "count":
+			st.count = true
+			countAll = !bytes.Equal(m.args, []byte("true"))
+		case "pretty", "toArray":
+		default:
+			return fmt.Errorf("fail to export %s: %s() can't be exported", st.source, m.method)
+		}
+	}
+	// like in the mongo shell, count() ignores skip and limit unless
+	// it's called with true
+	if st.count && countAll {
+		st.skip, st.limit = 0, 0
+	}
+	return nil
+}
+
+// write v in the language of the exporter
+func (e *exporter) value(v interface{}) (string, error) {
+
+	switch v := v.(type) {
+	case nil:
+		return e.null, nil
+	case bool:
+		if v {
+			return e.boolean[0], nil
+		}
+		return e.boolean[1], nil
+	case string:
+		return e.quote(v), nil
+	case bson.M:
+		return e.value(orderedMap(nil, v))
+	case map[string]interface{}:
+		return e.value(orderedMap(nil, v))
+	case bson.D:
+		items := make([]string, 0, len(v))
+		for _, elem := range v {
+			value, err := e.value(elem.Value)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, e.field(elem.Name, value))
+		}
+		return e.list(e.document, items), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, elem := range v {
+			value, err := e.value(elem)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, value)
+		}
+		if e.arrayImport != "" {
+			e.needs[e.arrayImport] = true
+		}
+		return e.list(e.array, items), nil
+	}
+	return e.lang.scalar(e, v)
+}
+
+// convert v, decoded from the json src, so that its documents are bson.D
+// with their keys in the order they're declared in src
+func ordered(src []byte, v interface{}) interface{} {
+
+	switch v := v.(type) {
+	case bson.M:
+		return orderedMap(src, v)
+	case map[string]interface{}:
+		return orderedMap(src, v)
+	case []interface{}:
+		items := arrayItems(src)
+		a := make([]interface{}, 0, len(v))
+		for i, elem := range v {
+			var item []byte
+			if len(items) == len(v) {
+				item = items[i]
+			}
+			a = append(a, ordered(item, elem))
+		}
+		return a
+	}
+	return v
+}
+
+// convert the map doc into a bson.D with its keys in the order they're declared in
+// src. Keys missing from src, like the _id added to documents without one,
+// come first and are sorted by name, as mongodb moves _id first
+func orderedMap(src []byte, doc map[string]interface{}) bson.D {
+
+	keys, values, _ := documentFields(src)
+	sources := make(map[string][]byte, len(keys))
+	for i, k := range keys {
+		sources[k] = values[i]
+	}
+	missing := make(sort.StringSlice, 0)
+	for k := range doc {
+		if _, ok := sources[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	missing.Sort()
+
+	d := make(bson.D, 0, len(doc))
+	for _, k := range missing {
+		d = append(d, bson.DocElem{Name: k, Value: ordered(nil, doc[k])})
+	}
+	written := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		v, ok := doc[k]
+		// with duplicated keys, the last value is kept at the position
+		// of the first one
+		if !ok || written[k] {
+			continue
+		}
+		written[k] = true
+		d = append(d, bson.DocElem{Name: k, Value: ordered(sources[k], v)})
+	}
+	return d
+}
+
+// write the items on a single line if they're short enough, and
+// one item per line otherwise
+func (e *exporter) list(l list, items []string) string {
+
+	if len(items) == 0 {
+		return strings.TrimSpace(l.open) + strings.TrimSpace(l.close)
+	}
+
+	length := len(l.open) + len(l.close)
+	multiline := false
+	for _, item := range items {
+		length += len(item) + len(l.sep) + 1
+		multiline = multiline || strings.Contains(item, "\n")
+	}
+	if !multiline && length <= maxInlineLength {
+		sep := l.sep
+		if sep != "" {
+			sep += " "
+		}
+		return l.open + strings.Join(items, sep) + l.close
+	}
+
+	var buf strings.Builder
+	buf.WriteString(strings.TrimRight(l.open, " "))
+	for i, item := range items {
+		buf.WriteString("\n")
+		buf.WriteString(indent(item, e.indent))
+		if i < len(items)-1 || l.trailing {
+			buf.WriteString(l.sep)
+		}
+	}
+	if l.close != "" {
+		buf.WriteString("\n")
+		buf.WriteString(strings.TrimLeft(l.close, " "))
+	}
+	return buf.String()
+}
+
+// write the values as the arguments of a function call
+func (e *exporter) args(values ...interface{}) (string, error) {
+	args := make([]string, 0, len(values))
+	for _, v := range values {
+		arg, err := e.value(v)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, ", "), nil
+}
+
+// return op if the variable is not declared yet, and "=" otherwise
+func (e *exporter) declare(name, op string) string {
+	if e.declared[name] {
+		return "="
+	}
+	e.declared[name] = true
+	return op
+}
+
+func (e *exporter) commented(s string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(e.comment+" "+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// return the imports or helpers required so far, in alphabetical order
+func (e *exporter) required() []string {
+	needs := make([]string, 0, len(e.needs))
+	for n := range e.needs {
+		needs = append(needs, n)
+	}
+	sort.Strings(needs)
+	return needs
+}
+
+// prefix each non empty line of s with prefix
+func indent(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// write the blocks of code separated by an empty line
+func writeBlocks(w *bytes.Buffer, blocks []string, prefix string) {
+	for i, block := range blocks {
+		if i > 0 {
+			w.WriteString("\n")
+		}
+		w.WriteString(indent(block, prefix))
+		w.WriteString("\n")
+	}
+}
+
+// format a number like the mongo shell, so integers are written
+// without decimal part
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// quote s as a json string, which is a valid string literal in
+// python, javascript and java
+func jsonQuote(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func timestampParts(t bson.MongoTimestamp) (sec, inc uint32) {
+	return uint32(t >> 32), uint32(t)
+}
+
+func unsupported(v interface{}) error {
+	return fmt.Errorf("values of type %T can't be exported", v)
+}
+
+type goLanguage struct{}
+
+func (goLanguage) syntax() *syntax {
+	return &syntax{
+		comment:  "//",
+		indent:   "\t",
+		null:     "nil",
+		boolean:  [2]string{"true", "false"},
+		document: list{open: "bson.D{", close: "}", sep: ",", trailing: true},
+		array:    list{open: "bson.A{", close: "}", sep: ",", trailing: true},
+		field: func(key, value string) string {
+			return "{Key: " + strconv.Quote(key) + ", Value: " + value + "}"
+		},
+		quote: strconv.Quote,
+	}
+}
+
+func (goLanguage) scalar(e *exporter, v interface{}) (string, error) {
+
+	switch v := v.(type) {
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			e.needs["math"] = true
+			return "math.NaN()", nil
+		case math.IsInf(v, 0):
+			e.needs["math"] = true
+			return fmt.Sprintf("math.Inf(%d)", int(math.Copysign(1, v))), nil
+		}
+		return formatFloat(v), nil
+	case int:
+		// go int are encoded as int64 by the driver
+		return fmt.Sprintf("int32(%d)", v), nil
+	case int32:
+		return fmt.Sprintf("int32(%d)", v), nil
+	case int64:
+		return fmt.Sprintf("int64(%d)", v), nil
+	case bson.ObjectId:
+		e.needs["objectID"] = true
+		return fmt.Sprintf("objectID(%q)", v.Hex()), nil
+	case time.Time:
+		e.needs["time"] = true
+		v = v.UTC()
+		return fmt.Sprintf("time.Date(%d, time.%s, %d, %d, %d, %d, %d, time.UTC)", v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond()), nil
+	case bson.RegEx:
+		e.needs["primitive"] = true
+		return fmt.Sprintf("primitive.Regex{Pattern: %s, Options: %s}", strconv.Quote(v.Pattern), strconv.Quote(v.Options)), nil
+	case bson.Decimal128:
+		e.needs["decimal128"] = true
+		return fmt.Sprintf("decimal128(%q)", v.String()), nil
+	case []byte:
+		e.needs["primitive"] = true
+		return fmt.Sprintf("primitive.Binary{Data: []byte(%s)}", strconv.Quote(string(v))), nil
+	case bson.Binary:
+		e.needs["primitive"] = true
+		return fmt.Sprintf("primitive.Binary{Subtype: 0x%02x, Data: []byte(%s)}", v.Kind, strconv.Quote(string(v.Data))), nil
+	case bson.MongoTimestamp:
+		e.needs["primitive"] = true
+		sec, inc := timestampParts(v)
+		return fmt.Sprintf("primitive.Timestamp{T: %d, I: %d}", sec, inc), nil
+	}
+	switch v {
+	case bson.MinKey:
+		e.needs["primitive"] = true
+		return "primitive.MinKey{}", nil
+	case bson.MaxKey:
+		e.needs["primitive"] = true
+		return "primitive.MaxKey{}", nil
+	}
+	return "", unsupported(v)
+}
+
+func (goLanguage) seed(e *exporter, collection string, docs []interface{}) (string, error) {
+	if len(docs) == 0 {
+		return fmt.Sprintf("err = db.CreateCollection(ctx, %s)\n%s", strconv.Quote(collection), goCheckErr), nil
+	}
+	args, err := e.args(docs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("_, err = db.Collection(%s).InsertMany(ctx, %s)\n%s", strconv.Quote(collection), args, goCheckErr), nil
+}
+
+const goCheckErr = `if err != nil {
+	log.Fatal(err)
+}`
+
+var goWriteMethods = map[string]string{
+	"insertOne":  "InsertOne",
+	"insertMany": "InsertMany",
+	"updateOne":  "UpdateOne",
+	"updateMany": "UpdateMany",
+	"deleteOne":  "DeleteOne",
+	"deleteMany": "DeleteMany",
+}
+
+func (goLanguage) statement(e *exporter, st *exportedStatement) (string, error) {
+
+	coll := fmt.Sprintf("db.Collection(%s)", strconv.Quote(st.collection))
+
+	if method, ok := goWriteMethods[st.method]; ok {
+		args, err := e.args(st.args...)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("_, err = %s.%s(ctx, %s)\n%s", coll, method, args, goCheckErr), nil
+	}
+
+	var call string
+	switch {
+	case st.count:
+		filter, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		opts := ""
+		if st.skip != 0 {
+			opts += fmt.Sprintf(".SetSkip(%d)", st.skip)
+		}
+		if st.limit != 0 {
+			opts += fmt.Sprintf(".SetLimit(%d)", st.limit)
+		}
+		if opts != "" {
+			opts = ", options.Count()" + opts
+		}
+		e.needs["fmt"] = true
+		return fmt.Sprintf("count, err %s %s.CountDocuments(ctx, %s%s)\n%s\nfmt.Println(count)", e.declare("count", ":="), coll, filter, opts, goCheckErr), nil
+	case st.method == "find":
+		filter, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		opts := ""
+		if st.args[1] != nil {
+			projection, err := e.value(st.args[1])
+			if err != nil {
+				return "", err
+			}
+			opts += ".SetProjection(" + projection + ")"
+		}
+		if st.sort != nil {
+			sort, err := e.value(st.sort)
+			if err != nil {
+				return "", err
+			}
+			opts += ".SetSort(" + sort + ")"
+		}
+		if st.skip != 0 {
+			opts += fmt.Sprintf(".SetSkip(%d)", st.skip)
+		}
+		if st.limit != 0 {
+			opts += fmt.Sprintf(".SetLimit(%d)", st.limit)
+		}
+		if opts != "" {
+			opts = ", options.Find()" + opts
+		}
+		call = fmt.Sprintf("Find(ctx, %s%s)", filter, opts)
+	default:
+		pipeline, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		call = fmt.Sprintf("Aggregate(ctx, %s)", pipeline)
+	}
+
+	e.needs["fmt"] = true
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "cursor, err %s %s.%s\n%s\n", e.declare("cursor", ":="), coll, call, goCheckErr)
+	if !e.declared["results"] {
+		e.declared["results"] = true
+		buf.WriteString("var results []bson.D\n")
+	}
+	fmt.Fprintf(&buf, "err = cursor.All(ctx, &results)\n%s\nfmt.Println(results)", goCheckErr)
+	return buf.String(), nil
+}
+
+// the program is formatted with gofmt
+func (l goLanguage) program(e *exporter, w *bytes.Buffer, blocks []string) {
+	var buf bytes.Buffer
+	l.write(e, &buf, blocks)
+	code, err := format.Source(buf.Bytes())
+	if err != nil {
+		code = buf.Bytes()
+	}
+	w.Write(code)
+}
+
+func (goLanguage) write(e *exporter, w *bytes.Buffer, blocks []string) {
+
+	w.WriteString("package main\n\nimport (\n\t\"context\"\n")
+	for _, pkg := range []string{"fmt", "log", "math", "time"} {
+		if pkg == "log" || e.needs[pkg] {
+			fmt.Fprintf(w, "\t%q\n", pkg)
+		}
+	}
+	w.WriteString("\n\t\"go.mongodb.org/mongo-driver/bson\"\n")
+	if e.needs["primitive"] || e.needs["objectID"] || e.needs["decimal128"] {
+		w.WriteString("\t\"go.mongodb.org/mongo-driver/bson/primitive\"\n")
+	}
+	w.WriteString("\t\"go.mongodb.org/mongo-driver/mongo\"\n\t\"go.mongodb.org/mongo-driver/mongo/options\"\n)\n\n")
+
+	fmt.Fprintf(w, `func main() {
+
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(%q))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database(%q)
+
+`, exportURI, exportDB)
+	writeBlocks(w, blocks, "\t")
+	w.WriteString("}\n")
+
+	if e.needs["objectID"] {
+		w.WriteString(`
+func objectID(hex string) primitive.ObjectID {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return id
+}
+`)
+	}
+	if e.needs["decimal128"] {
+		w.WriteString(`
+func decimal128(s string) primitive.Decimal128 {
+	d, err := primitive.ParseDecimal128(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return d
+}
+`)
+	}
+}
+
+type pythonLanguage struct{}
+
+func (pythonLanguage) syntax() *syntax {
+	field := func(key, value string) string {
+		return jsonQuote(key) + ": " + value
+	}
+	return &syntax{
+		comment:  "#",
+		indent:   "    ",
+		null:     "None",
+		boolean:  [2]string{"True", "False"},
+		document: list{open: "{", close: "}", sep: ",", trailing: true},
+		array:    list{open: "[", close: "]", sep: ",", trailing: true},
+		field:    field,
+		quote:    jsonQuote,
+	}
+}
+
+func (pythonLanguage) scalar(e *exporter, v interface{}) (string, error) {
+
+	switch v := v.(type) {
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return `float("nan")`, nil
+		case math.IsInf(v, 1):
+			return `float("inf")`, nil
+		case math.IsInf(v, -1):
+			return `float("-inf")`, nil
+		}
+		return formatFloat(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.Itoa(int(v)), nil
+	case int64:
+		e.needs["Int64"] = true
+		return fmt.Sprintf("Int64(%d)", v), nil
+	case bson.ObjectId:
+		e.needs["ObjectId"] = true
+		return fmt.Sprintf("ObjectId(%q)", v.Hex()), nil
+	case time.Time:
+		e.needs["datetime"] = true
+		v = v.UTC()
+		return fmt.Sprintf("datetime.datetime(%d, %d, %d, %d, %d, %d, %d, tzinfo=datetime.timezone.utc)", v.Year(), v.Month(), v.Day(), v.Hour(), v.Minute(), v.Second(), v.Nanosecond()/1000), nil
+	case bson.RegEx:
+		e.needs["Regex"] = true
+		return fmt.Sprintf("Regex(%s, %s)", jsonQuote(v.Pattern), jsonQuote(v.Options)), nil
+	case bson.Decimal128:
+		e.needs["Decimal128"] = true
+		return fmt.Sprintf("Decimal128(%q)", v.String()), nil
+	case []byte:
+		e.needs["Binary"] = true
+		return fmt.Sprintf("Binary(%s)", pythonBytes(v)), nil
+	case bson.Binary:
+		e.needs["Binary"] = true
+		return fmt.Sprintf("Binary(%s, %d)", pythonBytes(v.Data), v.Kind), nil
+	case bson.MongoTimestamp:
+		e.needs["Timestamp"] = true
+		sec, inc := timestampParts(v)
+		return fmt.Sprintf("Timestamp(%d, %d)", sec, inc), nil
+	}
+	switch v {
+	case bson.MinKey:
+		e.needs["MinKey"] = true
+		return "MinKey()", nil
+	case bson.MaxKey:
+		e.needs["MaxKey"] = true
+		return "MaxKey()", nil
+	}
+	return "", unsupported(v)
+}
+
+// write b as a python bytes literal
+func pythonBytes(b []byte) string {
+	var buf strings.Builder
+	buf.WriteString(`b"`)
+	for _, c := range b {
+		if c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, `\x%02x`, c)
+		}
+	}
+	buf.WriteString(`"`)
+	return buf.String()
+}
+
+func (pythonLanguage) seed(e *exporter, collection string, docs []interface{}) (string, error) {
+	if len(docs) == 0 {
+		return fmt.Sprintf("db.create_collection(%s)", jsonQuote(collection)), nil
+	}
+	args, err := e.args(docs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("db[%s].insert_many(%s)", jsonQuote(collection), args), nil
+}
+
+var pythonWriteMethods = map[string]string{
+	"insertOne":  "insert_one",
+	"insertMany": "insert_many",
+	"updateOne":  "update_one",
+	"updateMany": "update_many",
+	"deleteOne":  "delete_one",
+	"deleteMany": "delete_many",
+}
+
+func (pythonLanguage) statement(e *exporter, st *exportedStatement) (string, error) {
+
+	coll := fmt.Sprintf("db[%s]", jsonQuote(st.collection))
+
+	if method, ok := pythonWriteMethods[st.method]; ok {
+		args, err := e.args(st.args...)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s.%s(%s)", coll, method, args), nil
+	}
+
+	if st.method == "aggregate" {
+		pipeline, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("print(list(%s.aggregate(%s)))", coll, pipeline), nil
+	}
+
+	args, err := e.value(st.args[0])
+	if err != nil {
+		return "", err
+	}
+	if st.args[1] != nil && !st.count {
+		projection, err := e.value(st.args[1])
+		if err != nil {
+			return "", err
+		}
+		args += ", " + projection
+	}
+	if st.sort != nil && !st.count {
+		// pymongo expects a list of (key, direction) pairs
+		pairs := make([]string, 0, len(st.sort))
+		for _, elem := range st.sort {
+			direction, err := e.value(elem.Value)
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, fmt.Sprintf("(%s, %s)", jsonQuote(elem.Name), direction))
+		}
+		args += ", sort=" + e.list(e.array, pairs)
+	}
+	if st.skip != 0 {
+		args += fmt.Sprintf(", skip=%d", st.skip)
+	}
+	if st.limit != 0 {
+		args += fmt.Sprintf(", limit=%d", st.limit)
+	}
+	if st.count {
+		return fmt.Sprintf("print(%s.count_documents(%s))", coll, args), nil
+	}
+	return fmt.Sprintf("print(list(%s.find(%s)))", coll, args), nil
+}
+
+func (pythonLanguage) program(e *exporter, w *bytes.Buffer, blocks []string) {
+
+	if e.needs["datetime"] {
+		w.WriteString("import datetime\n\n")
+	}
+	var types []string
+	for _, n := range e.required() {
+		if n != "datetime" {
+			types = append(types, n)
+		}
+	}
+	if len(types) > 0 {
+		fmt.Fprintf(w, "from bson import %s\n", strings.Join(types, ", "))
+	}
+	fmt.Fprintf(w, "from pymongo import MongoClient\n\nclient = MongoClient(%q)\ndb = client[%q]\n\n", exportURI, exportDB)
+	writeBlocks(w, blocks, "")
+}
+
+type nodeLanguage struct{}
+
+// keys that don't need to be quoted in javascript
+var jsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+func (nodeLanguage) syntax() *syntax {
+	field := func(key, value string) string {
+		if !jsIdentifier.MatchString(key) {
+			key = jsonQuote(key)
+		}
+		return key + ": " + value
+	}
+	return &syntax{
+		comment:  "//",
+		indent:   "  ",
+		null:     "null",
+		boolean:  [2]string{"true", "false"},
+		document: list{open: "{ ", close: " }", sep: ",", trailing: true},
+		array:    list{open: "[", close: "]", sep: ",", trailing: true},
+		field:    field,
+		quote:    jsonQuote,
+	}
+}
+
+func (nodeLanguage) scalar(e *exporter, v interface{}) (string, error) {
+
+	switch v := v.(type) {
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "NaN", nil
+		case math.IsInf(v, 1):
+			return "Infinity", nil
+		case math.IsInf(v, -1):
+			return "-Infinity", nil
+		}
+		return formatFloat(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.Itoa(int(v)), nil
+	case int64:
+		e.needs["Long"] = true
+		return fmt.Sprintf(`Long.fromString("%d")`, v), nil
+	case bson.ObjectId:
+		e.needs["ObjectId"] = true
+		return fmt.Sprintf("new ObjectId(%q)", v.Hex()), nil
+	case time.Time:
+		return fmt.Sprintf("new Date(%q)", v.UTC().Format("2006-01-02T15:04:05.000Z")), nil
+	case bson.RegEx:
+		e.needs["BSONRegExp"] = true
+		return fmt.Sprintf("new BSONRegExp(%s, %s)", jsonQuote(v.Pattern), jsonQuote(v.Options)), nil
+	case bson.Decimal128:
+		e.needs["Decimal128"] = true
+		return fmt.Sprintf("Decimal128.fromString(%q)", v.String()), nil
+	case []byte:
+		e.needs["Binary"] = true
+		return fmt.Sprintf("new Binary(Buffer.from(%q, \"base64\"))", base64.StdEncoding.EncodeToString(v)), nil
+	case bson.Binary:
+		e.needs["Binary"] = true
+		return fmt.Sprintf("new Binary(Buffer.from(%q, \"base64\"), %d)", base64.StdEncoding.EncodeToString(v.Data), v.Kind), nil
+	case bson.MongoTimestamp:
+		e.needs["Timestamp"] = true
+		sec, inc := timestampParts(v)
+		return fmt.Sprintf("Timestamp.fromBits(%d, %d)", inc, sec), nil
+	}
+	switch v {
+	case bson.MinKey:
+		e.needs["MinKey"] = true
+		return "new MinKey()", nil
+	case bson.MaxKey:
+		e.needs["MaxKey"] = true
+		return "new MaxKey()", nil
+	}
+	return "", unsupported(v)
+}
+
+func (nodeLanguage) seed(e *exporter, collection string, docs []interface{}) (string, error) {
+	if len(docs) == 0 {
+		return fmt.Sprintf("await db.createCollection(%s);", jsonQuote(collection)), nil
+	}
+	args, err := e.args(docs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("await db.collection(%s).insertMany(%s);", jsonQuote(collection), args), nil
+}
+
+func (nodeLanguage) statement(e *exporter, st *exportedStatement) (string, error) {
+
+	coll := fmt.Sprintf("db.collection(%s)", jsonQuote(st.collection))
+
+	if writeMethods[st.method] {
+		args, err := e.args(st.args...)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("await %s.%s(%s);", coll, st.method, args), nil
+	}
+
+	if st.method == "aggregate" {
+		pipeline, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("console.dir(await %s.aggregate(%s).toArray(), { depth: null });", coll, pipeline), nil
+	}
+
+	filter, err := e.value(st.args[0])
+	if err != nil {
+		return "", err
+	}
+	if st.count {
+		opts := bson.D{}
+		if st.skip != 0 {
+			opts = append(opts, bson.DocElem{Name: "skip", Value: st.skip})
+		}
+		if st.limit != 0 {
+			opts = append(opts, bson.DocElem{Name: "limit", Value: st.limit})
+		}
+		if len(opts) > 0 {
+			o, err := e.value(opts)
+			if err != nil {
+				return "", err
+			}
+			filter += ", " + o
+		}
+		return fmt.Sprintf("console.log(await %s.countDocuments(%s));", coll, filter), nil
+	}
+
+	call := "find(" + filter
+	if st.args[1] != nil {
+		projection, err := e.value(bson.D{{Name: "projection", Value: st.args[1]}})
+		if err != nil {
+			return "", err
+		}
+		call += ", " + projection
+	}
+	call += ")"
+	if st.sort != nil {
+		sort, err := e.value(st.sort)
+		if err != nil {
+			return "", err
+		}
+		call += ".sort(" + sort + ")"
+	}
+	if st.skip != 0 {
+		call += fmt.Sprintf(".skip(%d)", st.skip)
+	}
+	if st.limit != 0 {
+		call += fmt.Sprintf(".limit(%d)", st.limit)
+	}
+	return fmt.Sprintf("console.dir(await %s.%s.toArray(), { depth: null });", coll, call), nil
+}
+
+func (nodeLanguage) program(e *exporter, w *bytes.Buffer, blocks []string) {
+
+	imports := append([]string{"MongoClient"}, e.required()...)
+	sort.Strings(imports)
+	fmt.Fprintf(w, `const { %s } = require("mongodb");
+
+async function main() {
+  const client = new MongoClient(%q);
+  await client.connect();
+  try {
+    const db = client.db(%q);
+
+`, strings.Join(imports, ", "), exportURI, exportDB)
+	writeBlocks(w, blocks, "    ")
+	w.WriteString(`  } finally {
+    await client.close();
+  }
+}
+
+main().catch(console.error);
+`)
+}
+
+type javaLanguage struct{}
+
+func (javaLanguage) syntax() *syntax {
+	field := func(key, value string) string {
+		return ".append(" + jsonQuote(key) + ", " + value + ")"
+	}
+	return &syntax{
+		comment:     "//",
+		indent:      "    ",
+		null:        "null",
+		boolean:     [2]string{"true", "false"},
+		document:    list{open: "new Document()"},
+		array:       list{open: "Arrays.asList(", close: ")", sep: ","},
+		arrayImport: "java.util.Arrays",
+		field:       field,
+		quote:       jsonQuote,
+	}
+}
+
+func (javaLanguage) scalar(e *exporter, v interface{}) (string, error) {
+
+	switch v := v.(type) {
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "Double.NaN", nil
+		case math.IsInf(v, 1):
+			return "Double.POSITIVE_INFINITY", nil
+		case math.IsInf(v, -1):
+			return "Double.NEGATIVE_INFINITY", nil
+		}
+		return formatFloat(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int32:
+		return strconv.Itoa(int(v)), nil
+	case int64:
+		return fmt.Sprintf("%dL", v), nil
+	case bson.ObjectId:
+		e.needs["org.bson.types.ObjectId"] = true
+		return fmt.Sprintf("new ObjectId(%q)", v.Hex()), nil
+	case time.Time:
+		e.needs["java.time.Instant"] = true
+		e.needs["java.util.Date"] = true
+		return fmt.Sprintf("Date.from(Instant.parse(%q))", v.UTC().Format("2006-01-02T15:04:05.000Z")), nil
+	case bson.RegEx:
+		e.needs["org.bson.BsonRegularExpression"] = true
+		return fmt.Sprintf("new BsonRegularExpression(%s, %s)", jsonQuote(v.Pattern), jsonQuote(v.Options)), nil
+	case bson.Decimal128:
+		e.needs["org.bson.types.Decimal128"] = true
+		return fmt.Sprintf("Decimal128.parse(%q)", v.String()), nil
+	case []byte:
+		e.needs["org.bson.types.Binary"] = true
+		e.needs["java.util.Base64"] = true
+		return fmt.Sprintf("new Binary(Base64.getDecoder().decode(%q))", base64.StdEncoding.EncodeToString(v)), nil
+	case bson.Binary:
+		e.needs["org.bson.types.Binary"] = true
+		e.needs["java.util.Base64"] = true
+		return fmt.Sprintf("new Binary((byte) %d, Base64.getDecoder().decode(%q))", v.Kind, base64.StdEncoding.EncodeToString(v.Data)), nil
+	case bson.MongoTimestamp:
+		e.needs["org.bson.BsonTimestamp"] = true
+		sec, inc := timestampParts(v)
+		return fmt.Sprintf("new BsonTimestamp(%d, %d)", sec, inc), nil
+	}
+	switch v {
+	case bson.MinKey:
+		e.needs["org.bson.types.MinKey"] = true
+		return "new MinKey()", nil
+	case bson.MaxKey:
+		e.needs["org.bson.types.MaxKey"] = true
+		return "new MaxKey()", nil
+	}
+	return "", unsupported(v)
+}
+
+func (javaLanguage) seed(e *exporter, collection string, docs []interface{}) (string, error) {
+	if len(docs) == 0 {
+		return fmt.Sprintf("db.createCollection(%s);", jsonQuote(collection)), nil
+	}
+	args, err := e.args(docs)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("db.getCollection(%s).insertMany(%s);", jsonQuote(collection), args), nil
+}
+
+func (javaLanguage) statement(e *exporter, st *exportedStatement) (string, error) {
+
+	coll := fmt.Sprintf("db.getCollection(%s)", jsonQuote(st.collection))
+
+	if writeMethods[st.method] {
+		args, err := e.args(st.args...)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s.%s(%s);", coll, st.method, args), nil
+	}
+
+	var call string
+	switch {
+	case st.count:
+		filter, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		opts := ""
+		if st.skip != 0 {
+			opts += fmt.Sprintf(".skip(%d)", st.skip)
+		}
+		if st.limit != 0 {
+			opts += fmt.Sprintf(".limit(%d)", st.limit)
+		}
+		if opts != "" {
+			e.needs["com.mongodb.client.model.CountOptions"] = true
+			opts = ", new CountOptions()" + opts
+		}
+		return fmt.Sprintf("System.out.println(%s.countDocuments(%s%s));", coll, filter, opts), nil
+	case st.method == "find":
+		filter, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		call = "find(" + filter + ")"
+		if st.args[1] != nil {
+			projection, err := e.value(st.args[1])
+			if err != nil {
+				return "", err
+			}
+			call += ".projection(" + projection + ")"
+		}
+		if st.sort != nil {
+			sort, err := e.value(st.sort)
+			if err != nil {
+				return "", err
+			}
+			call += ".sort(" + sort + ")"
+		}
+		if st.skip != 0 {
+			call += fmt.Sprintf(".skip(%d)", st.skip)
+		}
+		if st.limit != 0 {
+			call += fmt.Sprintf(".limit(%d)", st.limit)
+		}
+	default:
+		pipeline, err := e.value(st.args[0])
+		if err != nil {
+			return "", err
+		}
+		call = "aggregate(" + pipeline + ")"
+	}
+	return fmt.Sprintf("for (Document doc : %s.%s) {\n    System.out.println(doc.toJson());\n}", coll, call), nil
+}
+
+func (javaLanguage) program(e *exporter, w *bytes.Buffer, blocks []string) {
+
+	imports := append([]string{
+		"com.mongodb.client.MongoClient",
+		"com.mongodb.client.MongoClients",
+		"com.mongodb.client.MongoDatabase",
+		"org.bson.Document",
+	}, e.required()...)
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(w, "import %s;\n", imp)
+	}
+	fmt.Fprintf(w, `
+public class Playground {
+
+    public static void main(String[] args) {
+        try (MongoClient client = MongoClients.create(%q)) {
+            MongoDatabase db = client.getDatabase(%q);
+
+`, exportURI, exportDB)
+	writeBlocks(w, blocks, "            ")
+	w.WriteString("        }\n    }\n}\n")
+}
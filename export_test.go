@@ -0,0 +1,203 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportPage(t *testing.T) {
+
+	t.Parallel()
+
+	config := `[{"_id":1,"k":"a"},{"_id":2}]`
+	query := `db.collection.find({"_id":1}).sort({"k":-1}).limit(1)`
+
+	exportTests := []struct {
+		name     string
+		lang     string
+		config   string
+		query    string
+		contains []string
+		err      string
+	}{
+		{
+			name:  "python",
+			lang:  "python",
+			query: query,
+			contains: []string{
+				`db["collection"].insert_many([{"_id": 1, "k": "a"}, {"_id": 2}])`,
+				"# " + query,
+				`print(list(db["collection"].find({"_id": 1}, sort=[("k", -1)], limit=1)))`,
+			},
+		},
+		{
+			name:  "go",
+			lang:  "go",
+			query: query,
+			contains: []string{
+				`db.Collection("collection").InsertMany(ctx, bson.A{`,
+				`bson.D{{Key: "_id", Value: 1}, {Key: "k", Value: "a"}},`,
+				"// " + query,
+				`db.Collection("collection").Find(ctx, bson.D{{Key: "_id", Value: 1}}, options.Find().SetSort(bson.D{{Key: "k", Value: -1}}).SetLimit(1))`,
+				"var results []bson.D",
+			},
+		},
+		{
+			name:  "node",
+			lang:  "node",
+			query: query,
+			contains: []string{
+				`await db.collection("collection").insertMany([{ _id: 1, k: "a" }, { _id: 2 }]);`,
+				`console.dir(await db.collection("collection").find({ _id: 1 }).sort({ k: -1 }).limit(1).toArray(), { depth: null });`,
+			},
+		},
+		{
+			name:  "java",
+			lang:  "java",
+			query: query,
+			contains: []string{
+				`new Document().append("_id", 1).append("k", "a"),`,
+				`db.getCollection("collection").find(new Document().append("_id", 1)).sort(new Document().append("k", -1)).limit(1)`,
+			},
+		},
+		{
+			name:     "write methods",
+			lang:     "python",
+			query:    `db.collection.updateOne({"_id":1},{"$set":{"k":"b"}});db.collection.find()`,
+			contains: []string{`db["collection"].update_one({"_id": 1}, {"$set": {"k": "b"}})`, `print(list(db["collection"].find({})))`},
+		},
+		{
+			name:     "keys of the configuration in order",
+			lang:     "python",
+			config:   `db={"collection":[{"z":1,"a":{"y":2,"b":3}},{"_id":2,"b":[{"d":1,"c":2}]}]}`,
+			query:    `db.collection.find()`,
+			contains: []string{"\"_id\": ObjectId(\"5a934e000102030405000000\"),\n        \"z\": 1,\n        \"a\": {\"y\": 2, \"b\": 3},", `{"_id": 2, "b": [{"d": 1, "c": 2}]}`},
+		},
+		{
+			name:     "keys of mgodatagen content in order",
+			lang:     "node",
+			config:   `[{"collection":"collection","count":1,"content":{"z":{"type":"constant","constVal":1},"a":{"type":"constant","constVal":2}}}]`,
+			query:    `db.collection.find()`,
+			contains: []string{"_id: new ObjectId(\"5a934e000102030405000000\"),\n        z: 1,\n        a: 2,"},
+		},
+		{
+			name:  "keys of the query in order",
+			lang:  "go",
+			query: `db.collection.aggregate([{"$match":{"z":1,"a":2}},{"$sort":{"z":1,"a":-1}}]);db.collection.find({"z":1,"a":2},{"z":1,"a":1});db.collection.updateOne({"z":1,"a":2},{"$set":{"z":2,"a":1}})`,
+			contains: []string{
+				`{Key: "$match", Value: bson.D{{Key: "z", Value: 1}, {Key: "a", Value: 2}}}`,
+				`{Key: "$sort", Value: bson.D{{Key: "z", Value: 1}, {Key: "a", Value: -1}}}`,
+				`Find(ctx, bson.D{{Key: "z", Value: 1}, {Key: "a", Value: 2}}, options.Find().SetProjection(bson.D{{Key: "z", Value: 1}, {Key: "a", Value: 1}}))`,
+				`UpdateOne(ctx, bson.D{{Key: "z", Value: 1}, {Key: "a", Value: 2}}, bson.D{`,
+				`{Key: "$set", Value: bson.D{{Key: "z", Value: 2}, {Key: "a", Value: 1}}}`,
+			},
+		},
+		{
+			name:  "unknown language",
+			lang:  "rust",
+			query: query,
+			err:   "unknown language rust, expected go, python, node or java",
+		},
+		{
+			name:  "unsupported modifier",
+			lang:  "go",
+			query: `db.collection.find().hint({"_id":1})`,
+			err:   "fail to export db.collection.find().hint({\"_id\":1}): hint() can't be exported",
+		},
+		{
+			name:  "aggregate options",
+			lang:  "node",
+			query: `db.collection.aggregate([],{"allowDiskUse":true})`,
+			err:   "fail to export db.collection.aggregate([],{\"allowDiskUse\":true}): options of aggregate() can't be exported",
+		},
+		{
+			name:  "invalid query",
+			lang:  "java",
+			query: `db.collection.find(`,
+			err:   invalidQuery,
+		},
+	}
+
+	for _, tt := range exportTests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &page{Mode: bsonMode, Config: []byte(config), Query: []byte(tt.query)}
+			if tt.config != "" {
+				p.Config = []byte(tt.config)
+			}
+			if strings.Contains(tt.config, "content") {
+				p.Mode = mgodatagenMode
+			}
+			code, err := exportPage(p, tt.lang, defaultLimits)
+
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Errorf("expected error\n'%s'\nbut got\n'%v'", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(string(code), want) {
+					t.Errorf("expected code to contain\n'%s'\nbut got\n'%s'", want, code)
+				}
+			}
+		})
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	id, err := testServer.save(&page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte("db.collection.find()")})
+	if err != nil {
+		t.Fatalf("fail to save playground: %v", err)
+	}
+
+	exportHandlerTests := []struct {
+		name         string
+		url          string
+		responseCode int
+		body         string
+	}{
+		{
+			name:         "export to node",
+			url:          "/p/" + string(id) + "/export?lang=node",
+			responseCode: http.StatusOK,
+			body:         `const { MongoClient } = require("mongodb");`,
+		},
+		{
+			name:         "unknown language",
+			url:          "/p/" + string(id) + "/export?lang=c",
+			responseCode: http.StatusBadRequest,
+			body:         "unknown language c, expected go, python, node or java",
+		},
+		{
+			name:         "missing playground",
+			url:          "/p/random/export?lang=go",
+			responseCode: http.StatusNotFound,
+			body:         "this playground doesn't exist",
+		},
+	}
+
+	for _, tt := range exportHandlerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			resp := httptest.NewRecorder()
+			testServer.viewHandler(resp, req)
+
+			if tt.responseCode != resp.Code {
+				t.Errorf("expected response code %d, but got %d", tt.responseCode, resp.Code)
+			}
+			if !strings.HasPrefix(resp.Body.String(), tt.body) {
+				t.Errorf("expected body starting with\n'%s'\nbut got\n'%s'", tt.body, resp.Body)
+			}
+		})
+	}
+
+	testStorageContent(t, 0, 1)
+}
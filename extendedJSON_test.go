@@ -19,6 +19,8 @@ func TestExtendedJSON(t *testing.T) {
 
 	t.Parallel()
 
+	decimal, _ := bson.ParseDecimal128("12.50")
+
 	extendedJSONTests := []struct {
 		a interface{}
 		b string
@@ -46,6 +48,34 @@ func TestExtendedJSON(t *testing.T) {
 			a: bson.Undefined,
 			b: `undefined`,
 		},
+		{
+			a: bson.Binary{Kind: 4, Data: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}},
+			b: `UUID("01234567-89ab-cdef-0123-456789abcdef")`,
+		},
+		{
+			a: bson.Binary{Kind: 5, Data: []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}},
+			b: `MD5("0123456789abcdef0123456789abcdef")`,
+		},
+		{
+			a: decimal,
+			b: `NumberDecimal("12.50")`,
+		},
+		{
+			a: bson.M{"$ref": "coll", "$id": bson.ObjectIdHex("5a934e000102030405000000")},
+			b: `DBRef("coll",ObjectId("5a934e000102030405000000"))`,
+		},
+		{
+			a: bson.D{{Name: "$ref", Value: "coll"}, {Name: "$id", Value: 1}, {Name: "$db", Value: "db"}},
+			b: `DBRef("coll",1,"db")`,
+		},
+		{
+			a: bson.D{{Name: "b", Value: 1}, {Name: "a", Value: bson.M{"$ref": 1}}},
+			b: `{"b":1,"a":{"$ref":1}}`,
+		},
+		{
+			a: bson.RegEx{Pattern: "^a/b", Options: "i"},
+			b: `/^a\/b/i`,
+		},
 		{
 			a: int64(10),
 			b: `10`,
@@ -468,6 +498,42 @@ func TestFormatQuery(t *testing.T) {
 		{
 			name:                 `chained empty method`,
 			input:                `db.collection.find().toArray()`,
+			formattedModeBSON:    `db.collection.find().toArray()`,
+			formattedModeDatagen: `db.collection.find().toArray()`,
+		},
+		{
+			name:                 `chained cursor modifiers`,
+			input:                `db.collection.find({k: ")"}).sort({k: -1}).limit(2)`,
+			formattedModeBSON:    `db.collection.find({k: ")"}).sort({k: -1}).limit(2)`,
+			formattedModeDatagen: `db.collection.find({k: ")"}).sort({k: -1}).limit(2)`,
+		},
+		{
+			name:                 `aggregation with options`,
+			input:                `db.collection.aggregate([{"$match": {k: 1}}], {"allowDiskUse": true})`,
+			formattedModeBSON:    `db.collection.aggregate([{"$match": {k: 1}}], {"allowDiskUse": true})`,
+			formattedModeDatagen: `db.collection.aggregate([{"$match": {k: 1}}], {"allowDiskUse": true})`,
+		},
+		{
+			name:                 `chained unknown method`,
+			input:                `db.collection.find().batchSize(2)`,
+			formattedModeBSON:    `invalid`,
+			formattedModeDatagen: `invalid`,
+		},
+		{
+			name:                 `write method`,
+			input:                `db.collection.updateOne({k: 1}, {"$set": {k: 2}})`,
+			formattedModeBSON:    `db.collection.updateOne({k: 1}, {"$set": {k: 2}})`,
+			formattedModeDatagen: `db.collection.updateOne({k: 1}, {"$set": {k: 2}})`,
+		},
+		{
+			name:                 `multiple statements`,
+			input:                "db.collection.insertOne({k: \";\"});\n\ndb.collection.find()\n  .sort({k: 1})",
+			formattedModeBSON:    "db.collection.insertOne({k: \";\"});\ndb.collection.find()\n  .sort({k: 1})",
+			formattedModeDatagen: "db.collection.insertOne({k: \";\"});\ndb.collection.find()\n  .sort({k: 1})",
+		},
+		{
+			name:                 `multiple statements with invalid statement`,
+			input:                "db.collection.find()\ndb.collection.findOne()",
 			formattedModeBSON:    `invalid`,
 			formattedModeDatagen: `invalid`,
 		},
@@ -483,6 +549,24 @@ func TestFormatQuery(t *testing.T) {
 			formattedModeBSON:    `invalid`,
 			formattedModeDatagen: `invalid`,
 		},
+		{
+			name:                 `explain after find`,
+			input:                `db.collection.find({k: 1}).sort({k: 1}).explain("executionStats")`,
+			formattedModeBSON:    `db.collection.find({k: 1}).sort({k: 1}).explain("executionStats")`,
+			formattedModeDatagen: `db.collection.find({k: 1}).sort({k: 1}).explain("executionStats")`,
+		},
+		{
+			name:                 `explain before aggregate`,
+			input:                `db.collection.explain("executionStats").aggregate([{"$match": {k: 1}}])`,
+			formattedModeBSON:    `db.collection.explain("executionStats").aggregate([{"$match": {k: 1}}])`,
+			formattedModeDatagen: `db.collection.explain("executionStats").aggregate([{"$match": {k: 1}}])`,
+		},
+		{
+			name:                 `explain not last`,
+			input:                `db.collection.find().explain().limit(1)`,
+			formattedModeBSON:    `invalid`,
+			formattedModeDatagen: `invalid`,
+		},
 	}
 
 	buffer := loadPlaygroundJs(t)
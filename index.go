@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// an index to create on a collection, like
+//
+//	{"key": {"a": 1, "b": -1}, "unique": true}
+//
+// options are passed as is to the createIndexes command. The key is kept
+// as a bson.D, because the order of the fields matters for compound indexes
+type index struct {
+	key     bson.D
+	options bson.M
+}
+
+func (i *index) UnmarshalJSON(b []byte) error {
+
+	var spec struct {
+		Key orderedDocument `json:"key"`
+	}
+	err := bson.UnmarshalJSON(b, &spec)
+	if err != nil {
+		return fmt.Errorf("invalid index: %v", err)
+	}
+	if len(spec.Key) == 0 {
+		return fmt.Errorf("invalid index: key is required, but was %s", b)
+	}
+	err = bson.UnmarshalJSON(b, &i.options)
+	if err != nil {
+		return fmt.Errorf("invalid index: %v", err)
+	}
+	delete(i.options, "key")
+	i.key = bson.D(spec.Key)
+	return nil
+}
+
+// return the name of the index. If no name is specified, it's generated
+// from the key like mongodb does, for example a_1_b_-1
+func (i *index) name() string {
+	if name, ok := i.options["name"].(string); ok {
+		return name
+	}
+	parts := make([]string, 0, 2*len(i.key))
+	for _, e := range i.key {
+		parts = append(parts, e.Name, fmt.Sprint(e.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// a document keeping the order of its keys once decoded
+type orderedDocument bson.D
+
+func (d *orderedDocument) UnmarshalJSON(b []byte) error {
+	doc, err := orderedDoc(b)
+	*d = orderedDocument(doc)
+	return err
+}
+
+// a raw section of the configuration, decoded later once its
+// type is known
+type section []byte
+
+func (s *section) UnmarshalJSON(b []byte) error {
+	*s = append((*s)[:0], b...)
+	return nil
+}
+
+// load the indexes declared in a mgodatagen configuration. datagen.Index
+// is not used, as its key is a bson.M, and the order of the fields of
+// compound indexes would be lost
+func loadIndexesFromMgodatagen(indexes map[string][]index, config []byte) error {
+
+	var collConfigs []struct {
+		Name    string  `json:"collection"`
+		Indexes []index `json:"indexes"`
+	}
+	err := bson.UnmarshalJSON(config, &collConfigs)
+	if err != nil {
+		return err
+	}
+	for _, c := range collConfigs {
+		if len(c.Indexes) > 0 {
+			indexes[c.Name] = c.Indexes
+		}
+	}
+	return nil
+}
+
+// create the indexes on the collection
+func createIndexes(c *mgo.Collection, indexes []index) error {
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	specs := make([]bson.D, 0, len(indexes))
+	for _, idx := range indexes {
+		spec := bson.D{
+			{Name: "key", Value: idx.key},
+			{Name: "name", Value: idx.name()},
+		}
+		names := make(sort.StringSlice, 0, len(idx.options))
+		for name := range idx.options {
+			if name != "name" {
+				names = append(names, name)
+			}
+		}
+		names.Sort()
+		for _, name := range names {
+			spec = append(spec, bson.DocElem{Name: name, Value: idx.options[name]})
+		}
+		specs = append(specs, spec)
+	}
+
+	err := c.Database.Run(bson.D{
+		{Name: "createIndexes", Value: c.Name},
+		{Name: "indexes", Value: specs},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("fail to create indexes on collection %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// make sure that indexes are only declared for existing collections
+func checkIndexes(collections map[string][]bson.M, indexes map[string][]index) error {
+	for name := range indexes {
+		if _, ok := collections[name]; !ok {
+			return errors.New(`can't create indexes on collection "` + name + `", as it doesn't exist`)
+		}
+	}
+	return nil
+}
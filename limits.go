@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// code of the error returned by mongodb when a query
+// runs longer than its maxTimeMS
+const maxTimeMSExpired = 50
+
+// limits applied when running a playground, on the database created for
+// it and on each statement of its query, so that a single heavy query
+// can't tie up mongod for everyone
+type runLimits struct {
+	// max number of collections in a database
+	maxCollections int
+	// max number of documents in a collection
+	maxDocs int
+	// max size in bytes of a capped collection
+	maxCollectionBytes int
+	// max execution time of find(), count(), aggregate() and of the
+	// write methods, sent to mongodb as maxTimeMS
+	timeout time.Duration
+	// max number of documents returned by a statement
+	maxResultDocs int
+	// max size in bytes of the documents returned by a statement
+	maxResultBytes int
+	// operators of blockedOperators allowed anyway
+	allowedOperators map[string]bool
+}
+
+var defaultLimits = runLimits{
+	maxCollections:     10,
+	maxDocs:            100,
+	maxCollectionBytes: 100 * 1024,
+	timeout:            5 * time.Second,
+	maxResultDocs:      1000,
+	maxResultBytes:     1 << 20,
+}
+
+// error returned when a statement exceeds one of the limits
+type queryLimitError struct {
+	reason string
+}
+
+func (e *queryLimitError) Error() string {
+	return "query exceeded limit: " + e.reason
+}
+
+// maxTimeMS to send with commands run against mongodb
+func (l runLimits) maxTimeMS() int64 {
+	return int64(l.timeout / time.Millisecond)
+}
+
+// convert the error returned by mongodb when the query runs longer
+// than its maxTimeMS into a queryLimitError
+func (l runLimits) check(err error) error {
+	if e, ok := err.(*mgo.QueryError); ok && e.Code == maxTimeMSExpired {
+		return &queryLimitError{reason: fmt.Sprintf("execution took more than %v", l.timeout)}
+	}
+	return err
+}
+
+// read the documents from iter, and stop as soon as the result
+// contains too many documents or is too large
+func (l runLimits) collect(iter *mgo.Iter) ([]bson.M, error) {
+
+	var (
+		docs []bson.M
+		raw  bson.Raw
+		size int
+	)
+	for iter.Next(&raw) {
+		if len(docs) == l.maxResultDocs {
+			iter.Close()
+			return nil, &queryLimitError{reason: fmt.Sprintf("result contains more than %d documents", l.maxResultDocs)}
+		}
+		size += len(raw.Data)
+		if size > l.maxResultBytes {
+			iter.Close()
+			return nil, &queryLimitError{reason: fmt.Sprintf("result is larger than %d bytes", l.maxResultBytes)}
+		}
+		var doc bson.M
+		if err := raw.Unmarshal(&doc); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, l.check(iter.Close())
+}
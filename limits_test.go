@@ -0,0 +1,205 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+func TestQueryLimits(t *testing.T) {
+
+	p := &page{
+		Mode:   bsonMode,
+		Config: []byte(`[{"_id":1,"k":"aaaaaaaaaa"},{"_id":2,"k":"bbbbbbbbbb"},{"_id":3}]`),
+	}
+	db := testServer.session.DB("limits")
+	defer db.DropDatabase()
+	if err := createPageDatabase(db, p, true, defaultLimits); err != nil {
+		t.Fatalf("fail to create database: %v", err)
+	}
+
+	runLimitsTests := []struct {
+		name   string
+		limits runLimits
+		query  string
+		result string
+		err    string
+	}{
+		{
+			name:   "within limits",
+			limits: defaultLimits,
+			query:  `db.collection.find({"_id":1})`,
+			result: `[{"_id":1,"k":"aaaaaaaaaa"}]`,
+		},
+		{
+			name:   "too many documents",
+			limits: runLimits{timeout: time.Second, maxResultDocs: 2, maxResultBytes: 1 << 20},
+			query:  `db.collection.find()`,
+			err:    "query exceeded limit: result contains more than 2 documents",
+		},
+		{
+			name:   "too many documents with aggregate",
+			limits: runLimits{timeout: time.Second, maxResultDocs: 2, maxResultBytes: 1 << 20},
+			query:  `db.collection.aggregate([{"$project":{"k":0}}])`,
+			err:    "query exceeded limit: result contains more than 2 documents",
+		},
+		{
+			name:   "limit within max number of documents",
+			limits: runLimits{timeout: time.Second, maxResultDocs: 2, maxResultBytes: 1 << 20},
+			query:  `db.collection.find().limit(2)`,
+			result: `[{"_id":1,"k":"aaaaaaaaaa"},{"_id":2,"k":"bbbbbbbbbb"}]`,
+		},
+		{
+			name:   "count is not limited by max number of documents",
+			limits: runLimits{timeout: time.Second, maxResultDocs: 2, maxResultBytes: 1 << 20},
+			query:  `db.collection.find().count()`,
+			result: "3",
+		},
+		{
+			name:   "result too large",
+			limits: runLimits{timeout: time.Second, maxResultDocs: 1000, maxResultBytes: 40},
+			query:  `db.collection.find()`,
+			err:    "query exceeded limit: result is larger than 40 bytes",
+		},
+	}
+
+	for _, tt := range runLimitsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := runScript(db, [][]byte{[]byte(tt.query)}, tt.limits)
+			if tt.err != "" {
+				if err == nil || tt.err != err.Error() {
+					t.Errorf("expected error\n'%s'\nbut got\n'%v'", tt.err, err)
+				}
+				if se, ok := err.(*statementError); !ok || statementErrorKind(se) != limitError {
+					t.Errorf("expected a limit error, but got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			if want, got := tt.result, string(res); want != got {
+				t.Errorf("expected %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestWriteLimits(t *testing.T) {
+
+	p := &page{
+		Mode:   bsonMode,
+		Config: []byte(`[{"_id":1},{"_id":2},{"_id":3}]`),
+	}
+
+	fourDocs := defaultLimits
+	fourDocs.maxDocs = 4
+
+	smallCollection := defaultLimits
+	smallCollection.maxCollectionBytes = 200
+
+	// $where is needed to make the write slow
+	shortTimeout := defaultLimits
+	shortTimeout.timeout = 50 * time.Millisecond
+	shortTimeout.allowedOperators = map[string]bool{"$where": true}
+
+	writeLimitsTests := []struct {
+		name      string
+		limits    runLimits
+		query     string
+		result    string
+		err       string
+		statement int
+	}{
+		{
+			name:   "insert within max number of documents",
+			limits: fourDocs,
+			query:  `db.collection.insertOne({"_id":4})`,
+			result: `[{"_id":1},{"_id":2},{"_id":3},{"_id":4}]`,
+		},
+		{
+			name:      "insert more than max number of documents",
+			limits:    fourDocs,
+			query:     `db.collection.insertMany([{"_id":4},{"_id":5}])`,
+			err:       "query exceeded limit: max number of documents in a collection is 4, but was 5",
+			statement: 1,
+		},
+		{
+			name:      "script inserting more than max number of documents",
+			limits:    fourDocs,
+			query:     `db.collection.insertOne({"_id":4});db.collection.insertOne({"_id":5})`,
+			err:       "query exceeded limit: max number of documents in a collection is 4, but was 5",
+			statement: 2,
+		},
+		{
+			name:      "upsert more than max number of documents",
+			limits:    fourDocs,
+			query:     `db.collection.updateOne({"_id":4},{"$set":{"k":1}},{"upsert":true});db.collection.updateOne({"_id":5},{"$set":{"k":1}},{"upsert":true})`,
+			err:       "query exceeded limit: collection contains more than 4 documents",
+			statement: 2,
+		},
+		{
+			name:      "update larger than max size of a collection",
+			limits:    smallCollection,
+			query:     `db.collection.updateMany({},{"$set":{"k":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}})`,
+			err:       "query exceeded limit: collection is larger than 200 bytes",
+			statement: 1,
+		},
+		{
+			name:      "write running longer than max time",
+			limits:    shortTimeout,
+			query:     `db.collection.updateMany({"$where":"sleep(100) || true"},{"$set":{"k":1}})`,
+			err:       "query exceeded limit: execution took more than 50ms",
+			statement: 1,
+		},
+	}
+
+	for _, tt := range writeLimitsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// writes are run against a temporary database, like in run()
+			db := testServer.session.DB("writeLimits")
+			defer db.DropDatabase()
+			if err := createPageDatabase(db, p, false, defaultLimits); err != nil {
+				t.Fatalf("fail to create database: %v", err)
+			}
+			statements := splitScript([]byte(tt.query))
+
+			res, err := runScript(db, statements, tt.limits)
+			if tt.err != "" {
+				if err == nil || tt.err != err.Error() {
+					t.Errorf("expected error\n'%s'\nbut got\n'%v'", tt.err, err)
+				}
+				se, ok := err.(*statementError)
+				if !ok || statementErrorKind(se) != limitError {
+					t.Fatalf("expected a limit error, but got %T", err)
+				}
+				if tt.statement != se.statement {
+					t.Errorf("expected error in statement %d, but got %d", tt.statement, se.statement)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			if want, got := tt.result, string(res); want != got {
+				t.Errorf("expected %s but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestQueryLimitsTimeout(t *testing.T) {
+
+	t.Parallel()
+
+	err := defaultLimits.check(&mgo.QueryError{Code: maxTimeMSExpired, Message: "operation exceeded time limit"})
+	if want, got := "query exceeded limit: execution took more than 5s", err.Error(); want != got {
+		t.Errorf("expected error %s but got %s", want, got)
+	}
+
+	other := &mgo.QueryError{Code: 2, Message: "bad value"}
+	if err := defaultLimits.check(other); err != other {
+		t.Errorf("expected error %v to be returned as is, but got %v", other, err)
+	}
+}
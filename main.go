@@ -1,16 +1,112 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// values of a flag that can be set several times
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, " ") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
 func main() {
+	// run and save are subcommands of the command line client
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	l := log.New(os.Stdout, "", log.LstdFlags)
-	s, err := newServer(l)
+
+	c, err := loadConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		l.Fatalf("aborting: %v\n", err)
+	}
+	// listen first, so that the storage is not left open if the port
+	// is already in use
+	public, err := net.Listen("tcp", fmt.Sprintf(":%d", c.port))
 	if err != nil {
 		l.Fatalf("aborting: %v\n", err)
 	}
-	l.Fatal(http.ListenAndServe(":80", s))
+	var admin net.Listener
+	if c.adminAddr != "" {
+		admin, err = net.Listen("tcp", c.adminAddr)
+		if err != nil {
+			l.Fatalf("aborting: %v\n", err)
+		}
+	}
+	store, err := newStore(c)
+	if err != nil {
+		l.Fatalf("aborting: %v\n", err)
+	}
+	s, err := newServer(l, store, c)
+	if err != nil {
+		l.Fatalf("aborting: %v\n", err)
+	}
+
+	listeners := []listener{{Listener: public, handler: s}}
+	if admin != nil {
+		listeners = append(listeners, listener{Listener: admin, handler: s.adminHandler()})
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+	err = serve(listeners, s, stop, c.shutdownTimeout, l)
+	if err != nil {
+		l.Fatalf("aborting: %v\n", err)
+	}
+}
+
+// a listener and the handler of the requests it accepts
+type listener struct {
+	net.Listener
+	handler http.Handler
+}
+
+// serve http requests until a signal is received on stop, or until one of
+// the listeners fails. Running requests are then given at most timeout to
+// complete before s is closed
+func serve(listeners []listener, s *server, stop <-chan os.Signal, timeout time.Duration, l *log.Logger) error {
+
+	errs := make(chan error, len(listeners))
+	httpServers := make([]*http.Server, 0, len(listeners))
+	for _, ln := range listeners {
+		httpServer := &http.Server{Handler: ln.handler}
+		httpServers = append(httpServers, httpServer)
+		go func(ln net.Listener) {
+			errs <- httpServer.Serve(ln)
+		}(ln)
+	}
+
+	var err error
+	select {
+	case err = <-errs:
+	case sig := <-stop:
+		l.Printf("received %v, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, httpServer := range httpServers {
+		if e := httpServer.Shutdown(ctx); e != nil {
+			l.Printf("fail to wait for running requests: %v", e)
+		}
+	}
+	if e := s.Close(); err == nil {
+		err = e
+	}
+	return err
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "activeDB.json")
+
+	s := &server{
+		logger:      log.New(ioutil.Discard, "", 0),
+		storage:     newMemoryStore(),
+		metrics:     newMetrics(),
+		config:      &config{activeDBFile: file},
+		stopCleanup: make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+	}
+	go s.cleanupLoop(time.Hour)
+	s.activeDB.Store("a6f3fa2e5b1e56fb2b4dee0f4ec5e7a7", int64(1500000000))
+
+	stop := make(chan os.Signal, 1)
+	stop <- syscall.SIGTERM
+
+	listeners := []listener{
+		{Listener: testListener(t), handler: s},
+		{Listener: testListener(t), handler: s.adminHandler()},
+	}
+	if err := serve(listeners, s, stop, time.Second, s.logger); err != nil {
+		t.Errorf("expected a clean shutdown, but got %v", err)
+	}
+
+	select {
+	case <-s.cleanupDone:
+	default:
+		t.Errorf("cleanup loop should be stopped")
+	}
+	active, err := loadActiveDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := active["a6f3fa2e5b1e56fb2b4dee0f4ec5e7a7"]; !ok {
+		t.Errorf("active databases should be saved on shutdown, but got %v", active)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("closing the server twice should be a no-op, but got %v", err)
+	}
+}
+
+// a request running when the server is stopped should complete before
+// the storage and the sessions are closed
+func TestServeRunningRequest(t *testing.T) {
+
+	t.Parallel()
+
+	storage := &closeRecorder{PageStore: newMemoryStore()}
+	s := &server{
+		logger:      log.New(ioutil.Discard, "", 0),
+		storage:     storage,
+		metrics:     newMetrics(),
+		config:      &config{},
+		stopCleanup: make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+	}
+	go s.cleanupLoop(time.Hour)
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// leave time to the shutdown to close the server too early
+		time.Sleep(100 * time.Millisecond)
+		if storage.isClosed() {
+			t.Errorf("storage should not be closed while a request is running")
+		}
+		select {
+		case <-s.stopCleanup:
+			t.Errorf("server should not be closed while a request is running")
+		default:
+		}
+		w.Write([]byte("done"))
+	})
+
+	ln := testListener(t)
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve([]listener{{Listener: ln, handler: handler}}, s, stop, 5*time.Second, s.logger)
+	}()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/run")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+
+	<-started
+	stop <- syscall.SIGTERM
+
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, but got %v", err)
+	}
+	resp := <-responses
+	if resp.err != nil || resp.body != "done" {
+		t.Errorf("expected running request to complete, but got %q, %v", resp.body, resp.err)
+	}
+	if !storage.isClosed() {
+		t.Errorf("storage should be closed once the server is stopped")
+	}
+}
+
+func testListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("fail to listen: %v", err)
+	}
+	return ln
+}
+
+// a PageStore recording whether it was closed
+type closeRecorder struct {
+	PageStore
+	closed int32
+}
+
+func (c *closeRecorder) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.PageStore.Close()
+}
+
+func (c *closeRecorder) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
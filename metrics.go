@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upper bounds in seconds of the buckets of the run duration histogram
+var runDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// labels of the run duration histogram
+type runLabels struct {
+	mode   string
+	method string
+}
+
+type histogram struct {
+	// number of observations in each bucket, not cumulative. The last
+	// one is the +Inf bucket
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(runDurationBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// metrics of the server, exposed on /metrics in the prometheus
+// text format. Gauges like the number of active databases are
+// computed when metrics are scraped
+type metrics struct {
+	sync.Mutex
+	runDuration map[runLabels]*histogram
+	// number of failed runs by kind of error, see apiError
+	runErrors map[string]uint64
+	// number of requests rejected with a 429
+	throttled uint64
+	// number of databases dropped by removeExpiredDB
+	droppedDB uint64
+	// number of databases dropped by evictDB
+	evictedDB    uint64
+	staticHits   uint64
+	staticMisses uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		runDuration: map[runLabels]*histogram{},
+		runErrors:   map[string]uint64{},
+	}
+}
+
+func (m *metrics) observeRun(mode, method string, d time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+	labels := runLabels{mode: mode, method: method}
+	h, ok := m.runDuration[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(runDurationBuckets)+1)}
+		m.runDuration[labels] = h
+	}
+	h.observe(d.Seconds())
+	if err != nil {
+		m.runErrors[runErrorKind(err)]++
+	}
+}
+
+func (m *metrics) throttledRequest() {
+	m.Lock()
+	m.throttled++
+	m.Unlock()
+}
+
+func (m *metrics) droppedDatabase() {
+	m.Lock()
+	m.droppedDB++
+	m.Unlock()
+}
+
+func (m *metrics) evictedDatabase() {
+	m.Lock()
+	m.evictedDB++
+	m.Unlock()
+}
+
+func (m *metrics) staticRequest(hit bool) {
+	m.Lock()
+	if hit {
+		m.staticHits++
+	} else {
+		m.staticMisses++
+	}
+	m.Unlock()
+}
+
+// method label of a run: the method of the query, or "script" if the
+// query has several statements. Unknown methods are reported as "invalid"
+// to keep the number of series bounded
+func runMethod(statements [][]byte) string {
+	if len(statements) > 1 {
+		return "script"
+	}
+	q, err := parseQuery(statements[0])
+	if err != nil {
+		return "invalid"
+	}
+	method := q.method()
+	if method != "find" && method != "aggregate" && method != "explain" && !writeMethods[method] {
+		return "invalid"
+	}
+	return method
+}
+
+// expose the metrics in the prometheus text format
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+
+	var buf bytes.Buffer
+	s.metrics.write(&buf)
+
+	activeDB := 0
+	s.activeDB.Range(func(k, v interface{}) bool {
+		activeDB++
+		return true
+	})
+	writeMetric(&buf, "mongoplayground_active_databases", "gauge", "Number of databases created for playgrounds and not dropped yet.", float64(activeDB))
+
+	stats, err := s.storage.Stats()
+	if err != nil {
+		s.logger.Printf("fail to get stats of storage: %v", err)
+	} else {
+		writeMetric(&buf, "mongoplayground_storage_size_bytes", "gauge", "Size of the storage of saved playgrounds.", float64(stats.Bytes))
+		writeMetric(&buf, "mongoplayground_saved_pages", "gauge", "Number of saved playgrounds.", float64(stats.Pages))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (m *metrics) write(buf *bytes.Buffer) {
+
+	m.Lock()
+	defer m.Unlock()
+
+	name := "mongoplayground_run_duration_seconds"
+	writeHeader(buf, name, "histogram", "Duration of runs, by mode and method of the query.")
+	labels := make([]runLabels, 0, len(m.runDuration))
+	for l := range m.runDuration {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].mode != labels[j].mode {
+			return labels[i].mode < labels[j].mode
+		}
+		return labels[i].method < labels[j].method
+	})
+	for _, l := range labels {
+		h := m.runDuration[l]
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(runDurationBuckets) {
+				le = formatValue(runDurationBuckets[i])
+			}
+			fmt.Fprintf(buf, "%s_bucket{mode=%q,method=%q,le=%q} %d\n", name, l.mode, l.method, le, cumulative)
+		}
+		fmt.Fprintf(buf, "%s_sum{mode=%q,method=%q} %s\n", name, l.mode, l.method, formatValue(h.sum))
+		fmt.Fprintf(buf, "%s_count{mode=%q,method=%q} %d\n", name, l.mode, l.method, h.count)
+	}
+
+	name = "mongoplayground_run_errors_total"
+	writeHeader(buf, name, "counter", "Number of failed runs, by kind of error.")
+	kinds := make([]string, 0, len(m.runErrors))
+	for kind := range m.runErrors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(buf, "%s{kind=%q} %d\n", name, kind, m.runErrors[kind])
+	}
+
+	writeMetric(buf, "mongoplayground_throttled_requests_total", "counter", "Number of requests rejected because of rate limiting or too many database creations.", float64(m.throttled))
+	writeMetric(buf, "mongoplayground_dropped_databases_total", "counter", "Number of expired databases dropped.", float64(m.droppedDB))
+	writeMetric(buf, "mongoplayground_evicted_databases_total", "counter", "Number of least recently used databases dropped because of too many or too large databases.", float64(m.evictedDB))
+	writeMetric(buf, "mongoplayground_static_cache_hits_total", "counter", "Number of static resources served from the cache.", float64(m.staticHits))
+	writeMetric(buf, "mongoplayground_static_cache_misses_total", "counter", "Number of requests for unknown static resources.", float64(m.staticMisses))
+}
+
+func writeHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// write a metric without labels
+func writeMetric(buf *bytes.Buffer, name, kind, help string, value float64) {
+	writeHeader(buf, name, kind, help)
+	fmt.Fprintf(buf, "%s %s\n", name, formatValue(value))
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		logger:  log.New(ioutil.Discard, "", 0),
+		storage: newMemoryStore(),
+		metrics: newMetrics(),
+	}
+	s.storage.Put([]byte("id"), []byte("page"))
+	s.activeDB.Store("db", time.Now().Unix())
+
+	s.metrics.observeRun("bson", "find", 20*time.Millisecond, nil)
+	s.metrics.observeRun("bson", "find", 3*time.Second, &statementError{statement: 1, err: errors.New("query failed")})
+	s.metrics.observeRun("mgodatagen", "script", time.Millisecond, &invalidConfigError{err: errors.New("error in configuration")})
+	s.metrics.throttledRequest()
+	s.metrics.droppedDatabase()
+	s.metrics.evictedDatabase()
+	s.metrics.staticRequest(true)
+	s.metrics.staticRequest(true)
+	s.metrics.staticRequest(false)
+
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	resp := httptest.NewRecorder()
+	s.metricsHandler(resp, req)
+
+	want := `# HELP mongoplayground_run_duration_seconds Duration of runs, by mode and method of the query.
+# TYPE mongoplayground_run_duration_seconds histogram
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="0.005"} 0
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="0.01"} 0
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="0.025"} 1
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="0.05"} 1
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="0.1"} 1
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="0.25"} 1
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="0.5"} 1
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="1"} 1
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="2.5"} 1
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="5"} 2
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="10"} 2
+mongoplayground_run_duration_seconds_bucket{mode="bson",method="find",le="+Inf"} 2
+mongoplayground_run_duration_seconds_sum{mode="bson",method="find"} 3.02
+mongoplayground_run_duration_seconds_count{mode="bson",method="find"} 2
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="0.005"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="0.01"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="0.025"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="0.05"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="0.1"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="0.25"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="0.5"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="1"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="2.5"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="5"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="10"} 1
+mongoplayground_run_duration_seconds_bucket{mode="mgodatagen",method="script",le="+Inf"} 1
+mongoplayground_run_duration_seconds_sum{mode="mgodatagen",method="script"} 0.001
+mongoplayground_run_duration_seconds_count{mode="mgodatagen",method="script"} 1
+# HELP mongoplayground_run_errors_total Number of failed runs, by kind of error.
+# TYPE mongoplayground_run_errors_total counter
+mongoplayground_run_errors_total{kind="config"} 1
+mongoplayground_run_errors_total{kind="query"} 1
+# HELP mongoplayground_throttled_requests_total Number of requests rejected because of rate limiting or too many database creations.
+# TYPE mongoplayground_throttled_requests_total counter
+mongoplayground_throttled_requests_total 1
+# HELP mongoplayground_dropped_databases_total Number of expired databases dropped.
+# TYPE mongoplayground_dropped_databases_total counter
+mongoplayground_dropped_databases_total 1
+# HELP mongoplayground_evicted_databases_total Number of least recently used databases dropped because of too many or too large databases.
+# TYPE mongoplayground_evicted_databases_total counter
+mongoplayground_evicted_databases_total 1
+# HELP mongoplayground_static_cache_hits_total Number of static resources served from the cache.
+# TYPE mongoplayground_static_cache_hits_total counter
+mongoplayground_static_cache_hits_total 2
+# HELP mongoplayground_static_cache_misses_total Number of requests for unknown static resources.
+# TYPE mongoplayground_static_cache_misses_total counter
+mongoplayground_static_cache_misses_total 1
+# HELP mongoplayground_active_databases Number of databases created for playgrounds and not dropped yet.
+# TYPE mongoplayground_active_databases gauge
+mongoplayground_active_databases 1
+# HELP mongoplayground_storage_size_bytes Size of the storage of saved playgrounds.
+# TYPE mongoplayground_storage_size_bytes gauge
+mongoplayground_storage_size_bytes 6
+# HELP mongoplayground_saved_pages Number of saved playgrounds.
+# TYPE mongoplayground_saved_pages gauge
+mongoplayground_saved_pages 1
+`
+	if got := resp.Body.String(); want != got {
+		t.Errorf("expected metrics\n%s\nbut got\n%s", want, got)
+	}
+}
+
+func TestRunMethod(t *testing.T) {
+
+	t.Parallel()
+
+	runMethodTests := []struct {
+		query  string
+		method string
+	}{
+		{query: `db.collection.find()`, method: "find"},
+		{query: `db.collection.aggregate([])`, method: "aggregate"},
+		{query: `db.collection.updateOne({},{"$set":{"k":1}})`, method: "updateOne"},
+		{query: `db.collection.find();db.collection.find()`, method: "script"},
+		{query: `db.collection.unknownMethod()`, method: "invalid"},
+		{query: `find(`, method: "invalid"},
+	}
+
+	for _, tt := range runMethodTests {
+		if got := runMethod(splitScript([]byte(tt.query))); tt.method != got {
+			t.Errorf("%s: expected method %s, but got %s", tt.query, tt.method, got)
+		}
+	}
+}
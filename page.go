@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
@@ -13,6 +15,25 @@ const (
 	bsonMode
 )
 
+// a legacy page starts with the position of the end of its configuration
+// as an uint32, which can't be that large
+var encodingMarker = []byte{0xff, 0xff, 0xff, 0xff}
+
+const encodingV1 byte = 1
+
+// tags identifying the fields of an encoded page
+const (
+	tagMode byte = iota + 1
+	tagConfig
+	tagQuery
+	tagMongoVersion
+	tagCreatedAt
+	tagLastViewedAt
+	tagViews
+	tagRuns
+	tagSavedVersion
+)
+
 func modeByte(mode string) byte {
 	if mode == "bson" {
 		return bsonMode
@@ -20,14 +41,35 @@ func modeByte(mode string) byte {
 	return mgodatagenMode
 }
 
+func modeName(mode byte) string {
+	if mode == bsonMode {
+		return "bson"
+	}
+	return "mgodatagen"
+}
+
 type page struct {
 	Mode byte
 	// configuration used to generate the sample database
 	Config []byte
 	// query to run against the collection / database
 	Query []byte
-	// mongodb version
+	// mongodb version to run the query against. If empty,
+	// the default version is used
 	MongoVersion []byte
+
+	// metadata maintained by the server, not part of the ID of the page
+
+	// when the page was first saved, as a unix timestamp
+	CreatedAt int64
+	// when the page was last viewed, as a unix timestamp, or 0 if
+	// it was never viewed
+	LastViewedAt int64
+	// number of times the page was viewed and run
+	Views uint64
+	Runs  uint64
+	// version of mongodb the page was run against when it was saved
+	SavedVersion []byte
 }
 
 // generate an unique url for this page
@@ -36,6 +78,8 @@ func (p *page) ID() []byte {
 	e.Write([]byte{p.Mode})
 	e.Write(p.Query)
 	e.Write(p.Config)
+	// pages saved without a version keep their original ID
+	e.Write(p.MongoVersion)
 	sum := e.Sum(nil)
 	b := make([]byte, base64.URLEncoding.EncodedLen(len(sum)))
 	base64.URLEncoding.Encode(b, sum)
@@ -43,41 +87,152 @@ func (p *page) ID() []byte {
 }
 
 // generate an unique hash to identify the database used by the p page. Two pages with
-// same config and mode should generate the same dbHash
+// same config, mode and mongodb version should generate the same dbHash
 func (p *page) dbHash() string {
-	return fmt.Sprintf("%x", md5.Sum(append(p.Config, p.Mode)))
+	b := make([]byte, 0, len(p.Config)+1+len(p.MongoVersion))
+	b = append(b, p.Config...)
+	b = append(b, p.Mode)
+	b = append(b, p.MongoVersion...)
+	return fmt.Sprintf("%x", md5.Sum(b))
 }
 
 func (p *page) String() string {
-	mode := "bson"
-	if p.Mode != bsonMode {
-		mode = "mgodatagen"
-	}
-	return fmt.Sprintf("mode: %s\nconfig: %s\nquery: %s\n", mode, p.Config, p.Query)
+	return fmt.Sprintf("mode: %s\nconfig: %s\nquery: %s\nmongodb version: %s\n", modeName(p.Mode), p.Config, p.Query, p.MongoVersion)
 }
 
 // encode a page into a byte slice
 //
-// v[0:4] -> an int32 to store the position of the last byte of the configuration
-// v[4] -> the mode (mgodatagen / bson) to use for building the database
-// v[5:endConfig] -> the configuration
-// v[endConfig:] -> the query
+// v[0:4] -> encodingMarker, so the value can't be mistaken for a legacy one
+// v[4] -> the version of the encoding
+// v[5:] -> the fields of the page
+//
+// each field is stored as
+//
+// tag -> one byte identifying the field
+// n -> the length of the field as an uvarint
+// value -> n bytes holding the field
+//
+// fields with an empty value are omitted, and unknown tags are skipped
+// when decoding, so fields can be added without a new encoding version
 func (p *page) encode() []byte {
-	v := make([]byte, 5+len(p.Config)+len(p.Query))
-
-	endConfig := len(p.Config) + 5
-	binary.LittleEndian.PutUint32(v[0:4], uint32(endConfig))
 
-	v[4] = p.Mode
-	copy(v[5:endConfig], p.Config)
-	copy(v[endConfig:], p.Query)
+	// each field needs at most 1+binary.MaxVarintLen64 bytes in addition to its value,
+	// and numbers are stored as uvarints
+	size := len(encodingMarker) + 1 + 9*(1+binary.MaxVarintLen64) + 1 + len(p.Config) + len(p.Query) + len(p.MongoVersion) +
+		4*binary.MaxVarintLen64 + len(p.SavedVersion)
+	v := make([]byte, 0, size)
+	v = append(v, encodingMarker...)
+	v = append(v, encodingV1)
+	v = appendField(v, tagMode, []byte{p.Mode})
+	v = appendField(v, tagConfig, p.Config)
+	v = appendField(v, tagQuery, p.Query)
+	v = appendField(v, tagMongoVersion, p.MongoVersion)
+	v = appendUint(v, tagCreatedAt, uint64(p.CreatedAt))
+	v = appendUint(v, tagLastViewedAt, uint64(p.LastViewedAt))
+	v = appendUint(v, tagViews, p.Views)
+	v = appendUint(v, tagRuns, p.Runs)
+	v = appendField(v, tagSavedVersion, p.SavedVersion)
 	return v
 }
 
-// decode a slice of byte into the p page
-func (p *page) decode(v []byte) {
+// append a numeric field, omitted if n is 0
+func appendUint(v []byte, tag byte, n uint64) []byte {
+	if n == 0 {
+		return v
+	}
+	var b [binary.MaxVarintLen64]byte
+	return appendField(v, tag, b[:binary.PutUvarint(b[:], n)])
+}
+
+func appendField(v []byte, tag byte, value []byte) []byte {
+	if len(value) == 0 {
+		return v
+	}
+	var n [binary.MaxVarintLen64]byte
+	v = append(v, tag)
+	v = append(v, n[:binary.PutUvarint(n[:], uint64(len(value)))]...)
+	return append(v, value...)
+}
+
+// decode a slice of byte into the p page. Pages encoded before the
+// encoding was versioned are also supported
+func (p *page) decode(v []byte) error {
+
+	if !bytes.HasPrefix(v, encodingMarker) {
+		return p.decodeLegacy(v)
+	}
+	if len(v) == len(encodingMarker) || v[len(encodingMarker)] != encodingV1 {
+		return errors.New("invalid page: unknown encoding version")
+	}
+
+	v = v[len(encodingMarker)+1:]
+	for len(v) > 0 {
+		tag := v[0]
+		n, size := binary.Uvarint(v[1:])
+		if size <= 0 || n > uint64(len(v)-1-size) {
+			return fmt.Errorf("invalid page: field %d is truncated", tag)
+		}
+		value := v[1+size : 1+size+int(n)]
+		v = v[1+size+int(n):]
+
+		switch tag {
+		case tagMode:
+			if len(value) != 1 {
+				return fmt.Errorf("invalid page: mode should be a single byte, but was %d bytes long", len(value))
+			}
+			p.Mode = value[0]
+		case tagConfig:
+			p.Config = value
+		case tagQuery:
+			p.Query = value
+		case tagMongoVersion:
+			p.MongoVersion = value
+		case tagSavedVersion:
+			p.SavedVersion = value
+		case tagCreatedAt, tagLastViewedAt, tagViews, tagRuns:
+			n, size := binary.Uvarint(value)
+			if size != len(value) {
+				return fmt.Errorf("invalid page: field %d is not a valid number", tag)
+			}
+			switch tag {
+			case tagCreatedAt:
+				p.CreatedAt = int64(n)
+			case tagLastViewedAt:
+				p.LastViewedAt = int64(n)
+			case tagViews:
+				p.Views = n
+			case tagRuns:
+				p.Runs = n
+			}
+		}
+	}
+	return p.checkMode()
+}
+
+// decode a page using the legacy layout:
+//
+// v[0:4] -> an int32 to store the position of the last byte of the configuration
+// v[4] -> the mode (mgodatagen / bson) to use for building the database
+// v[5:endConfig] -> the configuration
+// v[endConfig:] -> the query
+func (p *page) decodeLegacy(v []byte) error {
+
+	if len(v) < 5 {
+		return fmt.Errorf("invalid page: expected at least 5 bytes, but got %d", len(v))
+	}
 	endConfig := binary.LittleEndian.Uint32(v[0:4])
 	p.Mode = v[4]
+	if endConfig < 5 || endConfig > uint32(len(v)) {
+		return fmt.Errorf("invalid page: end of configuration out of range: %d", endConfig)
+	}
 	p.Config = v[5:endConfig]
 	p.Query = v[endConfig:]
+	return p.checkMode()
+}
+
+func (p *page) checkMode() error {
+	if p.Mode != mgodatagenMode && p.Mode != bsonMode {
+		return fmt.Errorf("invalid page: unknown mode %d", p.Mode)
+	}
+	return nil
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPageEncoding(t *testing.T) {
+
+	t.Parallel()
+
+	pages := []struct {
+		name string
+		page page
+	}{
+		{
+			name: "bson mode",
+			page: page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery)},
+		},
+		{
+			name: "mgodatagen mode",
+			page: page{Mode: mgodatagenMode, Config: []byte(templateConfig), Query: []byte(templateQuery)},
+		},
+		{
+			name: "with mongodb version",
+			page: page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery), MongoVersion: []byte("4.0.10")},
+		},
+		{
+			name: "with metadata",
+			page: page{
+				Mode:         bsonMode,
+				Config:       []byte(`[{"_id":1}]`),
+				Query:        []byte(templateQuery),
+				CreatedAt:    1588586400,
+				LastViewedAt: 1588590000,
+				Views:        300,
+				Runs:         2,
+				SavedVersion: []byte("4.0.10"),
+			},
+		},
+		{
+			name: "empty page",
+			page: page{},
+		},
+	}
+
+	for _, tt := range pages {
+		t.Run(tt.name, func(t *testing.T) {
+			var p page
+			err := p.decode(tt.page.encode())
+			if err != nil {
+				t.Errorf("fail to decode page: %v", err)
+			}
+			if !pageEqual(&tt.page, &p) {
+				t.Errorf("expected page\n%v\nbut got\n%v", tt.page.String(), p.String())
+			}
+		})
+	}
+}
+
+func TestPageDecodeLegacy(t *testing.T) {
+
+	t.Parallel()
+
+	legacyTests := []struct {
+		name  string
+		value []byte
+		page  page
+	}{
+		{
+			name:  "legacy layout",
+			value: []byte("\x09\x00\x00\x00\x01[{}]db.c.find()"),
+			page:  page{Mode: bsonMode, Config: []byte("[{}]"), Query: []byte("db.c.find()")},
+		},
+		{
+			name:  "legacy layout with empty query",
+			value: []byte("\x09\x00\x00\x00\x00[{}]"),
+			page:  page{Mode: mgodatagenMode, Config: []byte("[{}]")},
+		},
+	}
+
+	for _, tt := range legacyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p page
+			err := p.decode(tt.value)
+			if err != nil {
+				t.Errorf("fail to decode page: %v", err)
+			}
+			if !pageEqual(&tt.page, &p) {
+				t.Errorf("expected page\n%v\nbut got\n%v", tt.page.String(), p.String())
+			}
+		})
+	}
+}
+
+func TestPageDecodeMalformed(t *testing.T) {
+
+	t.Parallel()
+
+	malformedTests := []struct {
+		name  string
+		value []byte
+		err   string
+	}{
+		{
+			name:  "empty value",
+			value: nil,
+			err:   "invalid page: expected at least 5 bytes, but got 0",
+		},
+		{
+			name:  "legacy end of configuration too large",
+			value: []byte("\xff\x00\x00\x00\x01[{}]"),
+			err:   "invalid page: end of configuration out of range: 255",
+		},
+		{
+			name:  "legacy end of configuration too small",
+			value: []byte("\x02\x00\x00\x00\x01[{}]"),
+			err:   "invalid page: end of configuration out of range: 2",
+		},
+		{
+			name:  "legacy unknown mode",
+			value: []byte("\x09\x00\x00\x00\x03[{}]"),
+			err:   "invalid page: unknown mode 3",
+		},
+		{
+			name:  "unknown encoding version",
+			value: []byte("\xff\xff\xff\xff\x09"),
+			err:   "invalid page: unknown encoding version",
+		},
+		{
+			name:  "missing encoding version",
+			value: []byte("\xff\xff\xff\xff"),
+			err:   "invalid page: unknown encoding version",
+		},
+		{
+			name:  "truncated field",
+			value: []byte("\xff\xff\xff\xff\x01\x02\x10[{}]"),
+			err:   "invalid page: field 2 is truncated",
+		},
+		{
+			name:  "missing field length",
+			value: []byte("\xff\xff\xff\xff\x01\x02"),
+			err:   "invalid page: field 2 is truncated",
+		},
+		{
+			name:  "invalid number",
+			value: []byte("\xff\xff\xff\xff\x01\x07\x02\xff\xff"),
+			err:   "invalid page: field 7 is not a valid number",
+		},
+		{
+			name:  "invalid mode",
+			value: []byte("\xff\xff\xff\xff\x01\x01\x02\x00\x01"),
+			err:   "invalid page: mode should be a single byte, but was 2 bytes long",
+		},
+	}
+
+	for _, tt := range malformedTests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p page
+			err := p.decode(tt.value)
+			if err == nil {
+				t.Fatalf("expected error %s, but got none", tt.err)
+			}
+			if want, got := tt.err, err.Error(); want != got {
+				t.Errorf("expected error %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+func pageEqual(a, b *page) bool {
+	return a.Mode == b.Mode &&
+		bytes.Equal(a.Config, b.Config) &&
+		bytes.Equal(a.Query, b.Query) &&
+		bytes.Equal(a.MongoVersion, b.MongoVersion) &&
+		a.CreatedAt == b.CreatedAt &&
+		a.LastViewedAt == b.LastViewedAt &&
+		a.Views == b.Views &&
+		a.Runs == b.Runs &&
+		bytes.Equal(a.SavedVersion, b.SavedVersion)
+}
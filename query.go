@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// a method call in a query, for example find({k: 1}) or limit(2)
+type call struct {
+	method string
+	// content of the parenthesis
+	args []byte
+}
+
+// a query written in mongo shell syntax, for example
+//
+//	db.collection.find({k: 1}).sort({k: -1}).limit(2)
+//
+// calls[0] is the method called on the collection, following calls
+// are the cursor modifiers chained after it
+type query struct {
+	collection string
+	calls      []call
+}
+
+func (q *query) method() string {
+	return q.calls[0].method
+}
+
+// error returned when a query, or the arguments of one of its
+// calls, can't be parsed
+type queryParseError struct {
+	msg string
+}
+
+func (e *queryParseError) Error() string {
+	return e.msg
+}
+
+// the query doesn't match the expected format
+var errInvalidQuery = &queryParseError{msg: invalidQuery}
+
+func parseErrorf(format string, a ...interface{}) error {
+	return &queryParseError{msg: "fail to parse content of query: " + fmt.Sprintf(format, a...)}
+}
+
+// the method called in the query is not supported
+func invalidMethod(method string) error {
+	return &queryParseError{msg: "query failed: invalid method: " + method}
+}
+
+// parse a query like db.coll.find({k:1}).sort({k:1}) into the collection
+// name and the chain of method calls
+func parseQuery(b []byte) (*query, error) {
+
+	b = bytes.TrimSuffix(bytes.TrimSpace(b), []byte{';'})
+
+	// query should look like
+	// db.(\w*).(method)(...).(method)(...)...
+	p := bytes.SplitN(b, []byte{'.'}, 3)
+	if len(p) != 3 {
+		return nil, errInvalidQuery
+	}
+
+	q := &query{
+		collection: string(p[1]),
+	}
+
+	rest := p[2]
+	for {
+		start := bytes.IndexByte(rest, '(')
+		if start == -1 {
+			return nil, errInvalidQuery
+		}
+		end := closing(rest, start, '(', ')')
+		if end == -1 {
+			return nil, errInvalidQuery
+		}
+		q.calls = append(q.calls, call{
+			method: string(bytes.TrimSpace(rest[:start])),
+			args:   bytes.TrimSpace(rest[start+1 : end]),
+		})
+
+		rest = bytes.TrimSpace(rest[end+1:])
+		if len(rest) == 0 {
+			return q, nil
+		}
+		if rest[0] != '.' {
+			return nil, errInvalidQuery
+		}
+		rest = rest[1:]
+	}
+}
+
+// split a script into its statements. Statements are separated by ';' or
+// by a new line, unless the next line starts with a chained call like .sort()
+func splitScript(b []byte) [][]byte {
+
+	var statements [][]byte
+	depth, start := 0, 0
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case '(', '{', '[':
+			depth++
+		case ')', '}', ']':
+			depth--
+		case '"', '\'':
+			i = endOfString(b, i)
+		case '/':
+			i = endOfRegex(b, i)
+		case ';', '\n':
+			if depth != 0 {
+				continue
+			}
+			if b[i] == '\n' && bytes.HasPrefix(bytes.TrimSpace(b[i:]), []byte{'.'}) {
+				continue
+			}
+			if st := bytes.TrimSpace(b[start:i]); len(st) > 0 {
+				statements = append(statements, st)
+			}
+			start = i + 1
+		}
+	}
+	if start < len(b) {
+		if st := bytes.TrimSpace(b[start:]); len(st) > 0 {
+			statements = append(statements, st)
+		}
+	}
+	// let runQuery report an invalid query
+	if len(statements) == 0 {
+		return [][]byte{b}
+	}
+	return statements
+}
+
+// return the position of the close char matching the open char at b[start],
+// for example the parenthesis closing the one at b[start], or -1 if it's not
+// closed. Characters in strings are ignored
+func closing(b []byte, start int, open, close byte) int {
+	depth := 0
+	for i := start; i < len(b); i++ {
+		switch b[i] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case '"', '\'':
+			i = endOfString(b, i)
+		case '/':
+			i = endOfRegex(b, i)
+		}
+	}
+	return -1
+}
+
+// return the position of the quote closing the string starting at b[start]
+func endOfString(b []byte, start int) int {
+	for i := start + 1; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case b[start]:
+			return i
+		}
+	}
+	return len(b)
+}
+
+// return the position of the slash closing the regular expression
+// starting at b[start], like /pattern/. A slash in a character class
+// doesn't close the regular expression
+func endOfRegex(b []byte, start int) int {
+	inClass := false
+	for i := start + 1; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				return i
+			}
+		}
+	}
+	return len(b)
+}
+
+// apply the cursor modifiers chained after find() to the query. If count() is
+// part of the chain, the number of documents should be returned instead of
+// the documents
+func applyModifiers(q *mgo.Query, modifiers []call) (count bool, err error) {
+
+	for i, m := range modifiers {
+
+		if count {
+			return false, invalidMethod(m.method)
+		}
+
+		switch m.method {
+		case "sort":
+			fields, err := indexKey(m.args)
+			if err != nil {
+				return false, parseErrorf("invalid sort: %v", err)
+			}
+			q.Sort(fields...)
+		case "limit", "skip":
+			var n int
+			if err := bson.UnmarshalJSON(m.args, &n); err != nil {
+				return false, parseErrorf("invalid %s: %v", m.method, err)
+			}
+			if m.method == "limit" {
+				q.Limit(n)
+			} else {
+				q.Skip(n)
+			}
+		case "count":
+			// like in the mongo shell, count() ignores skip and limit unless
+			// it's called with true
+			if !bytes.Equal(m.args, []byte("true")) {
+				q.Skip(0).Limit(0)
+			}
+			count = true
+		case "hint":
+			fields, err := indexKey(m.args)
+			if err != nil {
+				return false, parseErrorf("invalid hint: %v", err)
+			}
+			q.Hint(fields...)
+		case "collation":
+			var collation mgo.Collation
+			if err := bson.UnmarshalJSON(m.args, &collation); err != nil {
+				return false, parseErrorf("invalid collation: %v", err)
+			}
+			q.Collation(&collation)
+		default:
+			if err := checkNoModifiers(modifiers[i:]); err != nil {
+				return false, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// make sure that the chain contains only methods without effect
+// on the result, like pretty()
+func checkNoModifiers(modifiers []call) error {
+	for _, m := range modifiers {
+		if m.method != "pretty" && m.method != "toArray" {
+			return invalidMethod(m.method)
+		}
+	}
+	return nil
+}
+
+// convert an index specification like {a: 1, b: -1} into the
+// list of keys expected by mgo, ie ["a", "-b"]. Order of keys
+// is preserved
+func indexKey(spec []byte) ([]string, error) {
+
+	var values bson.M
+	err := bson.UnmarshalJSON(spec, &values)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := orderedKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("specification can't be empty")
+	}
+
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		switch v := values[k].(type) {
+		case string:
+			// text, 2dsphere, hashed...
+			fields = append(fields, "$"+v+":"+k)
+		case map[string]interface{}:
+			if v["$meta"] != "textScore" {
+				return nil, fmt.Errorf("invalid value for key %s: %v", k, v)
+			}
+			fields = append(fields, "$textScore:"+k)
+		default:
+			n, ok := toFloat(v)
+			if !ok || n == 0 {
+				return nil, fmt.Errorf("invalid value for key %s: %v", k, v)
+			}
+			if n < 0 {
+				k = "-" + k
+			}
+			fields = append(fields, k)
+		}
+	}
+	return fields, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// return the keys of the top level document in b in the order
+// they are declared. Keys may be quoted or not
+func orderedKeys(b []byte) ([]string, error) {
+	keys, _, err := documentFields(b)
+	return keys, err
+}
+
+// return the keys of the top level document in b in the order they are
+// declared, along with the source of their value
+func documentFields(b []byte) (keys []string, values [][]byte, err error) {
+
+	b = bytes.TrimSpace(b)
+	if len(b) < 2 || b[0] != '{' || b[len(b)-1] != '}' {
+		return nil, nil, errors.New("not a document")
+	}
+
+	i := 1
+	for i < len(b)-1 {
+		c := b[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := endOfString(b, i)
+			keys = append(keys, string(b[i+1:end]))
+			i = end + 1
+		default:
+			end := bytes.IndexByte(b[i:], ':')
+			if end == -1 {
+				return nil, nil, errors.New("missing ':' after key")
+			}
+			keys = append(keys, string(bytes.TrimSpace(b[i:i+end])))
+			i += end
+		}
+		next := skipValue(b, i)
+		value := bytes.TrimPrefix(bytes.TrimSpace(b[i:next]), []byte{':'})
+		values = append(values, bytes.TrimSpace(bytes.TrimSuffix(value, []byte{','})))
+		i = next
+	}
+	return keys, values, nil
+}
+
+// return the source of the items of the top level array in b
+func arrayItems(b []byte) [][]byte {
+
+	b = bytes.TrimSpace(b)
+	if len(b) < 2 || b[0] != '[' || b[len(b)-1] != ']' {
+		return nil
+	}
+
+	var items [][]byte
+	i := 1
+	for i < len(b)-1 {
+		switch b[i] {
+		case ' ', '\t', '\n', '\r', ',':
+			i++
+			continue
+		}
+		next := skipValue(b, i)
+		items = append(items, bytes.TrimSpace(bytes.TrimSuffix(b[i:next], []byte{','})))
+		i = next
+	}
+	return items
+}
+
+// skip the ':' and the value following a key, and return the position
+// of the next key, or the position of the closing brace
+func skipValue(b []byte, start int) int {
+	depth := 0
+	for i := start; i < len(b); i++ {
+		switch b[i] {
+		case '{', '[', '(':
+			depth++
+		case '}', ']', ')':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				return i + 1
+			}
+		case '"', '\'':
+			i = endOfString(b, i)
+		case '/':
+			i = endOfRegex(b, i)
+		}
+	}
+	return len(b)
+}
+
+// parse the arguments of aggregate(), ie the pipeline and optionally
+// an options document, for example
+//
+//	[{"$match": {"k": 1}}], {"collation": {"locale": "fr"}}
+func pipeline(queryBytes []byte) (p []bson.M, opts bson.M, err error) {
+
+	// stages may also be passed without array, like
+	// {"$match": {"k": 1}}, {"$project": {"_id": 0}}
+	if len(queryBytes) == 0 || queryBytes[0] != '[' {
+		p, err = stages(queryBytes)
+		return p, nil, err
+	}
+
+	end := closing(queryBytes, 0, '[', ']')
+	if end == -1 {
+		end = len(queryBytes) - 1
+	}
+	err = bson.UnmarshalJSON(queryBytes[:end+1], &p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rest := bytes.TrimSpace(queryBytes[end+1:])
+	if len(rest) == 0 {
+		return p, nil, nil
+	}
+	if rest[0] != ',' {
+		return nil, nil, fmt.Errorf("invalid character '%c' after pipeline", rest[0])
+	}
+	err = bson.UnmarshalJSON(rest[1:], &opts)
+	return p, opts, err
+}
+
+// options accepted by aggregate()
+var aggregateOptions = map[string]bool{
+	"allowDiskUse": true,
+	"collation":    true,
+	"comment":      true,
+	"hint":         true,
+	"let":          true,
+}
+
+// run the pipeline against the collection, and return an iterator over its
+// result. When options are specified, the aggregate command is sent as is,
+// as mgo.Pipe doesn't support hint and let
+func aggregate(collection *mgo.Collection, stages []bson.M, opts bson.M, l runLimits) (*mgo.Iter, error) {
+
+	if len(opts) == 0 {
+		return collection.Pipe(stages).SetMaxTime(l.timeout).Iter(), nil
+	}
+
+	cmd, err := aggregateCommand(collection.Name, stages, opts)
+	if err != nil {
+		return nil, err
+	}
+	cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: l.maxTimeMS()})
+
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			ID         int64      `bson:"id"`
+		} `bson:"cursor"`
+	}
+	err = collection.Database.Run(cmd, &result)
+	return collection.NewIter(collection.Database.Session, result.Cursor.FirstBatch, result.Cursor.ID, err), nil
+}
+
+// build the aggregate command for the pipeline. Options are sorted by name
+func aggregateCommand(name string, stages []bson.M, opts bson.M) (bson.D, error) {
+
+	cmd := bson.D{
+		{Name: "aggregate", Value: name},
+		{Name: "pipeline", Value: stages},
+		{Name: "cursor", Value: bson.M{}},
+	}
+	names := make(sort.StringSlice, 0, len(opts))
+	for name := range opts {
+		if !aggregateOptions[name] {
+			return nil, fmt.Errorf("unknown option for aggregate: %s", name)
+		}
+		names = append(names, name)
+	}
+	names.Sort()
+	for _, name := range names {
+		cmd = append(cmd, bson.DocElem{Name: name, Value: opts[name]})
+	}
+	return cmd, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// result of a prune of the saved pages
+type pruneReport struct {
+	// number of pages checked
+	pages int
+	// number of pages deleted, or that would be deleted by a dry run
+	pruned int
+	// size in bytes of the pruned pages
+	bytes int64
+}
+
+func (r pruneReport) String() string {
+	return fmt.Sprintf("%d pages out of %d, %d bytes", r.pruned, r.pages, r.bytes)
+}
+
+// whether the page p was not viewed within retention. A page never viewed
+// expires retention after it was saved. Pages saved before their metadata
+// were recorded have no known age, and never expire
+func expiredPage(p *page, retention time.Duration, now time.Time) bool {
+	lastUse := p.LastViewedAt
+	if lastUse == 0 {
+		lastUse = p.CreatedAt
+	}
+	return lastUse != 0 && now.Sub(time.Unix(lastUse, 0)) > retention
+}
+
+// delete the pages of storage not viewed within retention, and reclaim the
+// space they used. If dryRun is true, expired pages are only counted. lock
+// is held while a page is deleted, and lastViewed, if set, returns the last
+// view of a page not written to storage yet, so that a page viewed in the
+// meantime is kept
+func prunePages(storage PageStore, retention time.Duration, now time.Time, dryRun bool, lock sync.Locker, lastViewed func(key []byte) int64) (pruneReport, error) {
+
+	var report pruneReport
+	var expired [][]byte
+	var sizes []int64
+	err := storage.Iterate(func(key, value []byte) error {
+		report.pages++
+		p := &page{}
+		// pages that can't be decoded are left untouched
+		if p.decode(value) != nil || !expiredPage(p, retention, now) {
+			return nil
+		}
+		report.pruned++
+		report.bytes += int64(len(key) + len(value))
+		expired = append(expired, append([]byte(nil), key...))
+		sizes = append(sizes, int64(len(key)+len(value)))
+		return nil
+	})
+	if err != nil || dryRun {
+		return report, err
+	}
+
+	for i, key := range expired {
+		deleted, err := deleteExpiredPage(storage, key, retention, now, lock, lastViewed)
+		if err != nil {
+			return report, fmt.Errorf("fail to delete page %s: %v", key, err)
+		}
+		if !deleted {
+			report.pruned--
+			report.bytes -= sizes[i]
+		}
+	}
+	return report, storage.Compact()
+}
+
+// delete the page stored under key if it is still expired
+func deleteExpiredPage(storage PageStore, key []byte, retention time.Duration, now time.Time, lock sync.Locker, lastViewed func(key []byte) int64) (bool, error) {
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	val, err := storage.Get(key)
+	if err == errPageNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	p := &page{}
+	if err := p.decode(val); err != nil {
+		return false, nil
+	}
+	if lastViewed != nil {
+		if viewedAt := lastViewed(key); viewedAt > p.LastViewedAt {
+			p.LastViewedAt = viewedAt
+		}
+	}
+	if !expiredPage(p, retention, now) {
+		return false, nil
+	}
+	return true, storage.Delete(key)
+}
+
+// delete the saved pages not viewed within config.pageRetention
+func (s *server) pruneStorage() {
+	report, err := prunePages(s.storage, s.config.pageRetention, time.Now(), false, &s.pageUpdates, s.counters.lastViewed)
+	if err != nil {
+		s.logger.Printf("fail to prune saved pages: %v", err)
+	}
+	s.logger.Printf("pruned %v not viewed within %v", report, s.config.pageRetention)
+}
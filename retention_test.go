@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pages of a storage to prune after 30 days
+var (
+	retentionNow  = time.Date(2020, time.May, 4, 10, 0, 0, 0, time.UTC)
+	retentionDays = 30 * 24 * time.Hour
+	daysAgo       = func(n int) int64 { return retentionNow.Add(-time.Duration(n) * 24 * time.Hour).Unix() }
+)
+
+func TestExpiredPage(t *testing.T) {
+
+	t.Parallel()
+
+	expiredTests := []struct {
+		name    string
+		page    page
+		expired bool
+	}{
+		{
+			name:    "recently viewed",
+			page:    page{CreatedAt: daysAgo(100), LastViewedAt: daysAgo(2)},
+			expired: false,
+		},
+		{
+			name:    "not viewed recently",
+			page:    page{CreatedAt: daysAgo(100), LastViewedAt: daysAgo(31)},
+			expired: true,
+		},
+		{
+			name:    "recently saved and never viewed",
+			page:    page{CreatedAt: daysAgo(10)},
+			expired: false,
+		},
+		{
+			name:    "never viewed",
+			page:    page{CreatedAt: daysAgo(31)},
+			expired: true,
+		},
+		{
+			name:    "saved without metadata",
+			page:    page{},
+			expired: false,
+		},
+	}
+
+	for _, tt := range expiredTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if want, got := tt.expired, expiredPage(&tt.page, retentionDays, retentionNow); want != got {
+				t.Errorf("expected expired to be %v, but got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestPrunePages(t *testing.T) {
+
+	t.Parallel()
+
+	pages := map[string]*page{
+		"recent":   {Mode: bsonMode, CreatedAt: daysAgo(100), LastViewedAt: daysAgo(2)},
+		"old":      {Mode: bsonMode, CreatedAt: daysAgo(100), LastViewedAt: daysAgo(40)},
+		"unviewed": {Mode: bsonMode, CreatedAt: daysAgo(40)},
+		"legacy":   {Mode: bsonMode},
+	}
+	storage := newMemoryStore()
+	for key, p := range pages {
+		storage.Put([]byte(key), p.encode())
+	}
+	storage.Put([]byte("invalid"), []byte("\xff\xff\xff\xff\x09"))
+
+	expiredBytes := int64(len("old") + len(pages["old"].encode()) + len("unviewed") + len(pages["unviewed"].encode()))
+
+	report, err := prunePages(storage, retentionDays, retentionNow, true, &sync.Mutex{}, nil)
+	if err != nil {
+		t.Fatalf("fail to prune pages: %v", err)
+	}
+	if want := (pruneReport{pages: 5, pruned: 2, bytes: expiredBytes}); want != report {
+		t.Errorf("expected dry run report %v, but got %v", want, report)
+	}
+	if want, got := 5, countPages(storage); want != got {
+		t.Errorf("a dry run should not delete pages, expected %d pages, but got %d", want, got)
+	}
+
+	report, err = prunePages(storage, retentionDays, retentionNow, false, &sync.Mutex{}, nil)
+	if err != nil {
+		t.Fatalf("fail to prune pages: %v", err)
+	}
+	if want := (pruneReport{pages: 5, pruned: 2, bytes: expiredBytes}); want != report {
+		t.Errorf("expected report %v, but got %v", want, report)
+	}
+	for _, key := range []string{"recent", "legacy", "invalid"} {
+		if _, err := storage.Get([]byte(key)); err != nil {
+			t.Errorf("page %s should be kept, but got %v", key, err)
+		}
+	}
+	for _, key := range []string{"old", "unviewed"} {
+		if _, err := storage.Get([]byte(key)); err != errPageNotFound {
+			t.Errorf("page %s should be pruned", key)
+		}
+	}
+}
+
+// a page viewed since the last flush of the counters is kept
+func TestPrunePendingView(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		logger:  log.New(ioutil.Discard, "", 0),
+		storage: newMemoryStore(),
+	}
+	for _, key := range []string{"viewed", "unviewed"} {
+		s.storage.Put([]byte(key), (&page{Mode: bsonMode, CreatedAt: daysAgo(40)}).encode())
+	}
+	s.counters.record([]byte("viewed"), func(n *pageCount) {
+		n.views++
+		n.lastViewedAt = daysAgo(1)
+	})
+
+	report, err := prunePages(s.storage, retentionDays, retentionNow, false, &s.pageUpdates, s.counters.lastViewed)
+	if err != nil {
+		t.Fatalf("fail to prune pages: %v", err)
+	}
+	if report.pruned != 1 {
+		t.Errorf("expected 1 pruned page, but got %v", report)
+	}
+	if _, err := s.storage.Get([]byte("viewed")); err != nil {
+		t.Errorf("page viewed since the last flush should be kept, but got %v", err)
+	}
+	if _, err := s.storage.Get([]byte("unviewed")); err != errPageNotFound {
+		t.Errorf("page not viewed should be pruned")
+	}
+}
+
+func countPages(storage PageStore) int {
+	count := 0
+	storage.Iterate(func(key, value []byte) error {
+		count++
+		return nil
+	})
+	return count
+}
@@ -3,18 +3,21 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/dgraph-io/badger"
 	"github.com/feliixx/mgodatagen/datagen"
 	"github.com/feliixx/mgodatagen/datagen/generators"
 	"github.com/globalsign/mgo"
@@ -25,58 +28,89 @@ var (
 	templates = template.Must(template.ParseFiles("playground.html"))
 )
 
-const (
-	staticDir = "static/"
-	badgerDir = "storage"
-	// interval between two database cleanup
-	cleanupInterval = 120 * time.Minute
-	// if a database is not used within the last
-	// expireInterval, it is removed in the next cleanup
-	expireInterval = 60 * time.Minute
-)
-
 type server struct {
+	// number of temporary databases created so far. Kept as first
+	// field to guarantee 64-bit alignment for atomic operations
+	tmpDBCount       uint64
 	mux              *http.ServeMux
 	session          *mgo.Session
-	storage          *badger.DB
+	storage          PageStore
 	logger           *log.Logger
 	activeDB         sync.Map
-	mongodbVersion   []byte
 	staticContentMap map[string]int
 	staticContent    [][]byte
+	// mongod instances to run queries against, one per version
+	// of mongodb. The first one is the default, and session is
+	// its session
+	backends    []backend
+	config      *config
+	rateLimiter *rateLimiter
+	// slots to create a database, at most config.traffic.maxDBCreations
+	// databases are created at the same time
+	dbCreations chan struct{}
+	metrics     *metrics
+	// data size in bytes of the databases in activeDB
+	dbSizes sync.Map
+	// held while databases are dropped, so that cleanup and
+	// eviction don't drop the same database twice
+	dropping sync.Mutex
+	// held while a database of activeDB is created, so that
+	// runs of the same configuration don't create it twice
+	creating dbLocks
+	// databases of activeDB being queried, which can't be dropped
+	// before their runs return
+	using dbUsers
+	// closed to stop the cleanup loop
+	stopCleanup chan struct{}
+	// closed once the cleanup loop returned
+	cleanupDone chan struct{}
+	closeOnce   sync.Once
+	// held while the metadata of a saved page is updated, so
+	// that concurrent updates are not lost
+	pageUpdates sync.Mutex
+	// views and runs not written to the storage yet
+	counters pageCounters
 }
 
-func newServer(logger *log.Logger) (*server, error) {
+// create a new server saving playgrounds in storage, configured by c. Queries
+// are run against the mongod instances listening on c.mongoURIs, or against the
+// local one if no uri is provided
+func newServer(logger *log.Logger, storage PageStore, c *config) (*server, error) {
 
-	session, err := mgo.Dial("mongodb://")
-	if err != nil {
-		return nil, fmt.Errorf("fail to connect to mongodb: %v", err)
+	mongoURIs := c.mongoURIs
+	if len(mongoURIs) == 0 {
+		mongoURIs = []string{"mongodb://"}
 	}
-	info, _ := session.BuildInfo()
-	version := []byte(info.Version)
-
-	opts := badger.DefaultOptions
-	opts.Dir = badgerDir
-	opts.ValueDir = badgerDir
-	db, err := badger.Open(opts)
+	backends, err := dialBackends(mongoURIs)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &server{
-		mux:            http.DefaultServeMux,
-		session:        session,
-		storage:        db,
-		activeDB:       sync.Map{},
-		logger:         logger,
-		mongodbVersion: version,
+		mux:      http.DefaultServeMux,
+		backends: backends,
+		session:  backends[0].session,
+		storage:  storage,
+		activeDB: sync.Map{},
+		logger:   logger,
+		config:   c,
+		// clients are identified by their IP
+		rateLimiter: newRateLimiter(c.traffic.requestsPerSecond, c.traffic.burst),
+		metrics:     newMetrics(),
+	}
+	if c.traffic.maxDBCreations > 0 {
+		s.dbCreations = make(chan struct{}, c.traffic.maxDBCreations)
 	}
 
-	go func(s *server) {
-		for range time.Tick(cleanupInterval) {
-			s.removeExpiredDB()
-		}
-	}(s)
+	// databases created before a restart are not tracked yet
+	err = s.reconcileDB()
+	if err != nil {
+		return nil, err
+	}
+
+	s.stopCleanup = make(chan struct{})
+	s.cleanupDone = make(chan struct{})
+	go s.cleanupLoop(c.cleanupInterval)
 
 	err = s.precompile()
 	if err != nil {
@@ -85,26 +119,122 @@ func newServer(logger *log.Logger) (*server, error) {
 
 	s.mux.HandleFunc("/", s.newPageHandler)
 	s.mux.HandleFunc("/p/", s.viewHandler)
-	s.mux.HandleFunc("/run", s.runHandler)
-	s.mux.HandleFunc("/save", s.saveHandler)
+	s.mux.HandleFunc("/run", s.rateLimited(s.runHandler))
+	s.mux.HandleFunc("/save", s.rateLimited(s.saveHandler))
 	s.mux.HandleFunc("/static/", s.staticHandler)
 	s.mux.HandleFunc("/_status/healthcheck", s.healthcheckHandler)
+	s.mux.HandleFunc("/api/v1/run", s.rateLimited(s.apiRunHandler))
+	s.mux.HandleFunc("/api/v1/save", s.rateLimited(s.apiSaveHandler))
+	s.mux.HandleFunc("/api/v1/p/", s.apiViewHandler)
 	return s, nil
 }
 
+// handler of the endpoints exposing the internal state of the server.
+// They are not authenticated, so they are served on a dedicated
+// listener that should not be exposed publicly
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/admin/databases", s.adminDatabasesHandler)
+	return mux
+}
+
+// periodically drop expired databases, forget idle clients, and delete
+// saved pages not viewed within config.pageRetention, until stopCleanup
+// is closed
+func (s *server) cleanupLoop(interval time.Duration) {
+	defer close(s.cleanupDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// a nil channel never receives, so pages are never pruned
+	// without a retention
+	var prune <-chan time.Time
+	if s.config.pageRetention > 0 {
+		pruneTicker := time.NewTicker(s.config.pruneInterval)
+		defer pruneTicker.Stop()
+		prune = pruneTicker.C
+	}
+	// clients are pruned more often than databases are dropped, as
+	// each IP seen since the last prune is tracked
+	var forget <-chan time.Time
+	if interval := s.rateLimiter.pruneInterval(); interval > 0 {
+		forgetTicker := time.NewTicker(interval)
+		defer forgetTicker.Stop()
+		forget = forgetTicker.C
+	}
+	// without an interval, views and runs are only written on close
+	var flush <-chan time.Time
+	if s.config.flushInterval > 0 {
+		flushTicker := time.NewTicker(s.config.flushInterval)
+		defer flushTicker.Stop()
+		flush = flushTicker.C
+	}
+	for {
+		select {
+		case <-ticker.C:
+			s.removeExpiredDB()
+			if err := s.saveActiveDB(); err != nil {
+				s.logger.Printf("%v", err)
+			}
+		case <-forget:
+			s.rateLimiter.prune(time.Now())
+		case <-flush:
+			s.flushCounters()
+		case <-prune:
+			// recent views are written first, so that the pages
+			// viewed since the last flush are kept
+			s.flushCounters()
+			s.pruneStorage()
+		case <-s.stopCleanup:
+			return
+		}
+	}
+}
+
+// stop the cleanup loop, waiting for a running cleanup to complete, save the
+// active databases, and close the storage and the sessions to mongodb. Running
+// requests should be drained first, as the server can't be used anymore
+func (s *server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stopCleanup)
+		<-s.cleanupDone
+
+		s.flushCounters()
+		if e := s.saveActiveDB(); e != nil {
+			err = e
+		}
+		// closing badger flushes its memtables to disk
+		if e := s.storage.Close(); e != nil && err == nil {
+			err = fmt.Errorf("fail to close storage: %v", e)
+		}
+		for _, b := range s.backends {
+			b.session.Close()
+		}
+	})
+	return err
+}
+
 // remove db not used within the last expireInterval
 func (s *server) removeExpiredDB() {
+
+	s.dropping.Lock()
+	defer s.dropping.Unlock()
+
 	now := time.Now()
-	session := s.session.Copy()
-	defer session.Close()
+	sessions := s.copySessions()
+	defer closeSessions(sessions)
+
 	s.activeDB.Range(func(k, v interface{}) bool {
-		if now.Sub(time.Unix(v.(int64), 0)) > expireInterval {
-			err := session.DB(k.(string)).DropDatabase()
+		if now.Sub(time.Unix(v.(int64), 0)) > s.config.expireInterval {
+			dropped, err := s.dropDB(sessions, k.(string))
 			if err != nil {
 				s.logger.Printf("fail to drop database %v: %v", k, err)
 				return true
 			}
-			s.activeDB.Delete(k)
+			if dropped {
+				s.metrics.droppedDatabase()
+			}
 		}
 		return true
 	})
@@ -118,6 +248,10 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *server) viewHandler(w http.ResponseWriter, r *http.Request) {
 
 	id := strings.TrimPrefix(r.URL.Path, "/p/")
+	if strings.HasSuffix(id, "/export") {
+		s.exportHandler(w, r, strings.TrimSuffix(id, "/export"))
+		return
+	}
 	p, err := s.loadPage([]byte(id))
 	if err != nil {
 		s.logger.Printf("requested page %s doesn't exists", id)
@@ -125,62 +259,108 @@ func (s *server) viewHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("this playground doesn't exist"))
 		return
 	}
-	err = templates.Execute(w, p)
+	err = templates.Execute(w, s.pageData(p))
 	if err != nil {
 		s.logger.Printf("fail to execute template with page %s: %v", p.String(), err)
 		return
 	}
 }
 
+// load a saved page, and record the view. The metadata of the returned
+// page include views and runs not written to the storage yet
 func (s *server) loadPage(id []byte) (*page, error) {
-	p := &page{
-		MongoVersion: s.mongodbVersion,
+	p := &page{}
+	val, err := s.storage.Get(id)
+	if err == nil {
+		err = p.decode(val)
 	}
-	err := s.storage.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(id)
-		if err != nil {
-			return err
-		}
-		val, err := item.Value()
-		if err != nil {
-			return err
-		}
-		p.decode(val)
-		return nil
-	})
+	if err != nil {
+		p = &page{}
+	} else {
+		n := s.countView(id)
+		n.apply(p)
+	}
+	// show the version of mongodb the page will actually be run against
+	p.MongoVersion = s.backend(p.MongoVersion).version
 	return p, err
 }
 
+// apply update to the metadata of the saved page identified by id. Pages
+// that are not saved are skipped, and failing to store the updated page is
+// only logged, as the page is still usable
+func (s *server) updatePage(id []byte, update func(p *page)) {
+
+	s.pageUpdates.Lock()
+	defer s.pageUpdates.Unlock()
+
+	val, err := s.storage.Get(id)
+	if err != nil {
+		return
+	}
+	p := &page{}
+	if err := p.decode(val); err != nil {
+		return
+	}
+	update(p)
+	if err := s.storage.Put(id, p.encode()); err != nil {
+		s.logger.Printf("fail to update metadata of page %s: %v", id, err)
+	}
+}
+
+// data used to render a playground page
+type pageData struct {
+	*page
+	// versions of mongodb available
+	MongoVersions []string
+	// date the page was saved, if known
+	Created string
+}
+
+func (s *server) pageData(p *page) *pageData {
+	d := &pageData{
+		page:          p,
+		MongoVersions: s.mongodbVersions(),
+	}
+	if p.CreatedAt != 0 {
+		d.Created = time.Unix(p.CreatedAt, 0).UTC().Format("2006-01-02")
+	}
+	return d
+}
+
 // run a query and return the results as plain text
 func (s *server) runHandler(w http.ResponseWriter, r *http.Request) {
 
 	p := &page{
-		Mode:   modeByte(r.FormValue("mode")),
-		Config: []byte(r.FormValue("config")),
-		Query:  []byte(r.FormValue("query")),
+		Mode:         modeByte(r.FormValue("mode")),
+		Config:       []byte(r.FormValue("config")),
+		Query:        []byte(r.FormValue("query")),
+		MongoVersion: []byte(r.FormValue("mongoVersion")),
 	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// when a statement of a script fails, res holds the output
+	// of the previous statements
 	res, err := s.run(p)
-	if err != nil {
-		w.Write([]byte(err.Error()))
+	if e, ok := err.(*throttledError); ok {
+		s.writeThrottled(w, r, e)
 		return
 	}
+	s.countRun(p)
 	w.Write(res)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+	}
 }
 
 // save the playground and return the playground ID
 func (s *server) saveHandler(w http.ResponseWriter, r *http.Request) {
 
 	p := &page{
-		Mode:   modeByte(r.FormValue("mode")),
-		Config: []byte(r.FormValue("config")),
-		Query:  []byte(r.FormValue("query")),
+		Mode:         modeByte(r.FormValue("mode")),
+		Config:       []byte(r.FormValue("config")),
+		Query:        []byte(r.FormValue("query")),
+		MongoVersion: []byte(r.FormValue("mongoVersion")),
 	}
-
-	id, val := p.ID(), p.encode()
-	err := s.storage.Update(func(txn *badger.Txn) error {
-		return txn.Set(id, val)
-	})
+	id, err := s.save(p)
 	if err != nil {
 		s.logger.Printf("fail to save playground %s with id %s", p.String(), id)
 	}
@@ -188,6 +368,29 @@ func (s *server) saveHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%sp/%s", r.Referer(), id)
 }
 
+// store the p page and return its ID. Saving a page already saved
+// keeps its metadata
+func (s *server) save(p *page) ([]byte, error) {
+	// only store versions of mongodb actually available, so that
+	// the same playground always gets the same ID
+	p.MongoVersion = s.savedVersion(p.MongoVersion)
+	id := p.ID()
+
+	s.pageUpdates.Lock()
+	defer s.pageUpdates.Unlock()
+
+	saved := &page{}
+	if val, err := s.storage.Get(id); err == nil && saved.decode(val) == nil {
+		p.CreatedAt, p.LastViewedAt = saved.CreatedAt, saved.LastViewedAt
+		p.Views, p.Runs = saved.Views, saved.Runs
+		p.SavedVersion = saved.SavedVersion
+	} else {
+		p.CreatedAt = time.Now().Unix()
+		p.SavedVersion = s.backend(p.MongoVersion).version
+	}
+	return id, s.storage.Put(id, p.encode())
+}
+
 // return a playground with the default configuration
 func (s *server) newPageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -214,6 +417,7 @@ func (s *server) staticHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Encoding", "gzip")
 	w.Header().Set("Cache-Control", "public, max-age=31536000")
 	pos, ok := s.staticContentMap[name]
+	s.metrics.staticRequest(ok)
 	if !ok {
 		s.logger.Printf("static resource %s doesn't exist", name)
 		w.WriteHeader(http.StatusNotFound)
@@ -223,59 +427,183 @@ func (s *server) staticHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 const (
-	// max number of collection to create at once
-	maxCollNb = 10
-	// max number of documents in a collection
-	maxDoc = 100
-	// max size of a collection
-	maxBytes = maxDoc * 1024
 	// noDocFound error message when no docs match the query
 	noDocFound = "no document found"
+	// invalidQuery error message when the query doesn't match expected format
+	invalidQuery = "invalid query: \nmust match db.coll.find(...) or db.coll.aggregate(...)"
 	// invalidConfig error message when the configuration doesn't match expected format
 	invalidConfig = "invalid configuration:\n    must be an array of documents like '[ {_id: 1} ]'\n\n    or\n\n    must match 'db = { collection: [ {_id: 1}, ... ]' }"
 )
 
-func (s *server) run(p *page) (result []byte, err error) {
+// run the query of the p page, and return its output as text
+func (s *server) run(p *page) ([]byte, error) {
+	outputs, err := s.runPage(p)
+	if _, ok := err.(*statementError); err != nil && !ok {
+		return nil, err
+	}
+	text, textErr := scriptText(outputs, len(splitScript(p.Query)))
+	if err == nil {
+		err = textErr
+	}
+	return text, err
+}
+
+// run the query of the p page, and return the output of each of
+// its statements. The run is recorded in the metrics
+func (s *server) runPage(p *page) (outputs []*queryOutput, err error) {
+	defer func(start time.Time) {
+		s.metrics.observeRun(modeName(p.Mode), runMethod(splitScript(p.Query)), time.Since(start), err)
+	}(time.Now())
+	return s.execute(p)
+}
 
-	session := s.session.Copy()
+// same as runPage, without recording the run in the metrics
+func (s *server) execute(p *page) ([]*queryOutput, error) {
+
+	// the same configuration run against the same backend always
+	// uses the same database. p is left untouched, as its version
+	// identifies the saved page to count the run for
+	normalized := *p
+	normalized.MongoVersion = s.normalizeVersion(p.MongoVersion)
+	p = &normalized
+
+	statements := splitScript(p.Query)
+	session := s.backend(p.MongoVersion).session.Copy()
 	defer session.Close()
 
 	DBHash := p.dbHash()
+	// queries modifying the content of the database are run against a
+	// dedicated database, dropped once the script returns, so that changes
+	// don't leak into later runs sharing the same configuration
+	write := isWriteScript(statements)
+	if write {
+		DBHash = s.tmpDBHash(p)
+	}
 	db := session.DB(DBHash)
 
-	_, exists := s.activeDB.Load(DBHash)
-	if !exists {
+	if write {
+		defer db.DropDatabase()
+		// collections of a temporary database are not capped, as documents
+		// can't be removed from a capped collection
+		if err := s.createDB(db, p, false); err != nil {
+			return nil, err
+		}
+		return runStatements(db, statements, s.config.limits)
+	}
 
-		collections := map[string][]bson.M{}
+	s.using.acquire(DBHash)
+	created, err := s.loadDB(db, p)
+	var outputs []*queryOutput
+	if err == nil {
+		outputs, err = runStatements(db, statements, s.config.limits)
+	}
+	s.using.release(DBHash)
 
-		switch p.Mode {
-		case mgodatagenMode:
-			err = createContentFromMgodatagen(collections, p.Config)
-		case bsonMode:
-			err = loadContentFromJSON(collections, p.Config)
-		}
+	if created {
+		s.evictDB(DBHash)
+	}
+	return outputs, err
+}
 
-		if err != nil {
-			return nil, fmt.Errorf("error in configuration:\n  %v", err)
-		}
+// create the database of the p page if it is not in activeDB yet, and
+// mark it as used. created is true if the database was created
+func (s *server) loadDB(db *mgo.Database, p *page) (created bool, err error) {
 
-		err := createDatabase(db, collections)
-		if err != nil {
-			return nil, err
+	s.creating.lock(db.Name)
+	defer s.creating.unlock(db.Name)
+
+	if _, exists := s.activeDB.Load(db.Name); !exists {
+		if err := s.createDB(db, p, true); err != nil {
+			return false, err
 		}
+		s.addToPool(db)
+		created = true
+	}
+	s.activeDB.Store(db.Name, time.Now().Unix())
+	return created, nil
+}
+
+func (s *server) createDB(db *mgo.Database, p *page, capped bool) error {
+	// bound the number of databases created at the same time, as
+	// a burst of distinct configurations creates a burst of databases
+	if err := s.acquireDBCreation(); err != nil {
+		return err
+	}
+	defer s.releaseDBCreation()
+	return createPageDatabase(db, p, capped, s.config.limits)
+}
+
+// generate an unique hash to identify the temporary database used to run a
+// write query from the p page
+func (s *server) tmpDBHash(p *page) string {
+	n := atomic.AddUint64(&s.tmpDBCount, 1)
+	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprintf("%s%d", p.dbHash(), n))))
+}
+
+// an error caused by the configuration of a playground, like an invalid
+// document, or a duplicate key rejected by mongodb
+type invalidConfigError struct {
+	err error
+}
+
+func (e *invalidConfigError) Error() string {
+	return e.err.Error()
+}
+
+// return err as an invalidConfigError if mongodb rejected a command. As
+// commands run while creating a database only hold the content of the
+// configuration, the configuration is invalid. Other errors, like network
+// errors, are failures of the server
+func rejectedConfig(err error) error {
+	var queryErr *mgo.QueryError
+	var lastErr *mgo.LastError
+	var bulkErr *mgo.BulkError
+	if errors.As(err, &queryErr) || errors.As(err, &lastErr) || errors.As(err, &bulkErr) {
+		return &invalidConfigError{err: err}
 	}
+	return err
+}
+
+// create the collections described by the configuration of the p page in db
+func createPageDatabase(db *mgo.Database, p *page, capped bool, l runLimits) error {
+	collections, indexes, aggregators, err := loadPageContent(p, l)
+	if err != nil {
+		return &invalidConfigError{err: err}
+	}
+	return rejectedConfig(createDatabase(db, collections, indexes, aggregators, capped, l))
+}
+
+// load the collections, indexes and aggregators described by the
+// configuration of the p page
+func loadPageContent(p *page, l runLimits) (collections map[string][]bson.M, indexes map[string][]index, aggregators map[string]map[string]generators.Config, err error) {
 
-	s.activeDB.Store(DBHash, time.Now().Unix())
+	collections = map[string][]bson.M{}
+	indexes = map[string][]index{}
+	aggregators = map[string]map[string]generators.Config{}
 
-	return runQuery(db, p.Query)
+	switch p.Mode {
+	case mgodatagenMode:
+		err = createContentFromMgodatagen(collections, indexes, aggregators, p.Config, l)
+	case bsonMode:
+		err = loadContentFromJSON(collections, indexes, p.Config)
+	}
+
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error in configuration:\n  %v", err)
+	}
+	return collections, indexes, aggregators, nil
 }
 
-func createContentFromMgodatagen(collections map[string][]bson.M, config []byte) error {
+func createContentFromMgodatagen(collections map[string][]bson.M, indexes map[string][]index, aggregators map[string]map[string]generators.Config, config []byte, l runLimits) error {
 
 	collConfigs, err := datagen.ParseConfig(config, true)
 	if err != nil {
 		return err
 	}
+	err = loadIndexesFromMgodatagen(indexes, config)
+	if err != nil {
+		return err
+	}
 
 	mapRef := map[int][][]byte{}
 	mapRefType := map[int]byte{}
@@ -283,8 +611,8 @@ func createContentFromMgodatagen(collections map[string][]bson.M, config []byte)
 	for _, c := range collConfigs {
 
 		ci := generators.NewCollInfo(c.Count, []int{3, 6}, 1, mapRef, mapRefType)
-		if ci.Count > maxDoc || ci.Count <= 0 {
-			ci.Count = maxDoc
+		if ci.Count > l.maxDocs || ci.Count <= 0 {
+			ci.Count = l.maxDocs
 		}
 		g, err := ci.NewDocumentGenerator(c.Content)
 		if err != nil {
@@ -298,11 +626,19 @@ func createContentFromMgodatagen(collections map[string][]bson.M, config []byte)
 			}
 		}
 		collections[c.Name] = docs
+
+		fields, err := aggregatorFields(c.Content)
+		if err != nil {
+			return fmt.Errorf("fail to create collection %s: %v", c.Name, err)
+		}
+		if len(fields) > 0 {
+			aggregators[c.Name] = fields
+		}
 	}
 	return nil
 }
 
-func loadContentFromJSON(collections map[string][]bson.M, config []byte) error {
+func loadContentFromJSON(collections map[string][]bson.M, indexes map[string][]index, config []byte) error {
 
 	if bytes.HasPrefix(config, []byte("[")) {
 
@@ -315,16 +651,44 @@ func loadContentFromJSON(collections map[string][]bson.M, config []byte) error {
 	}
 
 	if bytes.HasPrefix(config, []byte("db={")) {
-		return bson.UnmarshalJSON(config[3:], &collections)
+		var sections map[string]section
+		err := bson.UnmarshalJSON(config[3:], &sections)
+		if err != nil {
+			return err
+		}
+		names := make(sort.StringSlice, 0, len(sections))
+		for name := range sections {
+			names = append(names, name)
+		}
+		names.Sort()
+		for _, name := range names {
+			content := sections[name]
+			// an "indexes" document holds the indexes of each collection, like
+			// indexes: { collection: [ {key: {a: 1}} ] }
+			if name == "indexes" && bytes.HasPrefix(content, []byte("{")) {
+				err = bson.UnmarshalJSON(content, &indexes)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			var docs []bson.M
+			err = bson.UnmarshalJSON(content, &docs)
+			if err != nil {
+				return err
+			}
+			collections[name] = docs
+		}
+		return checkIndexes(collections, indexes)
 	}
 
 	return errors.New(invalidConfig)
 }
 
-func createDatabase(db *mgo.Database, collections map[string][]bson.M) error {
+func createDatabase(db *mgo.Database, collections map[string][]bson.M, indexes map[string][]index, aggregators map[string]map[string]generators.Config, capped bool, l runLimits) error {
 
-	if len(collections) > maxCollNb {
-		return fmt.Errorf("max number of collection in a database is %d, but was %d", maxCollNb, len(collections))
+	if len(collections) > l.maxCollections {
+		return &invalidConfigError{err: fmt.Errorf("max number of collection in a database is %d, but was %d", l.maxCollections, len(collections))}
 	}
 	// clean any potentially remaining data
 	db.DropDatabase()
@@ -334,21 +698,37 @@ func createDatabase(db *mgo.Database, collections map[string][]bson.M) error {
 		names = append(names, name)
 	}
 	names.Sort()
+	setMissingIDs(collections, names)
 
-	base := 0
+	// the size of documents of a capped collection can't change, so
+	// collections updated by aggregators are never capped
+	isCapped := func(name string) bool {
+		_, aggregated := aggregators[name]
+		return capped && !aggregated
+	}
+
+	// capped collections drop the oldest documents when they are full, but
+	// other collections have to be checked
+	uncapped := make([]string, 0, len(names))
 	for _, name := range names {
+		if !isCapped(name) {
+			uncapped = append(uncapped, name)
+		}
+	}
+	if err := checkContent(collections, uncapped, l); err != nil {
+		return &invalidConfigError{err: err}
+	}
 
-		bulk := createBulk(db, name)
+	for _, name := range names {
+
+		bulk := createBulk(db, name, isCapped(name), l)
 
 		docs := collections[name]
 		if len(docs) == 0 {
 			continue
 		}
 
-		for i, doc := range docs {
-			if _, hasID := doc["_id"]; !hasID {
-				doc["_id"] = seededObjectID(int32(base + i))
-			}
+		for _, doc := range docs {
 			bulk.Insert(doc)
 		}
 
@@ -356,16 +736,58 @@ func createDatabase(db *mgo.Database, collections map[string][]bson.M) error {
 		if err != nil {
 			return err
 		}
-		base += len(docs)
+	}
+
+	// aggregators and indexes are applied once all collections are
+	// created, as they may rely on the content of other collections
+	for _, name := range names {
+
+		if fields, ok := aggregators[name]; ok {
+			err := runAggregators(db, name, fields, l)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := createIndexes(db.C(name), indexes[name])
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func createBulk(db *mgo.Database, name string) *mgo.Bulk {
-	info := &mgo.CollectionInfo{
-		Capped:   true,
-		MaxDocs:  maxDoc,
-		MaxBytes: maxBytes,
+// make sure that no collection holds more than maxDocs documents or
+// maxCollectionBytes bytes
+func checkContent(collections map[string][]bson.M, names []string, l runLimits) error {
+	for _, name := range names {
+		docs := collections[name]
+		if len(docs) > l.maxDocs {
+			return fmt.Errorf("max number of documents in a collection is %d, but was %d", l.maxDocs, len(docs))
+		}
+		size := 0
+		for _, doc := range docs {
+			b, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			size += len(b)
+		}
+		if size > l.maxCollectionBytes {
+			return fmt.Errorf("max size of a collection is %d bytes, but was %d bytes", l.maxCollectionBytes, size)
+		}
+	}
+	return nil
+}
+
+func createBulk(db *mgo.Database, name string, capped bool, l runLimits) *mgo.Bulk {
+	info := &mgo.CollectionInfo{}
+	if capped {
+		info = &mgo.CollectionInfo{
+			Capped:   true,
+			MaxDocs:  l.maxDocs,
+			MaxBytes: l.maxCollectionBytes,
+		}
 	}
 	c := db.C(name)
 	c.Create(info)
@@ -376,6 +798,21 @@ func createBulk(db *mgo.Database, name string) *mgo.Bulk {
 	return bulk
 }
 
+// give a predictable ObjectId to the documents without _id, so
+// results are the same on every run
+func setMissingIDs(collections map[string][]bson.M, names []string) {
+	base := 0
+	for _, name := range names {
+		docs := collections[name]
+		for i, doc := range docs {
+			if _, hasID := doc["_id"]; !hasID {
+				doc["_id"] = seededObjectID(int32(base + i))
+			}
+		}
+		base += len(docs)
+	}
+}
+
 func seededObjectID(n int32) bson.ObjectId {
 
 	// using date = uint32(time.Date(2018, 02, 26, 0, 0, 0, 0, time.UTC).Unix())
@@ -396,53 +833,258 @@ func seededObjectID(n int32) bson.ObjectId {
 	})
 }
 
-func runQuery(db *mgo.Database, query []byte) ([]byte, error) {
+// methods that modify the content of a collection. Once the write succeeded,
+// the resulting content of the collection is returned
+var writeMethods = map[string]bool{
+	"insertOne":  true,
+	"insertMany": true,
+	"updateOne":  true,
+	"updateMany": true,
+	"deleteOne":  true,
+	"deleteMany": true,
+}
+
+func isWriteQuery(query []byte) bool {
+	q, err := parseQuery(query)
+	return err == nil && writeMethods[q.method()]
+}
+
+func isWriteScript(statements [][]byte) bool {
+	for _, st := range statements {
+		if isWriteQuery(st) {
+			return true
+		}
+	}
+	return false
+}
+
+// error returned when a statement of a script fails
+type statementError struct {
+	// position of the statement in the script, starting at 1
+	statement int
+	err       error
+}
+
+func (e *statementError) Error() string {
+	return e.err.Error()
+}
+
+// output of a statement of a script
+type queryOutput struct {
+	// documents returned by the statement, or the summary of its query
+	// plan for explain
+	docs []interface{}
+	// set when the statement counts documents instead of returning them
+	counted bool
+	count   int
+}
+
+// output of the statement, as displayed in the playground
+func (o *queryOutput) text() ([]byte, error) {
+	if o.counted {
+		return []byte(strconv.Itoa(o.count)), nil
+	}
+	if len(o.docs) == 0 {
+		return []byte(noDocFound), nil
+	}
+	return bson.MarshalExtendedJSON(o.docs)
+}
+
+// output of the statement as a json array of documents in extended
+// json, empty if no document matched. A count is returned as a single
+// document {"count": n}
+func (o *queryOutput) json() ([]byte, error) {
+	if o.counted {
+		return bson.MarshalJSON([]bson.D{{{Name: "count", Value: o.count}}})
+	}
+	docs := o.docs
+	if docs == nil {
+		docs = []interface{}{}
+	}
+	return bson.MarshalJSON(docs)
+}
+
+// run the statements of a script in order against the same database. The
+// script stops at the first error. In this case, the output of the previous
+// statements is returned along with the error
+func runStatements(db *mgo.Database, statements [][]byte, l runLimits) ([]*queryOutput, error) {
+	outputs := make([]*queryOutput, 0, len(statements))
+	for i, st := range statements {
+		out, err := runQuery(db, st, l)
+		if err != nil {
+			return outputs, &statementError{statement: i + 1, err: err}
+		}
+		outputs = append(outputs, out)
+	}
+	return outputs, nil
+}
 
-	// query should look like
-	// db.(\w*).(find|aggregate)(...)
-	p := bytes.SplitN(query, []byte{'.'}, 3)
-	if len(p) != 3 {
-		return nil, fmt.Errorf("invalid query: \nmust match db.coll.find(...) or db.coll.aggregate(...)")
+// run the statements of a script and return their output as text
+func runScript(db *mgo.Database, statements [][]byte, l runLimits) ([]byte, error) {
+	outputs, err := runStatements(db, statements, l)
+	text, textErr := scriptText(outputs, len(statements))
+	if err == nil {
+		err = textErr
 	}
+	return text, err
+}
 
-	collection := db.C(string(p[1]))
+// format the outputs of a script of n statements. When there are several
+// statements, the output of each statement is labelled by its position.
+// If the script failed, the label of the failing statement ends the text
+func scriptText(outputs []*queryOutput, n int) ([]byte, error) {
 
-	if !exist(collection) {
-		return nil, fmt.Errorf(`collection "%s" doesn't exist`, p[1])
+	if n == 1 {
+		if len(outputs) == 0 {
+			return nil, nil
+		}
+		res, err := outputs[0].text()
+		if err != nil {
+			return nil, &statementError{statement: 1, err: err}
+		}
+		return res, nil
 	}
 
-	// last part of query contains the method and the stages, for example find({k:1})
-	queryBytes := p[2]
-	start, end := bytes.IndexByte(queryBytes, '('), bytes.LastIndexByte(queryBytes, ')')
+	var buf bytes.Buffer
+	for i, out := range outputs {
+		if i > 0 {
+			buf.WriteString("\n\n")
+		}
+		fmt.Fprintf(&buf, "statement %d:\n", i+1)
+		res, err := out.text()
+		if err != nil {
+			return buf.Bytes(), &statementError{statement: i + 1, err: err}
+		}
+		buf.Write(bytes.TrimSuffix(res, []byte{'\n'}))
+	}
+	if len(outputs) < n {
+		if len(outputs) > 0 {
+			buf.WriteString("\n\n")
+		}
+		fmt.Fprintf(&buf, "statement %d:\n", len(outputs)+1)
+	}
+	return buf.Bytes(), nil
+}
 
-	method := string(queryBytes[:start])
+func runQuery(db *mgo.Database, query []byte, l runLimits) (*queryOutput, error) {
 
-	stages, err := stages(queryBytes[start+1 : end])
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	verbosity, explain, err := explainOf(q)
 	if err != nil {
-		return nil, fmt.Errorf("fail to parse content of query: %v", err)
+		return nil, err
+	}
+
+	method, args := q.method(), q.calls[0].args
+	if err := l.checkMethod(method); err != nil {
+		return nil, err
+	}
+	collection := db.C(q.collection)
+
+	// insert creates the collection if it doesn't exist yet
+	if !exist(collection) && method != "insertOne" && method != "insertMany" {
+		return nil, fmt.Errorf(`collection "%s" doesn't exist`, q.collection)
 	}
 
 	var docs []bson.M
 
+	if writeMethods[method] {
+		if err := checkNoModifiers(q.calls[1:]); err != nil {
+			return nil, err
+		}
+		a, err := arguments(args)
+		if err != nil {
+			return nil, parseErrorf("%v", err)
+		}
+		if err := l.checkValues(a...); err != nil {
+			return nil, err
+		}
+		err = runWrite(collection, method, a, l)
+		if err == nil {
+			docs, err = l.collect(collection.Find(nil).SetMaxTime(l.timeout).Iter())
+		}
+		return queryResult(docs, err)
+	}
+
 	switch method {
 	case "find":
+		stages, err := stages(args)
+		if err != nil {
+			return nil, parseErrorf("%v", err)
+		}
+		if err := l.checkValues(stages); err != nil {
+			return nil, err
+		}
 		for len(stages) < 2 {
 			stages = append(stages, bson.M{})
 		}
-		err = collection.Find(stages[0]).Select(stages[1]).All(&docs)
+		mq := collection.Find(stages[0]).Select(stages[1]).SetMaxTime(l.timeout)
+		count, err := applyModifiers(mq, q.calls[1:])
+		if err != nil {
+			return nil, err
+		}
+		if explain {
+			cmd, err := findCommand(collection.Name, stages, q.calls[1:])
+			if err != nil {
+				return nil, err
+			}
+			return runExplain(db, cmd, verbosity, l)
+		}
+		if count {
+			n, err := mq.Count()
+			if err != nil {
+				return queryResult(nil, l.check(err))
+			}
+			return &queryOutput{counted: true, count: n}, nil
+		}
+		docs, err = l.collect(mq.Iter())
+		return queryResult(docs, err)
 	case "aggregate":
-		err = collection.Pipe(stages).All(&docs)
+		if err := checkNoModifiers(q.calls[1:]); err != nil {
+			return nil, err
+		}
+		stages, opts, err := pipeline(args)
+		if err != nil {
+			return nil, parseErrorf("%v", err)
+		}
+		if err := l.checkPipeline(stages); err != nil {
+			return nil, err
+		}
+		if err := l.checkValues(opts); err != nil {
+			return nil, err
+		}
+		if explain {
+			cmd, err := aggregateCommand(collection.Name, stages, opts)
+			if err != nil {
+				return queryResult(nil, err)
+			}
+			return runExplain(db, cmd, verbosity, l)
+		}
+		iter, err := aggregate(collection, stages, opts, l)
+		if err != nil {
+			return queryResult(nil, err)
+		}
+		docs, err = l.collect(iter)
+		return queryResult(docs, err)
 	default:
-		err = fmt.Errorf("invalid method: %s", method)
+		return nil, invalidMethod(method)
 	}
+}
 
+func queryResult(docs []bson.M, err error) (*queryOutput, error) {
+	if _, ok := err.(*queryLimitError); ok {
+		return nil, err
+	}
 	if err != nil {
 		return nil, fmt.Errorf("query failed: %v", err)
 	}
-	if len(docs) == 0 {
-		return []byte(noDocFound), nil
+	out := &queryOutput{docs: make([]interface{}, 0, len(docs))}
+	for _, doc := range docs {
+		out.docs = append(out.docs, doc)
 	}
-	return bson.MarshalExtendedJSON(docs)
+	return out, nil
 }
 
 func stages(queryBytes []byte) (stages []bson.M, err error) {
@@ -509,16 +1151,16 @@ func (s *server) precompile() error {
 		Mode:         bsonMode,
 		Config:       []byte(templateConfig),
 		Query:        []byte(templateQuery),
-		MongoVersion: s.mongodbVersion,
+		MongoVersion: s.backends[0].version,
 	}
-	if err := templates.Execute(zw, p); err != nil {
+	if err := templates.Execute(zw, s.pageData(p)); err != nil {
 		return err
 	}
 	if err := s.add(zw, &buf, 0); err != nil {
 		return err
 	}
 
-	files, err := ioutil.ReadDir(staticDir)
+	files, err := ioutil.ReadDir(s.config.staticDir)
 	if err != nil {
 		return err
 	}
@@ -527,7 +1169,7 @@ func (s *server) precompile() error {
 		zw.Reset(&buf)
 		zw.Name = f.Name()
 		zw.ModTime = time.Now()
-		b, err := ioutil.ReadFile(staticDir + f.Name())
+		b, err := ioutil.ReadFile(filepath.Join(s.config.staticDir, f.Name()))
 		if err != nil {
 			return err
 		}
@@ -568,7 +1210,12 @@ func (s *server) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "encoding/json")
 
-	result, err := s.run(p)
+	// healthchecks are not counted as runs in the metrics
+	outputs, err := s.execute(p)
+	var result []byte
+	if err == nil {
+		result, err = scriptText(outputs, 1)
+	}
 	if err != nil || bytes.Compare(bytes.TrimSuffix(result, []byte("\n")), p.Config) != 0 {
 		fmt.Fprintf(w, `{"status":"unexpected result: (err: %v, result: %s"}`, err, result)
 		return
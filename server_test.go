@@ -15,7 +15,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/dgraph-io/badger"
 	"github.com/globalsign/mgo/bson"
 )
 
@@ -30,22 +29,19 @@ var (
 )
 
 func TestMain(m *testing.M) {
-	err := os.RemoveAll(badgerDir)
-	if err != nil {
-		fmt.Printf("aborting: %v\n", err)
-		os.Exit(1)
-	}
 	log := log.New(ioutil.Discard, "", 0)
-	s, err := newServer(log)
+	c := defaultConfig()
+	// don't track databases across test runs
+	c.activeDBFile = ""
+	s, err := newServer(log, newMemoryStore(), c)
 	if err != nil {
 		fmt.Printf("aborting: %v\n", err)
 		os.Exit(1)
 	}
 	testServer = s
-	defer s.session.Close()
-	defer s.storage.Close()
 
 	retCode := m.Run()
+	s.Close()
 	os.Exit(retCode)
 }
 
@@ -61,6 +57,69 @@ func TestServeHTTP(t *testing.T) {
 	}
 }
 
+func TestAdminHandler(t *testing.T) {
+
+	t.Parallel()
+
+	adminHandlerTests := []struct {
+		name        string
+		handler     http.Handler
+		url         string
+		code        int
+		contentType string
+	}{
+		{
+			name:        "metrics",
+			handler:     testServer.adminHandler(),
+			url:         "/metrics",
+			code:        http.StatusOK,
+			contentType: "text/plain; version=0.0.4; charset=utf-8",
+		},
+		{
+			name:        "databases",
+			handler:     testServer.adminHandler(),
+			url:         "/admin/databases",
+			code:        http.StatusOK,
+			contentType: "application/json; charset=utf-8",
+		},
+		{
+			name:        "playgrounds are not served",
+			handler:     testServer.adminHandler(),
+			url:         "/" + templateURL,
+			code:        http.StatusNotFound,
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:        "metrics are not served publicly",
+			handler:     testServer,
+			url:         "/metrics",
+			code:        http.StatusOK,
+			contentType: "text/html; charset=utf-8",
+		},
+		{
+			name:        "databases are not served publicly",
+			handler:     testServer,
+			url:         "/admin/databases",
+			code:        http.StatusOK,
+			contentType: "text/html; charset=utf-8",
+		},
+	}
+
+	for _, tt := range adminHandlerTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			resp := httptest.NewRecorder()
+			tt.handler.ServeHTTP(resp, req)
+			if tt.code != resp.Code {
+				t.Errorf("expected code %d but got %d", tt.code, resp.Code)
+			}
+			if want, got := tt.contentType, resp.Header().Get("Content-Type"); want != got {
+				t.Errorf("expected content type %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
 func TestRunCreateDB(t *testing.T) {
 
 	testServer.clearDatabases(t)
@@ -302,6 +361,150 @@ func TestRunCreateDB(t *testing.T) {
 			createdDB: 0,
 			compact:   false,
 		},
+		{
+			name: "aggregators",
+			params: url.Values{
+				"mode": {"mgodatagen"},
+				"config": {`[
+				{
+					"collection": "first",
+					"count": 3,
+					"content": {
+						"field1": {
+							"type": "fromArray",
+							"in": [1, 1, 2]
+						},
+						"field2": {
+							"type": "fromArray",
+							"in": ["a", "b", "c"]
+						}
+					}
+				}, {
+					"collection": "second",
+					"count": 2,
+					"content": {
+						"_id": {
+							"type": "autoincrement",
+							"autoType": "int",
+							"startInt": 1
+						},
+						"count": {
+							"type": "countAggregator",
+							"collection": "first",
+							"query": {"field1": "$$_id"}
+						},
+						"values": {
+							"type": "valueAggregator",
+							"database": "unknown",
+							"collection": "first",
+							"field": "field2",
+							"query": {"field1": "$$_id"}
+						},
+						"bounds": {
+							"type": "boundAggregator",
+							"collection": "first",
+							"field": "field2",
+							"query": {"field1": "$$_id"}
+						}
+					}
+				}
+			]`}, "query": {`db.second.aggregate([{"$replaceRoot":{"newRoot":{"_id":"$_id","count":"$count","values":"$values","min":"$bounds.m","max":"$bounds.M"}}}])`}},
+			result:    `[{"_id":1,"count":2,"values":["a","b"],"min":"a","max":"b"},{"_id":2,"count":1,"values":["c"],"min":"c","max":"c"}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: "aggregated collection larger than max size of a collection",
+			params: url.Values{
+				"mode": {"mgodatagen"},
+				"config": {`[
+				{
+					"collection": "coll1",
+					"count": 100,
+					"content": {
+						"text": {
+							"type": "string",
+							"minLength": 1100,
+							"maxLength": 1100
+						},
+						"count": {
+							"type": "countAggregator",
+							"collection": "coll1",
+							"query": {"_id": "$$_id"}
+						}
+					}
+				}
+			]`}, "query": {`db.coll1.find()`}},
+			result:    "max size of a collection is 102400 bytes, but was 113300 bytes",
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: "aggregated field larger than max size of a collection",
+			params: url.Values{
+				"mode": {"mgodatagen"},
+				"config": {`[
+				{
+					"collection": "first",
+					"count": 90,
+					"content": {
+						"field1": {
+							"type": "constant",
+							"constVal": 1
+						},
+						"field2": {
+							"type": "string",
+							"minLength": 1000,
+							"maxLength": 1000
+						}
+					}
+				}, {
+					"collection": "second",
+					"count": 1,
+					"content": {
+						"_id": {
+							"type": "constant",
+							"constVal": 1
+						},
+						"values": {
+							"type": "valueAggregator",
+							"collection": "first",
+							"field": "field2",
+							"query": {"field1": "$$_id"}
+						},
+						"sameValues": {
+							"type": "valueAggregator",
+							"collection": "first",
+							"field": "field2",
+							"query": {"field1": "$$_id"}
+						}
+					}
+				}
+			]`}, "query": {`db.second.find()`}},
+			result:    "fail to aggregate fields of collection second: collection is larger than 102400 bytes",
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: "aggregator without query",
+			params: url.Values{
+				"mode": {"mgodatagen"},
+				"config": {`[
+				{
+					"collection": "coll1",
+					"count": 1,
+					"content": {
+						"count": {
+							"type": "countAggregator",
+							"collection": "coll1"
+						}
+					}
+				}
+			]`}, "query": {`db.coll1.find()`}},
+			result:    "error in configuration:\n  fail to create collection coll1: for field count, 'query' can't be null or empty",
+			createdDB: 0,
+			compact:   false,
+		},
 		{
 			name: "basic json mode",
 			params: url.Values{
@@ -478,6 +681,50 @@ func TestRunCreateDB(t *testing.T) {
 			createdDB: 1,
 			compact:   true,
 		},
+		{
+			name: `doc with bson "NumberDecimal", "UUID" and "new Date"`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{d: NumberDecimal("12.50"), u: UUID("01234567-89ab-cdef-0123-456789abcdef"), dt: new Date(946684800000)}]`},
+				"query":  {`db.collection.find({d: {"$gt": NumberDecimal("12.4")}})`},
+			},
+			result:    `[{"_id":ObjectId("5a934e000102030405000000"),"d":NumberDecimal("12.50"),"dt":ISODate("2000-01-01T00:00:00Z"),"u":UUID("01234567-89ab-cdef-0123-456789abcdef")}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `doc with bson "DBRef"`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id": 1, ref: DBRef("other", ObjectId("5a934e000102030405000000"))}]`},
+				"query":  {`db.collection.find()`},
+			},
+			result:    `[{"_id":1,"ref":DBRef("other",ObjectId("5a934e000102030405000000"))}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `"HexData" and "MD5" in query`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{k: HexData(5, "0123456789abcdef0123456789abcdef")}, {k: HexData(0, "0a0b")}]`},
+				"query":  {`db.collection.find({k: MD5("0123456789abcdef0123456789abcdef")})`},
+			},
+			result:    `[{"_id":ObjectId("5a934e000102030405000000"),"k":MD5("0123456789abcdef0123456789abcdef")}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `invalid "NumberDecimal"`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{d: NumberDecimal("abc")}]`},
+				"query":  {`db.collection.find()`},
+			},
+			result:    "error in configuration:\n  invalid NumberDecimal: cannot parse \"abc\" as a decimal128",
+			createdDB: 0,
+			compact:   false,
+		},
 		{
 			name: `invalid "ObjectId" should not panic`,
 			params: url.Values{
@@ -490,14 +737,47 @@ func TestRunCreateDB(t *testing.T) {
 			compact:   false,
 		},
 		{
-			name: `regex parsing`, // TODO
+			name: `regex parsing`,
 			params: url.Values{
 				"mode":   {"bson"},
 				"config": {`[{"k": "randompattern"}]`},
 				"query":  {`db.collection.find({k: /pattern/})`},
 			},
-			result:    `fail to parse content of query: invalid character '/' looking for beginning of value`,
+			result:    `[{"_id":ObjectId("5a934e000102030405000000"),"k":"randompattern"}]`,
 			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `regex parsing with options`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"k": "randompattern"}]`},
+				"query":  {`db.collection.aggregate([{"$match": {k: /^RANDOM(pat)/i}}, {"$project": {"_id": 0}}])`},
+			},
+			result:    `[{"k":"randompattern"}]`,
+			createdDB: 0,
+			compact:   true,
+		},
+		{
+			name: `regex in config`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"k": /a\/b[/]/i}]`},
+				"query":  {`db.collection.find()`},
+			},
+			result:    `[{"_id":ObjectId("5a934e000102030405000000"),"k":/a\/b[\/]/i}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `unterminated regex`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"k": "randompattern"}]`},
+				"query":  {`db.collection.find({k: /pattern})`},
+			},
+			result:    `fail to parse content of query: unexpected end of JSON input`,
+			createdDB: 0,
 			compact:   false,
 		},
 		{
@@ -511,6 +791,138 @@ func TestRunCreateDB(t *testing.T) {
 			createdDB: 1,
 			compact:   true,
 		},
+		{
+			name: `find with sort and limit`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":3},{"_id":2,"k":1},{"_id":3,"k":2}]`},
+				"query":  {`db.collection.find().sort({"k": -1}).limit(2)`},
+			},
+			result:    `[{"_id":1,"k":3},{"_id":3,"k":2}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `find with projection, sort and skip`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":3},{"_id":2,"k":1},{"_id":3,"k":2}]`},
+				"query":  {`db.collection.find({}, {"_id": 0}).sort({k: 1}).skip(1).pretty()`},
+			},
+			result:    `[{"k":2},{"k":3}]`,
+			createdDB: 0,
+			compact:   true,
+		},
+		{
+			name: `find with count`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":3},{"_id":2,"k":1},{"_id":3,"k":2}]`},
+				"query":  {`db.collection.find({"k": {"$gt": 1}}).limit(1).count()`},
+			},
+			result:    `2`,
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: `find with count applying skip and limit`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":3},{"_id":2,"k":1},{"_id":3,"k":2}]`},
+				"query":  {`db.collection.find({"k": {"$gt": 1}}).limit(1).count(true)`},
+			},
+			result:    `1`,
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: `find with sort on multiple keys`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"a":1,"b":1},{"_id":2,"a":1,"b":2},{"_id":3,"a":0,"b":3}]`},
+				"query":  {`db.collection.find().sort({a: -1, "b": -1})`},
+			},
+			result:    `[{"_id":2,"a":1,"b":2},{"_id":1,"a":1,"b":1},{"_id":3,"a":0,"b":3}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `find with invalid cursor modifier`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"a":1,"b":1},{"_id":2,"a":1,"b":2},{"_id":3,"a":0,"b":3}]`},
+				"query":  {`db.collection.find().sort({a: 1}).batchSize(1)`},
+			},
+			result:    "query failed: invalid method: batchSize",
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: `find with invalid sort`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"a":1,"b":1},{"_id":2,"a":1,"b":2},{"_id":3,"a":0,"b":3}]`},
+				"query":  {`db.collection.find().sort({a: 0})`},
+			},
+			result:    "fail to parse content of query: invalid sort: invalid value for key a: 0",
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: `cursor modifier after aggregate`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"a":1,"b":1},{"_id":2,"a":1,"b":2},{"_id":3,"a":0,"b":3}]`},
+				"query":  {`db.collection.aggregate([]).limit(1)`},
+			},
+			result:    "query failed: invalid method: limit",
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: `aggregate with collation`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":"b"},{"_id":2,"k":"A"},{"_id":3,"k":"a"}]`},
+				"query":  {`db.collection.aggregate([{"$match":{"k":"a"}}],{"collation":{"locale":"en","strength":2}})`},
+			},
+			result:    `[{"_id":2,"k":"A"},{"_id":3,"k":"a"}]`,
+			createdDB: 1,
+			compact:   true,
+		},
+		{
+			name: `aggregate with allowDiskUse`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":"b"},{"_id":2,"k":"A"},{"_id":3,"k":"a"}]`},
+				"query":  {`db.collection.aggregate([{"$project":{"k":0}}], {allowDiskUse: true})`},
+			},
+			result:    `[{"_id":1},{"_id":2},{"_id":3}]`,
+			createdDB: 0,
+			compact:   true,
+		},
+		{
+			name: `aggregate with unknown option`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":"b"},{"_id":2,"k":"A"},{"_id":3,"k":"a"}]`},
+				"query":  {`db.collection.aggregate([], {"bypassDocumentValidation": true})`},
+			},
+			result:    "query failed: unknown option for aggregate: bypassDocumentValidation",
+			createdDB: 0,
+			compact:   false,
+		},
+		{
+			name: `aggregate with invalid options`,
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":"b"},{"_id":2,"k":"A"},{"_id":3,"k":"a"}]`},
+				"query":  {`db.collection.aggregate([] {"allowDiskUse": true})`},
+			},
+			result:    "fail to parse content of query: invalid character '{' after pipeline",
+			createdDB: 0,
+			compact:   false,
+		},
 		{
 			name: `empty config`,
 			params: url.Values{
@@ -606,6 +1018,454 @@ func TestRunExistingDB(t *testing.T) {
 
 }
 
+func TestRunWriteQuery(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	runWriteTests := []struct {
+		name   string
+		params url.Values
+		result string
+	}{
+		{
+			name: "updateOne",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1},{"_id":2,"k":2}]`},
+				"query":  {`db.collection.updateOne({"_id":1},{"$set":{"k":3}})`},
+			},
+			result: `[{"_id":1,"k":3},{"_id":2,"k":2}]`,
+		},
+		{
+			name: "updateMany",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1},{"_id":2,"k":2}]`},
+				"query":  {`db.collection.updateMany({},{"$inc":{"k":1}})`},
+			},
+			result: `[{"_id":1,"k":2},{"_id":2,"k":3}]`,
+		},
+		{
+			name: "updateOne with arrayFilters",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"a":[1,2,3]}]`},
+				"query":  {`db.collection.updateOne({"_id":1},{"$set":{"a.$[e]":0}},{"arrayFilters":[{"e":{"$gt":1}}]})`},
+			},
+			result: `[{"_id":1,"a":[1,0,0]}]`,
+		},
+		{
+			name: "updateOne with upsert",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1}]`},
+				"query":  {`db.collection.updateOne({"_id":2},{"$set":{"k":1}},{"upsert":true})`},
+			},
+			result: `[{"_id":1},{"_id":2,"k":1}]`,
+		},
+		{
+			name: "insertOne without _id",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"k":1}]`},
+				"query":  {`db.collection.insertOne({"k":2})`},
+			},
+			result: `[{"_id":ObjectId("5a934e000102030405000000"),"k":1},{"_id":ObjectId("5a934e000102030405000001"),"k":2}]`,
+		},
+		{
+			name: "insertMany in new collection",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1}]`},
+				"query":  {`db.other.insertMany([{"_id":1},{"_id":2}])`},
+			},
+			result: `[{"_id":1},{"_id":2}]`,
+		},
+		{
+			name: "deleteOne",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1},{"_id":2,"k":1}]`},
+				"query":  {`db.collection.deleteOne({"k":1})`},
+			},
+			result: `[{"_id":2,"k":1}]`,
+		},
+		{
+			name: "deleteMany",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1},{"_id":2,"k":1}]`},
+				"query":  {`db.collection.deleteMany({"k":1})`},
+			},
+			result: noDocFound,
+		},
+		{
+			name: "deleteMany without filter",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1}]`},
+				"query":  {`db.collection.deleteMany()`},
+			},
+			result: "query failed: deleteMany requires a filter",
+		},
+		{
+			name: "insertMany with too many documents",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1}]`},
+				"query":  {`db.collection.insertMany([` + strings.Repeat(`{},`, defaultLimits.maxDocs) + `])`},
+			},
+			result: fmt.Sprintf("query exceeded limit: max number of documents in a collection is %d, but was %d", defaultLimits.maxDocs, defaultLimits.maxDocs+1),
+		},
+	}
+
+	for _, tt := range runWriteTests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := httpBody(t, testServer.runHandler, http.MethodPost, "/run", tt.params)
+			got := buf.String()
+			if strings.HasPrefix(got, "[") {
+				comp, err := bson.CompactJSON(buf.Bytes())
+				if err != nil {
+					t.Errorf("could not compact result: %s (%v)", buf.Bytes(), err)
+				}
+				got = string(comp)
+			}
+			if want := tt.result; want != got {
+				t.Errorf("expected\n '%s'\n but got\n '%s'", want, got)
+			}
+		})
+	}
+	// databases used for write queries are dropped once the query returns
+	testStorageContent(t, 0, 0)
+
+	// a write should not leak into later runs with the same config
+	params := url.Values{
+		"mode":   {"bson"},
+		"config": {`[{"_id":1,"k":1},{"_id":2,"k":2}]`},
+		"query":  {templateQuery},
+	}
+	buf := httpBody(t, testServer.runHandler, http.MethodPost, "/run", params)
+	comp, err := bson.CompactJSON(buf.Bytes())
+	if err != nil {
+		t.Error(err)
+	}
+	if want, got := `[{"_id":1,"k":1},{"_id":2,"k":2}]`, string(comp); want != got {
+		t.Errorf("expected %s but got %s", want, got)
+	}
+	testStorageContent(t, 1, 0)
+}
+
+func TestRunScript(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	runScriptTests := []struct {
+		name   string
+		params url.Values
+		result string
+	}{
+		{
+			name: "single statement with semicolon",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":"a;b"}]`},
+				"query":  {`db.collection.find({"k":"a;b"});`},
+			},
+			result: `[{"_id":1,"k":"a;b"}]`,
+		},
+		{
+			name: "statements separated by semicolon",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1},{"_id":2,"k":2}]`},
+				"query":  {`db.collection.updateOne({"_id":1},{"$set":{"k":3}});db.collection.find({"k":{"$gt":2}});db.collection.aggregate([{"$group":{"_id":null,"total":{"$sum":"$k"}}}])`},
+			},
+			result: "statement 1:\n" + `[{"_id":1,"k":3},{"_id":2,"k":2}]` +
+				"\n\nstatement 2:\n" + `[{"_id":1,"k":3}]` +
+				"\n\nstatement 3:\n" + `[{"_id":null,"total":5}]`,
+		},
+		{
+			name: "statements separated by new lines",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1}]`},
+				"query":  {"db.collection.insertOne({\"_id\":2,\"k\":/a;b/})\n\ndb.collection.find()\n  .sort({\"_id\":-1})\n  .limit(1)"},
+			},
+			result: "statement 1:\n" + `[{"_id":1,"k":1},{"_id":2,"k":/a;b/}]` +
+				"\n\nstatement 2:\n" + `[{"_id":2,"k":/a;b/}]`,
+		},
+		{
+			name: "stop at first error",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1}]`},
+				"query":  {`db.collection.find({"_id":2});db.collection.insertOne({"_id":1});db.collection.find()`},
+			},
+			result: "statement 1:\nno document found\n\nstatement 2:\nquery failed: E11000 duplicate key error collection: ",
+		},
+	}
+
+	for _, tt := range runScriptTests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := httpBody(t, testServer.runHandler, http.MethodPost, "/run", tt.params)
+			got := strings.TrimSuffix(buf.String(), "\n")
+			if !strings.HasPrefix(got, tt.result) {
+				t.Errorf("expected\n '%s'\n but got\n '%s'", tt.result, got)
+			}
+		})
+	}
+	// scripts containing a write are run against a temporary database
+	testStorageContent(t, 1, 0)
+}
+
+func TestRunExplain(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	// plan details depend on mongodb version, so only parts
+	// of the summary are checked
+	runExplainTests := []struct {
+		name     string
+		query    string
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "find with executionStats",
+			query:    `db.collection.find({"k":{"$gt":1}}).sort({"_id":1}).explain("executionStats")`,
+			contains: []string{`"winningPlan":"FETCH > IXSCAN _id_"`, `"indexesUsed":["_id_"]`, `"totalKeysExamined":3`, `"totalDocsExamined":3`, `"nReturned":2`},
+		},
+		{
+			name:     "find with default verbosity",
+			query:    `db.collection.find().explain()`,
+			contains: []string{`"winningPlan":"COLLSCAN"`, `"indexesUsed":[]`},
+			excludes: []string{`totalDocsExamined`},
+		},
+		{
+			name:     "explain before find",
+			query:    `db.collection.explain(true).find({"_id":{"$gt":1}}).hint({"_id":1})`,
+			contains: []string{`"indexesUsed":["_id_"]`, `"totalDocsExamined":2`},
+		},
+		{
+			name:     "explain aggregate",
+			query:    `db.collection.explain("executionStats").aggregate([{"$match":{"k":1}},{"$project":{"_id":0}}])`,
+			contains: []string{`COLLSCAN`, `"totalDocsExamined":3`},
+		},
+		{
+			name:     "invalid verbosity",
+			query:    `db.collection.find().explain("verbose")`,
+			contains: []string{`fail to parse content of query: invalid verbosity for explain: verbose`},
+		},
+		{
+			name:     "explain with count",
+			query:    `db.collection.find().count().explain()`,
+			contains: []string{`query failed: explain() can't be used with count()`},
+		},
+		{
+			name:     "explain write method",
+			query:    `db.collection.explain().deleteOne({})`,
+			contains: []string{`query failed: explain() is only supported with find() and aggregate(), but was deleteOne()`},
+		},
+		{
+			name:     "explain not last",
+			query:    `db.collection.find().explain().limit(1)`,
+			contains: []string{`query failed: invalid method: explain`},
+		},
+	}
+
+	for _, tt := range runExplainTests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := url.Values{
+				"mode":   {"bson"},
+				"config": {`[{"_id":1,"k":1},{"_id":2,"k":2},{"_id":3,"k":3}]`},
+				"query":  {tt.query},
+			}
+			buf := httpBody(t, testServer.runHandler, http.MethodPost, "/run", params)
+			got := buf.String()
+			if strings.HasPrefix(got, "[") {
+				comp, err := bson.CompactJSON(buf.Bytes())
+				if err != nil {
+					t.Errorf("could not compact result: %s (%v)", buf.Bytes(), err)
+				}
+				got = string(comp)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected result to contain\n '%s'\n but got\n '%s'", want, got)
+				}
+			}
+			for _, notWant := range tt.excludes {
+				if strings.Contains(got, notWant) {
+					t.Errorf("expected result not to contain\n '%s'\n but got\n '%s'", notWant, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRunIndexes(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	runIndexesTests := []struct {
+		name     string
+		params   url.Values
+		contains string
+	}{
+		{
+			name: "unique index",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"collection":[{"_id":1,"k":1}],"indexes":{"collection":[{"key":{"k":1},"unique":true}]}}`},
+				"query":  {`db.collection.insertOne({"_id":2,"k":1})`},
+			},
+			contains: "query failed: E11000 duplicate key error collection: ",
+		},
+		{
+			name: "text index",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"collection":[{"_id":1,"t":"quick brown fox"},{"_id":2,"t":"lazy dog"}],"indexes":{"collection":[{"key":{"t":"text"}}]}}`},
+				"query":  {`db.collection.find({"$text":{"$search":"fox"}},{"_id":1})`},
+			},
+			contains: `[{"_id":1}]`,
+		},
+		{
+			name: "2dsphere index",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"collection":[{"_id":1,"loc":{"type":"Point","coordinates":[2,2]}},{"_id":2,"loc":{"type":"Point","coordinates":[1,1]}}],"indexes":{"collection":[{"key":{"loc":"2dsphere"}}]}}`},
+				"query":  {`db.collection.aggregate([{"$geoNear":{"near":{"type":"Point","coordinates":[0,0]},"distanceField":"d","spherical":true}},{"$project":{"_id":1}}])`},
+			},
+			contains: `[{"_id":2},{"_id":1}]`,
+		},
+		{
+			name: "compound index keeps key order",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"collection":[{"_id":1,"a":1,"b":1}],"indexes":{"collection":[{"key":{"b":1,"a":-1}}]}}`},
+				"query":  {`db.collection.find({"a":1,"b":1}).explain()`},
+			},
+			contains: `IXSCAN b_1_a_-1`,
+		},
+		{
+			name: "mgodatagen index",
+			params: url.Values{
+				"mode":   {"mgodatagen"},
+				"config": {`[{"collection":"collection","count":10,"content":{"k":{"type":"int","minInt":0,"maxInt":10}},"indexes":[{"name":"k_idx","key":{"k":1}}]}]`},
+				"query":  {`db.collection.find({"k":5}).explain()`},
+			},
+			contains: `IXSCAN k_idx`,
+		},
+		{
+			name: "collection named indexes",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"indexes":[{"_id":1}]}`},
+				"query":  {`db.indexes.find()`},
+			},
+			contains: `[{"_id":1}]`,
+		},
+		{
+			name: "index on unknown collection",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"collection":[{"_id":1}],"indexes":{"other":[{"key":{"k":1}}]}}`},
+				"query":  {`db.collection.find()`},
+			},
+			contains: "error in configuration:\n  can't create indexes on collection \"other\", as it doesn't exist",
+		},
+		{
+			name: "index without key",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"collection":[{"_id":1}],"indexes":{"collection":[{"unique":true}]}}`},
+				"query":  {`db.collection.find()`},
+			},
+			contains: "error in configuration:\n  invalid index: key is required",
+		},
+		{
+			name: "invalid index",
+			params: url.Values{
+				"mode":   {"bson"},
+				"config": {`db={"collection":[{"_id":1}],"indexes":{"collection":[{"key":{"k":"unknown"}}]}}`},
+				"query":  {`db.collection.find()`},
+			},
+			contains: "fail to create indexes on collection collection: ",
+		},
+	}
+
+	for _, tt := range runIndexesTests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := httpBody(t, testServer.runHandler, http.MethodPost, "/run", tt.params)
+			got := buf.String()
+			if strings.HasPrefix(got, "[") {
+				comp, err := bson.CompactJSON(buf.Bytes())
+				if err != nil {
+					t.Errorf("could not compact result: %s (%v)", buf.Bytes(), err)
+				}
+				got = string(comp)
+			}
+			if !strings.Contains(got, tt.contains) {
+				t.Errorf("expected result to contain\n '%s'\n but got\n '%s'", tt.contains, got)
+			}
+		})
+	}
+}
+
+func TestMongoVersion(t *testing.T) {
+
+	testServer.clearDatabases(t)
+
+	version := string(testServer.backends[0].version)
+	params := url.Values{
+		"mode":   {"bson"},
+		"config": {`[{"_id":1}]`},
+		"query":  {templateQuery},
+	}
+
+	// the default version and unknown versions are run against the
+	// default backend, in the same database as a run without version
+	for _, v := range []string{version, "1.0.0", ""} {
+		params.Set("mongoVersion", v)
+		buf := httpBody(t, testServer.runHandler, http.MethodPost, "/run", params)
+		if want, got := `[{"_id":1}]`, strings.TrimSuffix(buf.String(), "\n"); want != got {
+			t.Errorf("expected %s but got %s", want, got)
+		}
+	}
+
+	params.Set("mongoVersion", version)
+	withVersion := httpBody(t, testServer.saveHandler, http.MethodPost, "/save", params).String()
+	params.Set("mongoVersion", "1.0.0")
+	if want, got := withVersion, httpBody(t, testServer.saveHandler, http.MethodPost, "/save", params).String(); want != got {
+		t.Errorf("unknown version should be saved as default version %s, expected %s but got %s", version, want, got)
+	}
+	params.Del("mongoVersion")
+	if withoutVersion := httpBody(t, testServer.saveHandler, http.MethodPost, "/save", params).String(); withVersion == withoutVersion {
+		t.Errorf("the default version should be saved with the page, but got the url of a page without version %s", withoutVersion)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/"+withVersion, nil)
+	resp := httptest.NewRecorder()
+	testServer.viewHandler(resp, req)
+	if want := `<span id="version">` + version + `</span>`; !strings.Contains(resp.Body.String(), want) {
+		t.Errorf("expected page to contain %s, but got %s", want, resp.Body.String())
+	}
+	saved, err := testServer.storage.Get([]byte(strings.TrimPrefix(withVersion, "p/")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &page{}
+	if err := p.decode(saved); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := version, string(p.MongoVersion); want != got {
+		t.Errorf("expected page to be saved with version %s, but got %s", want, got)
+	}
+
+	testStorageContent(t, 1, 2)
+}
+
 func TestSave(t *testing.T) {
 
 	testServer.clearDatabases(t)
@@ -731,6 +1591,108 @@ func TestView(t *testing.T) {
 
 }
 
+func TestPageMetadata(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		logger:   log.New(ioutil.Discard, "", 0),
+		storage:  newMemoryStore(),
+		backends: []backend{{version: []byte("4.0.10")}, {version: []byte("3.6.12")}},
+	}
+	stored := func(id []byte) *page {
+		val, err := s.storage.Get(id)
+		if err != nil {
+			t.Fatalf("page %s should be saved: %v", id, err)
+		}
+		p := &page{}
+		if err := p.decode(val); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	before := time.Now().Unix()
+	id, err := s.save(&page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := stored(id)
+	if p.CreatedAt < before || p.CreatedAt > time.Now().Unix() {
+		t.Errorf("expected creation time to be now, but got %d", p.CreatedAt)
+	}
+	if want, got := "4.0.10", string(p.SavedVersion); want != got {
+		t.Errorf("expected page to be saved with version %s, but got %s", want, got)
+	}
+	if p.LastViewedAt != 0 || p.Views != 0 || p.Runs != 0 {
+		t.Errorf("a new page should not be viewed or run yet, but got %d views and %d runs", p.Views, p.Runs)
+	}
+
+	for i := 0; i < 2; i++ {
+		viewed, err := s.loadPage(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := "4.0.10", string(viewed.MongoVersion); want != got {
+			t.Errorf("expected page to be displayed with version %s, but got %s", want, got)
+		}
+		if want, got := uint64(i+1), viewed.Views; want != got {
+			t.Errorf("expected page to be displayed with %d views, but got %d", want, got)
+		}
+	}
+	if views := stored(id).Views; views != 0 {
+		t.Errorf("views should not be written before a flush, but got %d views", views)
+	}
+	s.flushCounters()
+	p = stored(id)
+	if p.Views != 2 || p.LastViewedAt < before {
+		t.Errorf("expected 2 views recorded, but got %d views, last one at %d", p.Views, p.LastViewedAt)
+	}
+
+	// the page is run with the version it was displayed with
+	s.countRun(&page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery), MongoVersion: []byte("4.0.10")})
+	// not saved
+	s.countRun(&page{Mode: bsonMode, Config: []byte(`[{"_id":2}]`), Query: []byte(templateQuery)})
+	s.flushCounters()
+	if want, got := uint64(1), stored(id).Runs; want != got {
+		t.Errorf("expected %d runs, but got %d", want, got)
+	}
+	if want, got := 1, s.countSavedPages(); want != got {
+		t.Errorf("counting runs should not save pages, expected %d pages, but got %d", want, got)
+	}
+
+	// saving it again keeps the metadata
+	_, err = s.save(&page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resaved := stored(id)
+	if resaved.CreatedAt != p.CreatedAt || resaved.LastViewedAt != p.LastViewedAt || resaved.Views != 2 || resaved.Runs != 1 {
+		t.Errorf("expected metadata to be kept, but got\n%+v", resaved)
+	}
+
+	if _, err := s.loadPage([]byte("random")); err == nil {
+		t.Errorf("expected an error for a page that doesn't exist")
+	}
+
+	// the version chosen is saved, even if it is the default one
+	versionID, err := s.save(&page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery), MongoVersion: []byte("4.0.3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(id, versionID) {
+		t.Errorf("a page saved with a version should not have the ID of the page saved without version")
+	}
+	if want, got := "4.0.10", string(stored(versionID).MongoVersion); want != got {
+		t.Errorf("expected page to be saved with version %s, but got %s", want, got)
+	}
+	s.countRun(&page{Mode: bsonMode, Config: []byte(`[{"_id":1}]`), Query: []byte(templateQuery), MongoVersion: []byte("4.0.10")})
+	s.flushCounters()
+	if want, got := uint64(1), stored(versionID).Runs; want != got {
+		t.Errorf("expected %d runs, but got %d", want, got)
+	}
+}
+
 func TestBasePage(t *testing.T) {
 
 	t.Parallel()
@@ -774,7 +1736,7 @@ func TestRemoveOldDB(t *testing.T) {
 	}
 	testServer.logger.Print(p.String())
 	DBHash := p.dbHash()
-	testServer.activeDB.Store(DBHash, time.Now().Add(-cleanupInterval).Unix())
+	testServer.activeDB.Store(DBHash, time.Now().Add(-testServer.config.cleanupInterval).Unix())
 	// this DB should not be removed
 	configFormat := `[{"collection": "collection%v","count": 10,"content": {}}]`
 	params.Set("config", fmt.Sprintf(configFormat, "other"))
@@ -901,6 +1863,7 @@ func TestHealthcheck(t *testing.T) {
 	resp := httptest.NewRecorder()
 	req, _ := http.NewRequest(http.MethodGet, "/_status/healthcheck", nil)
 
+	runs := observedRuns(testServer.metrics)
 	testServer.healthcheckHandler(resp, req)
 	if resp.Code != http.StatusOK {
 		t.Errorf("expected response code %v, got %v", http.StatusOK, resp.Code)
@@ -908,6 +1871,18 @@ func TestHealthcheck(t *testing.T) {
 	if want, got := string(statusOK), resp.Body.String(); want != got {
 		t.Errorf("expected response %s, but got %s", want, got)
 	}
+	if want, got := runs, observedRuns(testServer.metrics); want != got {
+		t.Errorf("healthcheck should not be recorded as a run, expected %d runs but got %d", want, got)
+	}
+}
+
+func observedRuns(m *metrics) (runs uint64) {
+	m.Lock()
+	defer m.Unlock()
+	for _, h := range m.runDuration {
+		runs += h.count
+	}
+	return runs
 }
 
 func TestHealthcheckServerError(t *testing.T) {
@@ -945,39 +1920,26 @@ func (s *server) clearDatabases(t *testing.T) error {
 	}
 	s.activeDB.Range(func(k, v interface{}) bool {
 		s.activeDB.Delete(k)
+		s.dbSizes.Delete(k)
 		return true
 	})
 
 	keys := make([][]byte, 0)
-	err = s.storage.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := make([]byte, len(item.Key()))
-			copy(key, item.Key())
-			keys = append(keys, key)
-		}
-		return err
+	err = s.storage.Iterate(func(key, value []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
 	})
 	if err != nil {
 		t.Error(err)
 	}
 
-	deleteTxn := s.storage.NewTransaction(true)
-	for i := 0; i < len(keys); i++ {
-		err = deleteTxn.Delete(keys[i])
+	for _, key := range keys {
+		err = s.storage.Delete(key)
 		if err != nil {
 			t.Error(err)
 		}
 	}
-	return deleteTxn.Commit(func(err error) {
-		if err != nil {
-			fmt.Printf("fail to delete: %v\n", err)
-		}
-	})
+	return err
 }
 
 func testStorageContent(t *testing.T, nbMongoDatabases, nbBadgerRecords int) {
@@ -1005,14 +1967,8 @@ func filterDBNames(dbNames []string) []string {
 }
 
 func (s *server) countSavedPages() (count int) {
-	s.storage.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			count++
-		}
+	s.storage.Iterate(func(key, value []byte) error {
+		count++
 		return nil
 	})
 	return count
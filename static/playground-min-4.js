@@ -1 +1 @@
-function compact(e){return format(e,!1)}function indent(e){return format(e,!0)}function format(e,r){var t="",n=!1,a=!1,i=0,s=0,c=e.charAt(s);for(e.startsWith("db.")&&(s=e.indexOf("(")+1,t+=e.substring(0,s));s<e.length;)if(" "!==(c=e.charAt(s))&&"\n"!==c&&"\t"!==c){switch(n&&"]"!==c&&"}"!==c&&(n=!1,i++,t+=r?newline(i):""),c){case"(":a=!0,t+=c;break;case")":a=!1,t+=c;break;case"{":case"[":n=!0,t+=c;break;case",":t+=c,r&&(t+=a?" ":newline(i));break;case":":t+=c,r&&(t+=" ");break;case"}":case"]":n?n=!1:(i--,t+=r?newline(i):""),t+=c;break;case'"':case"'":var f=c;for(t+='"',s++,c=e.charAt(s);c!==f&&s<e.length;)t+=c,s++,c=e.charAt(s);s!=e.length&&(t+='"');break;case"n":var h=e.substring(s,s+9);if("new Date("===h){for(t+=h,s+=h.length,c=e.charAt(s);")"!==c&&s<e.length;)t+=c,s++,c=e.charAt(s);s!=e.length&&(t+=")")}else t+=c;break;case"/":for(t+=c,s++,c=e.charAt(s);"/"!==c&&s<e.length;)t+=c,s++,c=e.charAt(s);s!=e.length&&(t+="/");break;default:t+=c}s++}else s++;return t}function newline(e){for(var r="\n",t=0;t<e;t++)r+="  ";return r}function formatConfig(e,r){if(!e.startsWith("[")||!e.endsWith("]")){if("bson"!==r)return"invalid";if(!/^\s*db\s*=\s*\{[\s\S]*\}$/.test(e))return"invalid"}return e}function formatQuery(e,r){var t=e;if(e.endsWith(";")&&(t=e.slice(0,-1)),!/^db\..(\w*)\.(find|aggregate)\([\s\S]*\)$/.test(t))return"invalid";var n=t.indexOf("(")+1;return query=t.substring(n,t.length-1),""===query||query.endsWith("}")||query.endsWith("]")?t:"invalid"}
\ No newline at end of file
+function compact(e){return format(e,!1)}function indent(e){return format(e,!0)}function format(e,r){var t="",n=!1,a=!1,i=0,s=0,c=e.charAt(s);for(e.startsWith("db.")&&(s=e.indexOf("(")+1,t+=e.substring(0,s));s<e.length;)if(" "!==(c=e.charAt(s))&&"\n"!==c&&"\t"!==c){switch(n&&"]"!==c&&"}"!==c&&(n=!1,i++,t+=r?newline(i):""),c){case"(":a=!0,t+=c;break;case")":a=!1,t+=c;break;case"{":case"[":n=!0,t+=c;break;case",":t+=c,r&&(t+=a?" ":newline(i));break;case":":t+=c,r&&(t+=" ");break;case";":t+=c,r&&(t+="\n");break;case"}":case"]":n?n=!1:(i--,t+=r?newline(i):""),t+=c;break;case'"':case"'":var f=c;for(t+='"',s++,c=e.charAt(s);c!==f&&s<e.length;)t+=c,s++,c=e.charAt(s);s!=e.length&&(t+='"');break;case"n":var h=e.substring(s,s+9);if("new Date("===h){for(t+=h,s+=h.length,c=e.charAt(s);")"!==c&&s<e.length;)t+=c,s++,c=e.charAt(s);s!=e.length&&(t+=")")}else t+=c;break;case"/":for(t+=c,s++,c=e.charAt(s);"/"!==c&&s<e.length;)t+=c,"\\"===c&&(s++,t+=e.charAt(s)),s++,c=e.charAt(s);s!=e.length&&(t+="/");break;default:t+=c}s++}else s++;return t}function newline(e){for(var r="\n",t=0;t<e;t++)r+="  ";return r}function formatConfig(e,r){if(!e.startsWith("[")||!e.endsWith("]")){if("bson"!==r)return"invalid";if(!/^\s*db\s*=\s*\{[\s\S]*\}$/.test(e))return"invalid"}return e}var cursorModifiers=["sort","limit","skip","count","hint","collation","pretty","toArray"];function formatQuery(e,r){var t=splitStatements(e);if(0===t.length)return"invalid";for(var n=0;n<t.length;n++)if("invalid"===formatStatement(t[n]))return"invalid";return t.join(";\n")}function formatStatement(t){var o=/^db\.\w+\.explain\(/.exec(t);if(null!==o){var l=closingParenthesis(t,o[0].length-1);return-1===l||"invalid"===formatStatement("db.collection"+t.substring(l+1))?"invalid":t}var u=/^db\..(\w*)\.(find|aggregate|insertOne|insertMany|updateOne|updateMany|deleteOne|deleteMany)\([\s\S]*\)$/.exec(t);if(null===u)return"invalid";var n=t.indexOf("(")+1,a=closingParenthesis(t,n-1);if(query=t.substring(n,a),""!==query&&!query.endsWith("}")&&!query.endsWith("]"))return"invalid";for(var i=t.substring(a+1);""!==i;){var s=/^\s*\.(\w+)\(/.exec(i);if(null===s)return"invalid";if(-1===(a=closingParenthesis(i,s[0].length-1)))return"invalid";if(i=i.substring(a+1),!("explain"===s[1]&&"find"===u[2]&&""===i.trim())&&!cursorModifiers.includes(s[1]))return"invalid"}return t}function splitStatements(e){for(var r=[],t=0,n=0,a=0;a<e.length;a++){var i=e.charAt(a);if("("===i||"{"===i||"["===i)t++;else if(")"===i||"}"===i||"]"===i)t--;else if('"'===i||"'"===i||"/"===i)for(a++;a<e.length&&e.charAt(a)!==i;)"\\"===e.charAt(a)&&a++,a++;else if((";"===i||"\n"===i)&&0===t){if("\n"===i&&e.substring(a).trim().startsWith("."))continue;var s=e.substring(n,a).trim();""!==s&&r.push(s),n=a+1}}var c=e.substring(n).trim();return""!==c&&r.push(c),r}function formatResult(e){return e.split("\n").map(function(e){return e.startsWith("[")?indent(e):e}).join("\n")}function closingParenthesis(e,r){for(var t=0,n=r;n<e.length;n++){var a=e.charAt(n);if("("===a)t++;else if(")"===a){if(0===--t)return n}else if('"'===a||"'"===a)for(n++;n<e.length&&e.charAt(n)!==a;)"\\"===e.charAt(n)&&n++,n++}return-1}
\ No newline at end of file
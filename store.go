@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+)
+
+// errPageNotFound is returned by PageStore.Get when no page
+// is stored under the requested key
+var errPageNotFound = errors.New("page not found")
+
+// PageStore persists saved playgrounds. Keys are page IDs, and
+// values encoded pages
+type PageStore interface {
+	// return the value stored under key, or errPageNotFound
+	Get(key []byte) ([]byte, error)
+	// store value under key, replacing the existing value if any
+	Put(key, value []byte) error
+	// remove the value stored under key. Deleting a missing key is
+	// not an error
+	Delete(key []byte) error
+	// call fn for each key/value pair of the store, and stop at the
+	// first error. Slices passed to fn are only valid until fn returns
+	Iterate(fn func(key, value []byte) error) error
+	// write the content of the store to w. All stores share the same
+	// format, described in writeBackup, so a backup can be loaded in any
+	// kind of store. For a badger store, this is not a badger backup, and
+	// it can't be restored with badger tools
+	Backup(w io.Writer) error
+	// load the content of a backup created by Backup
+	Load(r io.Reader) error
+	// return the number of pages in the store and its size
+	Stats() (StoreStats, error)
+	// reclaim the space used by deleted pages
+	Compact() error
+	Close() error
+}
+
+// StoreStats describes the content of a PageStore
+type StoreStats struct {
+	Pages int
+	// size of the store on disk, or in memory, in bytes
+	Bytes int64
+}
+
+// create the store of the kind set in the configuration
+func newStore(c *config) (PageStore, error) {
+	switch c.storage {
+	case "badger":
+		return newBadgerStore(c.badgerDir)
+	case "filesystem":
+		return newFilesystemStore(c.pagesDir)
+	case "memory":
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown storage %s, expected badger, filesystem or memory", c.storage)
+}
+
+// a PageStore backed by badger
+type badgerStore struct {
+	db *badger.DB
+	// number of pages, counted when the store is opened and kept up
+	// to date by Put and Delete, so that Stats doesn't read all keys
+	mu    sync.Mutex
+	pages int
+}
+
+func newBadgerStore(dir string) (*badgerStore, error) {
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	b := &badgerStore{db: db}
+	b.pages, err = b.countPages()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// only keys are read to count pages
+func (b *badgerStore) countPages() (pages int, err error) {
+	err = b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			pages++
+		}
+		return nil
+	})
+	return pages, err
+}
+
+// tell whether key is stored. Reading the key in an update makes the
+// transaction conflict with concurrent writes of the same key
+func exists(txn *badger.Txn, key []byte) (bool, error) {
+	_, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *badgerStore) addPages(n int) {
+	b.mu.Lock()
+	b.pages += n
+	b.mu.Unlock()
+}
+
+func (b *badgerStore) Get(key []byte) (value []byte, err error) {
+	err = b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return errPageNotFound
+		}
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return value, err
+}
+
+func (b *badgerStore) Put(key, value []byte) error {
+	var found bool
+	err := b.db.Update(func(txn *badger.Txn) (err error) {
+		found, err = exists(txn, key)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, value)
+	})
+	if err == nil && !found {
+		b.addPages(1)
+	}
+	return err
+}
+
+func (b *badgerStore) Delete(key []byte) error {
+	var found bool
+	err := b.db.Update(func(txn *badger.Txn) (err error) {
+		found, err = exists(txn, key)
+		if err != nil || !found {
+			return err
+		}
+		return txn.Delete(key)
+	})
+	if err == nil && found {
+		b.addPages(-1)
+	}
+	return err
+}
+
+func (b *badgerStore) Iterate(fn func(key, value []byte) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if err := fn(item.Key(), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// badger's own backup is not used, as it keeps deleted keys
+func (b *badgerStore) Backup(w io.Writer) error {
+	return writeBackup(b, w)
+}
+
+func (b *badgerStore) Load(r io.Reader) error {
+	return readBackup(b, r)
+}
+
+// the size reported by badger is only refreshed periodically
+func (b *badgerStore) Stats() (StoreStats, error) {
+	lsm, vlog := b.db.Size()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return StoreStats{Pages: b.pages, Bytes: lsm + vlog}, nil
+}
+
+// run the garbage collection of the value log until there is
+// nothing left to rewrite
+func (b *badgerStore) Compact() error {
+	for {
+		err := b.db.RunValueLogGC(0.5)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *badgerStore) Close() error {
+	return b.db.Close()
+}
+
+// a PageStore keeping pages in memory, mostly useful for tests
+type memoryStore struct {
+	mu    sync.RWMutex
+	pages map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		pages: map[string][]byte{},
+	}
+}
+
+func (m *memoryStore) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.pages[string(key)]
+	if !ok {
+		return nil, errPageNotFound
+	}
+	return value, nil
+}
+
+func (m *memoryStore) Put(key, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pages[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryStore) Delete(key []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.pages, string(key))
+	return nil
+}
+
+// pages are iterated in key order, like with badger. The store is not
+// locked while fn runs, so fn may modify the store
+func (m *memoryStore) Iterate(fn func(key, value []byte) error) error {
+	m.mu.RLock()
+	keys := make(sort.StringSlice, 0, len(m.pages))
+	for key := range m.pages {
+		keys = append(keys, key)
+	}
+	m.mu.RUnlock()
+	keys.Sort()
+
+	for _, key := range keys {
+		value, err := m.Get([]byte(key))
+		if err == errPageNotFound {
+			continue
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) Backup(w io.Writer) error {
+	return writeBackup(m, w)
+}
+
+func (m *memoryStore) Load(r io.Reader) error {
+	return readBackup(m, r)
+}
+
+func (m *memoryStore) Stats() (StoreStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stats := StoreStats{Pages: len(m.pages)}
+	for key, value := range m.pages {
+		stats.Bytes += int64(len(key) + len(value))
+	}
+	return stats, nil
+}
+
+func (m *memoryStore) Compact() error {
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// a PageStore keeping each page in its own file. File names
+// are the hex encoded keys
+type filesystemStore struct {
+	dir string
+}
+
+func newFilesystemStore(dir string) (*filesystemStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemStore{dir: dir}, nil
+}
+
+func (f *filesystemStore) path(key []byte) string {
+	return filepath.Join(f.dir, hex.EncodeToString(key))
+}
+
+func (f *filesystemStore) Get(key []byte) ([]byte, error) {
+	value, err := ioutil.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, errPageNotFound
+	}
+	return value, err
+}
+
+// the page is first written to a temporary file, so a page is
+// never partially written
+func (f *filesystemStore) Put(key, value []byte) error {
+	tmp, err := ioutil.TempFile(f.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (f *filesystemStore) Delete(key []byte) error {
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *filesystemStore) Iterate(fn func(key, value []byte) error) error {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		key, err := hex.DecodeString(file.Name())
+		if err != nil || file.IsDir() {
+			// not a page, like a temporary file
+			continue
+		}
+		value, err := f.Get(key)
+		if err == errPageNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *filesystemStore) Backup(w io.Writer) error {
+	return writeBackup(f, w)
+}
+
+func (f *filesystemStore) Load(r io.Reader) error {
+	return readBackup(f, r)
+}
+
+func (f *filesystemStore) Stats() (stats StoreStats, err error) {
+	files, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return stats, err
+	}
+	for _, file := range files {
+		if _, err := hex.DecodeString(file.Name()); err != nil || file.IsDir() {
+			continue
+		}
+		stats.Pages++
+		stats.Bytes += file.Size()
+	}
+	return stats, nil
+}
+
+func (f *filesystemStore) Compact() error {
+	return nil
+}
+
+func (f *filesystemStore) Close() error {
+	return nil
+}
+
+// write the content of store to w. Each page is written as:
+//
+// uvarint -> the length of the key
+// key
+// uvarint -> the length of the value
+// value
+func writeBackup(store PageStore, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var n [binary.MaxVarintLen64]byte
+	err := store.Iterate(func(key, value []byte) error {
+		for _, b := range [][]byte{key, value} {
+			bw.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))])
+			if _, err := bw.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// max size of a key or a value in a backup, far above the size of any page
+const maxBackupFieldSize = 16 << 20
+
+// load in store a backup created by writeBackup
+func readBackup(store PageStore, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		key, err := readBackupField(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := readBackupField(br)
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if err := store.Put(key, value); err != nil {
+			return err
+		}
+	}
+}
+
+func readBackupField(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBackupFieldSize {
+		return nil, fmt.Errorf("invalid backup: field of %d bytes", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(br, b)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPageStore(t *testing.T) {
+
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("fail to create storage directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	storeTests := []struct {
+		name     string
+		newStore func(name string) (PageStore, error)
+	}{
+		{
+			name: "memory",
+			newStore: func(name string) (PageStore, error) {
+				return newMemoryStore(), nil
+			},
+		},
+		{
+			name: "filesystem",
+			newStore: func(name string) (PageStore, error) {
+				return newFilesystemStore(dir + "/filesystem-" + name)
+			},
+		},
+		{
+			name: "badger",
+			newStore: func(name string) (PageStore, error) {
+				return newBadgerStore(dir + "/badger-" + name)
+			},
+		},
+	}
+
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			store, err := tt.newStore("store")
+			if err != nil {
+				t.Fatalf("fail to create store: %v", err)
+			}
+			defer store.Close()
+
+			for _, key := range []string{"b", "a", "c"} {
+				if err := store.Put([]byte(key), []byte("value "+key)); err != nil {
+					t.Errorf("fail to put %s: %v", key, err)
+				}
+			}
+			store.Put([]byte("c"), []byte("new value c"))
+
+			if err := store.Delete([]byte("b")); err != nil {
+				t.Errorf("fail to delete b: %v", err)
+			}
+			if err := store.Delete([]byte("missing")); err != nil {
+				t.Errorf("deleting a missing key should not fail, but got %v", err)
+			}
+			if _, err := store.Get([]byte("b")); err != errPageNotFound {
+				t.Errorf("expected %v, but got %v", errPageNotFound, err)
+			}
+
+			if want, got := "a:value a,c:new value c,", storeContent(t, store); want != got {
+				t.Errorf("expected content %s, but got %s", want, got)
+			}
+
+			stats, err := store.Stats()
+			if err != nil {
+				t.Errorf("fail to get stats of store: %v", err)
+			}
+			if stats.Pages != 2 {
+				t.Errorf("expected 2 pages, but got %d", stats.Pages)
+			}
+
+			if err := store.Compact(); err != nil {
+				t.Errorf("fail to compact store: %v", err)
+			}
+			if want, got := "a:value a,c:new value c,", storeContent(t, store); want != got {
+				t.Errorf("expected content after compaction %s, but got %s", want, got)
+			}
+
+			var backup bytes.Buffer
+			if err := store.Backup(&backup); err != nil {
+				t.Errorf("fail to backup store: %v", err)
+			}
+			restored, err := tt.newStore("restored")
+			if err != nil {
+				t.Fatalf("fail to create store: %v", err)
+			}
+			defer restored.Close()
+			if err := restored.Load(&backup); err != nil {
+				t.Errorf("fail to load backup: %v", err)
+			}
+			if want, got := "a:value a,c:new value c,", storeContent(t, restored); want != got {
+				t.Errorf("expected restored content %s, but got %s", want, got)
+			}
+			stats, err = restored.Stats()
+			if err != nil {
+				t.Errorf("fail to get stats of restored store: %v", err)
+			}
+			if stats.Pages != 2 {
+				t.Errorf("expected 2 restored pages, but got %d", stats.Pages)
+			}
+		})
+	}
+}
+
+func TestLoadInvalidBackup(t *testing.T) {
+
+	t.Parallel()
+
+	invalidTests := []struct {
+		name   string
+		backup string
+	}{
+		{
+			name:   "missing value",
+			backup: "\x01a",
+		},
+		{
+			name:   "truncated value",
+			backup: "\x01a\x05val",
+		},
+		{
+			name:   "field too large",
+			backup: "\x01a\xff\xff\xff\xff\x0f",
+		},
+	}
+
+	for _, tt := range invalidTests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newMemoryStore().Load(bytes.NewBufferString(tt.backup))
+			if err == nil {
+				t.Errorf("expected an error when loading %q", tt.backup)
+			}
+		})
+	}
+}
+
+// return the content of store as "key:value," pairs
+func storeContent(t *testing.T, store PageStore) string {
+	var buf bytes.Buffer
+	err := store.Iterate(func(key, value []byte) error {
+		fmt.Fprintf(&buf, "%s:%s,", key, value)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("fail to iterate over store: %v", err)
+	}
+	return buf.String()
+}
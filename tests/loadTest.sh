@@ -1,3 +1,5 @@
+# the server should be started with -rateLimit 0, otherwise most requests get a 429
+
 echo "/run on same database, 100 documents:\n"
 echo "POST http://localhost:80/run?config=%5B%7B%22collection%22%3A%22collection%22%2C%22count%22%3A100%2C%22content%22%3A%7B%22fieldName%22%3A%7B%22type%22%3A%22string%22%2C%22minLength%22%3A5%2C%22maxLength%22%3A10%7D%7D%7D%5D&query=db.collection.find()" | vegeta attack -duration=5s | tee results.bin | vegeta report
 
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits on the traffic a client can send, and on the load
+// it can put on mongodb
+type trafficLimits struct {
+	// number of requests to /run and /save allowed per second for
+	// each client, or 0 for no limit
+	requestsPerSecond float64
+	// number of requests a client can send at once before being
+	// throttled
+	burst int
+	// max number of databases created at the same time, or 0
+	// for no limit
+	maxDBCreations int
+	// how long a run waits for another database creation to complete
+	// before giving up
+	dbCreationWait time.Duration
+	// reverse proxies allowed to set the IP of the client in the
+	// X-Forwarded-For header. Empty to ignore the header
+	trustedProxies []*net.IPNet
+}
+
+var defaultTrafficLimits = trafficLimits{
+	requestsPerSecond: 2,
+	burst:             10,
+	maxDBCreations:    4,
+	dbCreationWait:    10 * time.Second,
+}
+
+// error returned when a request is rejected because the client or
+// the server is too busy, and should be retried later
+type throttledError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("%s, retry in %v", e.reason, time.Duration(e.retryAfterSeconds())*time.Second)
+}
+
+// value of the Retry-After header, at least 1 second
+func (e *throttledError) retryAfterSeconds() int {
+	return int(math.Max(1, math.Ceil(e.retryAfter.Seconds())))
+}
+
+// token bucket for a client: each request takes a token, and
+// tokens are refilled at a constant rate
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// per client rate limiter, clients are identified by their IP
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	clients map[string]*bucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clients: map[string]*bucket{},
+	}
+}
+
+// take a token from the bucket of the client, or return a throttledError
+// if the bucket is empty
+func (l *rateLimiter) allow(client string, now time.Time) error {
+
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return nil
+	}
+	return &throttledError{
+		reason:     "too many requests",
+		retryAfter: time.Duration((1 - b.tokens) / l.rate * float64(time.Second)),
+	}
+}
+
+// how often clients are pruned: the time it takes to refill an empty
+// bucket, so that only clients seen during this time are tracked, but
+// at least a second. 0 if rate limiting is disabled
+func (l *rateLimiter) pruneInterval() time.Duration {
+	if l == nil || l.rate <= 0 {
+		return 0
+	}
+	return time.Duration(math.Max(1, l.burst/l.rate) * float64(time.Second))
+}
+
+// forget clients whose bucket is full again, as they behave
+// like new clients
+func (l *rateLimiter) prune(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// IP of the client sending the request. When the request comes from a
+// trusted proxy, the client is the last IP of the X-Forwarded-For header
+// that is not a trusted proxy, as the ones before it may be forged by
+// the client
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrusted(host, trustedProxies) {
+		return host
+	}
+
+	var hops []string
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !isTrusted(hop, trustedProxies) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrusted(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse the trusted proxies, given as IPs like 10.0.0.1 or CIDRs like
+// 10.0.0.0/8
+func parseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	proxies := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if strings.Contains(v, "/") {
+			_, n, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %s, expected an IP or a CIDR like 10.0.0.0/8", v)
+			}
+			proxies = append(proxies, n)
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s, expected an IP or a CIDR like 10.0.0.0/8", v)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return proxies, nil
+}
+
+// reject requests of clients exceeding the rate limit
+func (s *server) rateLimited(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.rateLimiter.allow(clientIP(r, s.config.traffic.trustedProxies), time.Now()); err != nil {
+			s.writeThrottled(w, r, err.(*throttledError))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// write a 429 response with a Retry-After header, in json for
+// requests to the api
+func (s *server) writeThrottled(w http.ResponseWriter, r *http.Request, e *throttledError) {
+	s.metrics.throttledRequest()
+	w.Header().Set("Retry-After", strconv.Itoa(e.retryAfterSeconds()))
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		s.apiWriteError(w, http.StatusTooManyRequests, tooManyRequestsError, e.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(e.Error()))
+}
+
+// wait for a slot to create a database. Requests are queued until
+// a slot is released, or until dbCreationWait is elapsed
+func (s *server) acquireDBCreation() error {
+	if s.dbCreations == nil {
+		return nil
+	}
+	timer := time.NewTimer(s.config.traffic.dbCreationWait)
+	defer timer.Stop()
+	select {
+	case s.dbCreations <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return &throttledError{
+			reason:     "too many databases are being created",
+			retryAfter: s.config.traffic.dbCreationWait,
+		}
+	}
+}
+
+func (s *server) releaseDBCreation() {
+	if s.dbCreations != nil {
+		<-s.dbCreations
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+
+	t.Parallel()
+
+	start := time.Now()
+	l := newRateLimiter(2, 2)
+
+	rateLimiterTests := []struct {
+		name    string
+		client  string
+		elapsed time.Duration
+		allowed bool
+	}{
+		{name: "first request", client: "1.1.1.1", allowed: true},
+		{name: "burst", client: "1.1.1.1", allowed: true},
+		{name: "bucket empty", client: "1.1.1.1", allowed: false},
+		{name: "other client", client: "2.2.2.2", allowed: true},
+		{name: "one token refilled", client: "1.1.1.1", elapsed: 500 * time.Millisecond, allowed: true},
+		{name: "bucket empty again", client: "1.1.1.1", elapsed: 500 * time.Millisecond, allowed: false},
+	}
+
+	for _, tt := range rateLimiterTests {
+		err := l.allow(tt.client, start.Add(tt.elapsed))
+		if tt.allowed != (err == nil) {
+			t.Errorf("%s: expected allowed to be %v, but got error %v", tt.name, tt.allowed, err)
+		}
+	}
+
+	l.prune(start.Add(time.Second))
+	if _, ok := l.clients["2.2.2.2"]; ok {
+		t.Error("expected client with a full bucket to be pruned")
+	}
+	if _, ok := l.clients["1.1.1.1"]; !ok {
+		t.Error("expected client with an empty bucket to be kept")
+	}
+}
+
+func TestPruneClients(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		logger:      log.New(ioutil.Discard, "", 0),
+		storage:     newMemoryStore(),
+		rateLimiter: newRateLimiter(2, 1),
+		config:      &config{},
+		stopCleanup: make(chan struct{}),
+		cleanupDone: make(chan struct{}),
+	}
+	if want, got := time.Second, s.rateLimiter.pruneInterval(); want != got {
+		t.Errorf("expected clients to be pruned every %v, but got %v", want, got)
+	}
+	// databases are dropped long after idle clients are forgotten
+	go s.cleanupLoop(time.Hour)
+	defer func() {
+		close(s.stopCleanup)
+		<-s.cleanupDone
+	}()
+
+	for i := 0; i < 100; i++ {
+		s.rateLimiter.allow(fmt.Sprintf("10.0.0.%d", i), time.Now())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.rateLimiter.Lock()
+		n := len(s.rateLimiter.clients)
+		s.rateLimiter.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected idle clients to be pruned, but %d clients are still tracked", n)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if want, got := time.Duration(0), newRateLimiter(0, 10).pruneInterval(); want != got {
+		t.Errorf("expected no prune without rate limiting, but got an interval of %v", got)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		logger:      log.New(ioutil.Discard, "", 0),
+		rateLimiter: newRateLimiter(0.5, 1),
+		metrics:     newMetrics(),
+		config:      &config{},
+	}
+	handler := s.rateLimited(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	rateLimitedTests := []struct {
+		name         string
+		url          string
+		responseCode int
+		retryAfter   string
+		body         string
+	}{
+		{
+			name:         "allowed",
+			url:          "/run",
+			responseCode: http.StatusOK,
+			body:         "ok",
+		},
+		{
+			name:         "throttled",
+			url:          "/run",
+			responseCode: http.StatusTooManyRequests,
+			retryAfter:   "2",
+			body:         "too many requests, retry in 2s",
+		},
+		{
+			name:         "throttled api",
+			url:          "/api/v1/run",
+			responseCode: http.StatusTooManyRequests,
+			retryAfter:   "2",
+			body:         `{"error":{"kind":"tooManyRequests","message":"too many requests, retry in 2s"}}` + "\n",
+		},
+	}
+
+	for _, tt := range rateLimitedTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, tt.url, nil)
+			req.RemoteAddr = "1.1.1.1:1234"
+			resp := httptest.NewRecorder()
+			handler(resp, req)
+
+			if tt.responseCode != resp.Code {
+				t.Errorf("expected response code %d, but got %d", tt.responseCode, resp.Code)
+			}
+			if want, got := tt.retryAfter, resp.Header().Get("Retry-After"); want != got {
+				t.Errorf("expected Retry-After '%s', but got '%s'", want, got)
+			}
+			if want, got := tt.body, resp.Body.String(); want != got {
+				t.Errorf("expected body\n'%s'\nbut got\n'%s'", want, got)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+
+	t.Parallel()
+
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientIPTests := []struct {
+		name           string
+		remoteAddr     string
+		forwardedFor   []string
+		trustedProxies []*net.IPNet
+		ip             string
+	}{
+		{
+			name:       "no proxy",
+			remoteAddr: "1.1.1.1:1234",
+			ip:         "1.1.1.1",
+		},
+		{
+			name:         "header ignored by default",
+			remoteAddr:   "10.0.0.1:1234",
+			forwardedFor: []string{"1.1.1.1"},
+			ip:           "10.0.0.1",
+		},
+		{
+			name:           "header ignored from untrusted address",
+			remoteAddr:     "2.2.2.2:1234",
+			forwardedFor:   []string{"1.1.1.1"},
+			trustedProxies: trusted,
+			ip:             "2.2.2.2",
+		},
+		{
+			name:           "trusted proxy",
+			remoteAddr:     "10.0.0.1:1234",
+			forwardedFor:   []string{"1.1.1.1"},
+			trustedProxies: trusted,
+			ip:             "1.1.1.1",
+		},
+		{
+			name:           "forged header",
+			remoteAddr:     "192.168.1.1:1234",
+			forwardedFor:   []string{"3.3.3.3, 1.1.1.1"},
+			trustedProxies: trusted,
+			ip:             "1.1.1.1",
+		},
+		{
+			name:           "chain of trusted proxies",
+			remoteAddr:     "10.0.0.1:1234",
+			forwardedFor:   []string{"3.3.3.3, 1.1.1.1", "192.168.1.1"},
+			trustedProxies: trusted,
+			ip:             "1.1.1.1",
+		},
+		{
+			name:           "missing header",
+			remoteAddr:     "10.0.0.1:1234",
+			trustedProxies: trusted,
+			ip:             "10.0.0.1",
+		},
+	}
+
+	for _, tt := range clientIPTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/run", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, h := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", h)
+			}
+			if want, got := tt.ip, clientIP(req, tt.trustedProxies); want != got {
+				t.Errorf("expected client IP %s, but got %s", want, got)
+			}
+		})
+	}
+}
+
+func TestDBCreationQueue(t *testing.T) {
+
+	t.Parallel()
+
+	s := &server{
+		config:      &config{traffic: trafficLimits{dbCreationWait: 10 * time.Millisecond}},
+		dbCreations: make(chan struct{}, 1),
+	}
+
+	if err := s.acquireDBCreation(); err != nil {
+		t.Fatalf("expected a free slot, but got %v", err)
+	}
+	err := s.acquireDBCreation()
+	if want := "too many databases are being created, retry in 1s"; err == nil || want != err.Error() {
+		t.Errorf("expected error %s, but got %v", want, err)
+	}
+
+	// queued requests get the slot once it's released
+	s.config.traffic.dbCreationWait = time.Second
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.releaseDBCreation()
+	}()
+	if err := s.acquireDBCreation(); err != nil {
+		t.Errorf("expected to get the released slot, but got %v", err)
+	}
+}
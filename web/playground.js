@@ -59,6 +59,12 @@ function format(src, indent) {
                     result += " "
                 }
                 break
+            case ";":
+                result += c
+                if (indent) {
+                    result += "\n"
+                }
+                break
             case "}":
             case "]":
                 if (needIndent) {
@@ -108,6 +114,10 @@ function format(src, indent) {
                 c = src.charAt(i)
                 while (c !== "/" && i < src.length) {
                     result += c
+                    if (c === "\\") {
+                        i++
+                        result += src.charAt(i)
+                    }
                     i++
                     c = src.charAt(i)
                 }
@@ -145,20 +155,133 @@ function formatConfig(content, mode) {
     return content
 }
 
+// methods that can be chained after find()
+var cursorModifiers = ["sort", "limit", "skip", "count", "hint", "collation", "pretty", "toArray"]
+
 function formatQuery(content, mode) {
-    var result = content
-    if (content.endsWith(";")) {
-        result = content.slice(0, -1)
+    var statements = splitStatements(content)
+    if (statements.length === 0) {
+        return "invalid"
+    }
+    for (var i = 0; i < statements.length; i++) {
+        if (formatStatement(statements[i]) === "invalid") {
+            return "invalid"
+        }
     }
-    var correctQuery = /^db\..(\w*)\.(find|aggregate)\([\s\S]*\)$/.test(result)
-    if (!correctQuery) {
+    return statements.join(";\n")
+}
+
+function formatStatement(result) {
+    // db.collection.explain().find(...)
+    var explain = /^db\.\w+\.explain\(/.exec(result)
+    if (explain !== null) {
+        var end = closingParenthesis(result, explain[0].length - 1)
+        if (end === -1 || formatStatement("db.collection" + result.substring(end + 1)) === "invalid") {
+            return "invalid"
+        }
+        return result
+    }
+
+    var correctQuery = /^db\..(\w*)\.(find|aggregate|insertOne|insertMany|updateOne|updateMany|deleteOne|deleteMany)\([\s\S]*\)$/.exec(result)
+    if (correctQuery === null) {
         return "invalid"
     }
 
-    var start = result.indexOf("(") +1
-    query = result.substring(start, result.length-1)
+    var start = result.indexOf("(") + 1
+    var end = closingParenthesis(result, start - 1)
+    query = result.substring(start, end)
     if (query !== "" && !query.endsWith("}") && !query.endsWith("]")) {
         return "invalid"
     }
+
+    var rest = result.substring(end + 1)
+    while (rest !== "") {
+        var modifier = /^\s*\.(\w+)\(/.exec(rest)
+        if (modifier === null) {
+            return "invalid"
+        }
+        end = closingParenthesis(rest, modifier[0].length - 1)
+        if (end === -1) {
+            return "invalid"
+        }
+        rest = rest.substring(end + 1)
+        // explain() has to be the last method chained after find()
+        var isExplain = modifier[1] === "explain" && correctQuery[2] === "find" && rest.trim() === ""
+        if (!isExplain && !cursorModifiers.includes(modifier[1])) {
+            return "invalid"
+        }
+    }
     return result
 }
+
+// split a script into its statements. Statements are separated by ';'
+// or by a new line, unless the next line starts with a chained call
+function splitStatements(src) {
+    var statements = []
+    var depth = 0
+    var start = 0
+    for (var i = 0; i < src.length; i++) {
+        var c = src.charAt(i)
+        if (c === "(" || c === "{" || c === "[") {
+            depth++
+        } else if (c === ")" || c === "}" || c === "]") {
+            depth--
+        } else if (c === "\"" || c === "'" || c === "/") {
+            i++
+            while (i < src.length && src.charAt(i) !== c) {
+                if (src.charAt(i) === "\\") {
+                    i++
+                }
+                i++
+            }
+        } else if ((c === ";" || c === "\n") && depth === 0) {
+            if (c === "\n" && src.substring(i).trim().startsWith(".")) {
+                continue
+            }
+            var statement = src.substring(start, i).trim()
+            if (statement !== "") {
+                statements.push(statement)
+            }
+            start = i + 1
+        }
+    }
+    var last = src.substring(start).trim()
+    if (last !== "") {
+        statements.push(last)
+    }
+    return statements
+}
+
+// results of a script are labelled by the position of the statement,
+// so indent each line holding documents
+function formatResult(response) {
+    return response.split("\n").map(function (line) {
+        return line.startsWith("[") ? indent(line) : line
+    }).join("\n")
+}
+
+// return the position of the parenthesis closing the one at
+// src[start], ignoring parenthesis in strings
+function closingParenthesis(src, start) {
+    var depth = 0
+    for (var i = start; i < src.length; i++) {
+        var c = src.charAt(i)
+        if (c === "(") {
+            depth++
+        } else if (c === ")") {
+            depth--
+            if (depth === 0) {
+                return i
+            }
+        } else if (c === "\"" || c === "'") {
+            i++
+            while (i < src.length && src.charAt(i) !== c) {
+                if (src.charAt(i) === "\\") {
+                    i++
+                }
+                i++
+            }
+        }
+    }
+    return -1
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// result of an insert / update / delete command
+type writeResult struct {
+	WriteErrors []struct {
+		Index  int    `bson:"index"`
+		Code   int    `bson:"code"`
+		Errmsg string `bson:"errmsg"`
+	} `bson:"writeErrors"`
+}
+
+// runWrite runs a write method against the collection. Writes are sent as raw
+// commands, so update pipelines, arrayFilters or collation are passed as is
+// to mongodb. Like reads, writes are bounded by the limits l, and the collection
+// can't grow beyond maxDocs and maxCollectionBytes
+func runWrite(collection *mgo.Collection, method string, args []interface{}, l runLimits) error {
+
+	var cmd bson.D
+
+	switch method {
+	case "insertOne", "insertMany":
+		docs, err := insertedDocs(collection, method, args, l)
+		if err != nil {
+			return err
+		}
+		cmd = bson.D{
+			{Name: "insert", Value: collection.Name},
+			{Name: "documents", Value: docs},
+		}
+	case "updateOne", "updateMany":
+		if len(args) < 2 {
+			return fmt.Errorf("%s requires a filter and an update document or pipeline", method)
+		}
+		update := bson.M{
+			"q":     args[0],
+			"u":     args[1],
+			"multi": method == "updateMany",
+		}
+		if err := copyOptions(update, args[2:], "upsert", "arrayFilters", "collation", "hint"); err != nil {
+			return err
+		}
+		cmd = bson.D{
+			{Name: "update", Value: collection.Name},
+			{Name: "updates", Value: []bson.M{update}},
+		}
+	case "deleteOne", "deleteMany":
+		if len(args) < 1 {
+			return fmt.Errorf("%s requires a filter", method)
+		}
+		limit := 0
+		if method == "deleteOne" {
+			limit = 1
+		}
+		del := bson.M{
+			"q":     args[0],
+			"limit": limit,
+		}
+		if err := copyOptions(del, args[1:], "collation", "hint"); err != nil {
+			return err
+		}
+		cmd = bson.D{
+			{Name: "delete", Value: collection.Name},
+			{Name: "deletes", Value: []bson.M{del}},
+		}
+	default:
+		return fmt.Errorf("invalid method: %s", method)
+	}
+
+	cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: l.maxTimeMS()})
+
+	var result writeResult
+	err := collection.Database.Run(cmd, &result)
+	if err != nil {
+		return l.check(err)
+	}
+	if len(result.WriteErrors) > 0 {
+		return errors.New(result.WriteErrors[0].Errmsg)
+	}
+	// updates and upserts can make the collection grow too
+	return l.checkCollection(collection)
+}
+
+// make sure that the collection doesn't hold more than maxDocs documents
+// or maxCollectionBytes bytes
+func (l runLimits) checkCollection(collection *mgo.Collection) error {
+	var stats struct {
+		Count int     `bson:"count"`
+		Size  float64 `bson:"size"`
+	}
+	err := collection.Database.Run(bson.D{{Name: "collStats", Value: collection.Name}}, &stats)
+	if err != nil {
+		return err
+	}
+	if stats.Count > l.maxDocs {
+		return &queryLimitError{reason: fmt.Sprintf("collection contains more than %d documents", l.maxDocs)}
+	}
+	if int(stats.Size) > l.maxCollectionBytes {
+		return &queryLimitError{reason: fmt.Sprintf("collection is larger than %d bytes", l.maxCollectionBytes)}
+	}
+	return nil
+}
+
+// return the documents to insert. Documents without _id get a deterministic
+// ObjectId, following the ones generated when the database was created
+func insertedDocs(collection *mgo.Collection, method string, args []interface{}, l runLimits) ([]interface{}, error) {
+
+	if len(args) < 1 {
+		return nil, fmt.Errorf("%s requires a document to insert", method)
+	}
+
+	docs := []interface{}{args[0]}
+	if method == "insertMany" {
+		d, ok := args[0].([]interface{})
+		if !ok {
+			return nil, errors.New("insertMany requires an array of documents")
+		}
+		docs = d
+	}
+
+	count, err := collection.Count()
+	if err != nil {
+		return nil, err
+	}
+	if count+len(docs) > l.maxDocs {
+		return nil, &queryLimitError{reason: fmt.Sprintf("max number of documents in a collection is %d, but was %d", l.maxDocs, count+len(docs))}
+	}
+
+	seed := nextSeed(collection.Database)
+	for i, d := range docs {
+		doc, ok := d.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("document to insert must be an object, but was %v", d)
+		}
+		if _, hasID := doc["_id"]; !hasID {
+			doc["_id"] = seededObjectID(seed + int32(i))
+		}
+	}
+	return docs, nil
+}
+
+// return the next n for which seededObjectID(n) is not used yet in
+// the database
+func nextSeed(db *mgo.Database) int32 {
+
+	names, err := db.CollectionNames()
+	if err != nil {
+		return 0
+	}
+
+	selector := bson.M{
+		"_id": bson.M{
+			"$gte": seededObjectID(0),
+			"$lte": seededObjectID(1<<24 - 1),
+		},
+	}
+
+	next := int32(0)
+	for _, name := range names {
+		var doc struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+		err := db.C(name).Find(selector).Sort("-_id").One(&doc)
+		if err != nil || len(doc.ID) != 12 {
+			continue
+		}
+		id := []byte(doc.ID)
+		n := int32(id[9])<<16 | int32(id[10])<<8 | int32(id[11])
+		if n >= next {
+			next = n + 1
+		}
+	}
+	return next
+}
+
+// copy the allowed keys of the options document, if any, into dst
+func copyOptions(dst bson.M, args []interface{}, allowed ...string) error {
+
+	if len(args) == 0 {
+		return nil
+	}
+	opts, ok := args[0].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("options must be an object, but was %v", args[0])
+	}
+	for _, k := range allowed {
+		if v, ok := opts[k]; ok {
+			dst[k] = v
+		}
+	}
+	return nil
+}
+
+// parse the arguments of a method, for example
+// {"k": 1}, [{"$set": {"k": 2}}], {"upsert": true}
+func arguments(queryBytes []byte) (args []interface{}, err error) {
+
+	b := make([]byte, 0, len(queryBytes)+2)
+	b = append(b, '[')
+	b = append(b, queryBytes...)
+	b = append(b, ']')
+
+	err = bson.UnmarshalJSON(b, &args)
+
+	return args, err
+}